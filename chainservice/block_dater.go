@@ -130,8 +130,10 @@ func (b *BlockDater) SetBoundaries(ctx context.Context) error {
 
 	b.Latest = &latest
 
-	// Calculates the average block time
-	b.BlockTime = float64(b.Latest.Timestamp-b.First.Timestamp) / float64(b.Latest.Number.Int64()-1)
+	// Calculates the average block time, unless it's configured
+	if b.BlockTime == 0 {
+		b.BlockTime = float64(b.Latest.Timestamp-b.First.Timestamp) / float64(b.Latest.Number.Int64()-1)
+	}
 	return nil
 }
 
@@ -33,8 +33,8 @@ type ChainService struct {
 	// network requests is started, we call rateLimiter.Take(), which will block if the bucket is full.
 	rateLimiter ratelimit.Limiter
 
-	// rpcs is a map from a chain to an api url.
-	rpcs map[apolloTypes.Chain]string
+	// chains is a map from a chain to its api url and metadata.
+	chains map[apolloTypes.Chain]apolloTypes.ChainInfo
 
 	// defaultTimeout is the default timeout after which any network request
 	// that the chainservice makes will time out.
@@ -49,11 +49,11 @@ type ChainService struct {
 	logParts int
 }
 
-func NewChainService(defaultTimeout time.Duration, actionsPerSecond, logParts int, rpcs map[apolloTypes.Chain]string) *ChainService {
+func NewChainService(defaultTimeout time.Duration, actionsPerSecond, logParts int, chains map[apolloTypes.Chain]apolloTypes.ChainInfo) *ChainService {
 	return &ChainService{
 		defaultTimeout:   defaultTimeout,
 		actionsPerSecond: actionsPerSecond,
-		rpcs:             rpcs,
+		chains:           chains,
 		clients:          make(map[apolloTypes.Chain]*CachedClient),
 		blockDaters:      make(map[apolloTypes.Chain]BlockDater),
 		rateLimiter:      ratelimit.New(actionsPerSecond),
@@ -63,17 +63,35 @@ func NewChainService(defaultTimeout time.Duration, actionsPerSecond, logParts in
 }
 
 // Connect will create a CachedClient and a BlockDater for the given chain
-// and store them in the maps.
+// and store them in the maps. It makes sure the RPC serves the configured chain ID.
 func (c *ChainService) Connect(ctx context.Context, chain apolloTypes.Chain) (*ChainService, error) {
-	client, err := ethclient.DialContext(ctx, c.rpcs[chain])
+	info, ok := c.chains[chain]
+	if !ok {
+		return nil, fmt.Errorf("Connect: chain %s is not defined in the config", chain)
+	}
+
+	client, err := ethclient.DialContext(ctx, info.Rpc)
 	if err != nil {
 		return nil, fmt.Errorf("Connect: %w", err)
 	}
 
-	c.logger.Debug().Str("rpc", c.rpcs[chain]).Msg("connected to rpc")
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Connect: getting chain ID of %s: %w", chain, err)
+	}
+
+	if chainID.Uint64() != info.ChainID {
+		return nil, fmt.Errorf("Connect: rpc of %s serves chain ID %s, expected %d", chain, chainID, info.ChainID)
+	}
+
+	c.logger.Debug().Str("rpc", log.RedactURL(info.Rpc)).Uint64("chain_id", info.ChainID).Msg("connected to rpc")
 
 	c.clients[chain] = NewCachedClient(client, c.logParts)
-	c.blockDaters[chain] = NewBlockDater(client)
+
+	blockDater := NewBlockDater(client)
+	blockDater.BlockTime = info.BlockTime
+	c.blockDaters[chain] = blockDater
+
 	return c, nil
 }
 
@@ -81,53 +99,32 @@ func (c *ChainService) Connect(ctx context.Context, chain apolloTypes.Chain) (*C
 // * it calls Connect to connect the client and block dater
 // * it determines the start and end blocks (using BlockDater), and run that
 // query concurrently.
+// EnsureConnected connects to the chain, unless we already have a client for it.
+func (c *ChainService) EnsureConnected(ctx context.Context, chain apolloTypes.Chain) error {
+	if _, ok := c.clients[chain]; ok {
+		return nil
+	}
+
+	_, err := c.Connect(ctx, chain)
+	return err
+}
+
 func (c *ChainService) Start(ctx context.Context, schema *dsl.DynamicSchema, opts apolloTypes.ApolloOpts, out chan<- apolloTypes.CallResult) error {
 	queryChannels := make(map[string]chan apolloTypes.CallResult, len(schema.QuerySchemas))
 	c.startTime = time.Now()
 
 	c.logger.Info().Msgf("running with %d queries", len(schema.QuerySchemas))
 	for i, query := range schema.QuerySchemas {
-		// Change query name into something that is guaranteed to be unique
-		// If we already have a client for this chain, don't create a new one
-		if _, ok := c.clients[query.Chain]; !ok {
-			if _, err := c.Connect(ctx, query.Chain); err != nil {
-				return err
-			}
+		if err := c.EnsureConnected(ctx, query.Chain); err != nil {
+			return err
 		}
 
-		query.StartBlock = schema.StartBlock
-		query.EndBlock = schema.EndBlock
-		query.BlockInterval = schema.BlockInterval
-
-		// If we're running in realtime mode we don't need all this
-		if !opts.Realtime {
-			// Fill in start, end and interval blocks per query, since these can differ
-			if schema.StartBlock == 0 && schema.StartTime != 0 {
-				query.StartBlock, err = c.BlockByTimestamp(ctx, query.Chain, schema.StartTime)
-				if err != nil {
-					return err
-				}
-			}
-
-			if schema.EndBlock == 0 && schema.EndTime != 0 {
-				query.EndBlock, err = c.BlockByTimestamp(ctx, query.Chain, schema.EndTime)
-				if err != nil {
-					return err
-				}
-			}
-
-			if schema.BlockInterval == 0 && schema.TimeInterval != 0 {
-				query.BlockInterval, err = c.SecondsToBlockInterval(ctx, query.Chain, schema.TimeInterval)
-				if err != nil {
-					return err
-				}
-			}
+		if err := c.ResolveQuery(ctx, schema, query, opts.Realtime); err != nil {
+			return err
 		}
 
 		queryKey := fmt.Sprintf("%d-%s", i, query.Name)
 		ch := c.handleQuery(query, opts)
-		// Problem, can't just use query.Name here since these are not always unique,
-		// in a loop for example. We need the loop variable to
 		queryChannels[queryKey] = ch
 	}
 
@@ -157,6 +154,45 @@ func (c *ChainService) Start(ctx context.Context, schema *dsl.DynamicSchema, opt
 	return nil
 }
 
+// ResolveQuery applies the top-level block range and intervals to the query if it doesn't define
+// its own, and in historical mode converts its timestamps to block numbers on its chain.
+// The query's chain has to be connected.
+func (c *ChainService) ResolveQuery(ctx context.Context, schema *dsl.DynamicSchema, query *dsl.QuerySchema, realtime bool) error {
+	var err error
+
+	// Every query can override the top-level block range and intervals
+	query.ApplyDefaults(schema)
+
+	// If we're running in realtime mode we don't need all this
+	if realtime {
+		return nil
+	}
+
+	// Fill in start, end and interval blocks per query, since these can differ
+	if query.StartBlock == 0 && query.StartTime != 0 {
+		query.StartBlock, err = c.BlockByTimestamp(ctx, query.Chain, query.StartTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if query.EndBlock == 0 && query.EndTime != 0 {
+		query.EndBlock, err = c.BlockByTimestamp(ctx, query.Chain, query.EndTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	if query.BlockInterval == 0 && query.TimeInterval != 0 {
+		query.BlockInterval, err = c.SecondsToBlockInterval(ctx, query.Chain, query.TimeInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // handleQuery is a non-blocking function that handles an individual query. It returns a channel
 // on which the results are sent.
 func (c ChainService) handleQuery(query *dsl.QuerySchema, opts apolloTypes.ApolloOpts) chan apolloTypes.CallResult {
@@ -164,17 +200,26 @@ func (c ChainService) handleQuery(query *dsl.QuerySchema, opts apolloTypes.Apoll
 	out := make(chan apolloTypes.CallResult)
 	c.logger.Debug().Str("query", query.Name).Msg("starting query")
 
+	// Historical results are sent in chain order, unless that's disabled. Stateful queries
+	// always need their results in order.
+	ordered := !opts.Realtime && (!opts.Unordered || query.HasState())
+
 	switch {
 	// CONTRACT METHODS
 	case query.HasContractMethods():
-		go c.RunMethodCaller(query, opts.Realtime, blocks, out)
+		go c.RunMethodCaller(query, opts.Realtime, ordered, blocks, out)
 
 		// Start main program loop
 		if opts.Realtime {
+			interval := query.BlockInterval
+			if query.TimeInterval != 0 {
+				interval = query.TimeInterval
+			}
+
 			go func() {
 				for {
 					blocks <- nil
-					time.Sleep(time.Duration(query.BlockInterval) * time.Second)
+					time.Sleep(time.Duration(interval) * time.Second)
 				}
 			}()
 		} else {
@@ -196,7 +241,7 @@ func (c ChainService) handleQuery(query *dsl.QuerySchema, opts apolloTypes.Apoll
 			}()
 		} else {
 			go func() {
-				c.FilterGlobalEvents(query, big.NewInt(query.StartBlock), big.NewInt(query.EndBlock), out)
+				c.FilterGlobalEvents(query, big.NewInt(query.StartBlock), big.NewInt(query.EndBlock), ordered, out)
 			}()
 		}
 
@@ -209,7 +254,7 @@ func (c ChainService) handleQuery(query *dsl.QuerySchema, opts apolloTypes.Apoll
 			}()
 		} else {
 			go func() {
-				c.FilterEvents(query, big.NewInt(query.StartBlock), big.NewInt(query.EndBlock), out)
+				c.FilterEvents(query, big.NewInt(query.StartBlock), big.NewInt(query.EndBlock), ordered, out)
 			}()
 		}
 	}
@@ -241,24 +286,22 @@ func (c ChainService) SecondsToBlockInterval(ctx context.Context, chain apolloTy
 	return n, nil
 }
 
-func (c ChainService) Balance(chain apolloTypes.Chain, address common.Address, block *big.Int) (float64, error) {
+// Balance returns the native balance of address at the given block, parsed
+// with the native decimals of the chain.
+func (c ChainService) Balance(chain apolloTypes.Chain, address common.Address, block *big.Int) (*big.Float, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	rawInt, err := c.clients[chain].client.BalanceAt(ctx, address, block)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	raw := new(big.Float).SetInt(rawInt)
-
-	decimals := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
-
-	parsed, _ := raw.Quo(raw, new(big.Float).SetInt(decimals)).Float64()
-
-	return parsed, nil
+	return dsl.ScaleDecimals(rawInt, int64(c.chains[chain].NativeDecimals)), nil
 }
 
-func (c ChainService) TokenBalance(chain apolloTypes.Chain, address, tokenAddress common.Address, block *big.Int) (float64, error) {
+// TokenBalance returns the ERC20 balance of address at the given block, parsed
+// with the decimals of the token.
+func (c ChainService) TokenBalance(chain apolloTypes.Chain, address, tokenAddress common.Address, block *big.Int) (*big.Float, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -266,28 +309,22 @@ func (c ChainService) TokenBalance(chain apolloTypes.Chain, address, tokenAddres
 
 	tokenCaller, err := erc20.NewErc20Caller(tokenAddress, client)
 	if err != nil {
-		return 0, fmt.Errorf("creating erc20 caller: %w", err)
+		return nil, fmt.Errorf("creating erc20 caller: %w", err)
 	}
 
 	opts := &bind.CallOpts{Context: ctx, BlockNumber: block}
 	rawDecimals, err := tokenCaller.Decimals(opts)
 	// rawInt, err := .BalanceAt(ctx, address, block)
 	if err != nil {
-		return 0, fmt.Errorf("reading erc20 decimals (block: %d): %w", block, err)
+		return nil, fmt.Errorf("reading erc20 decimals (block: %d): %w", block, err)
 	}
 
 	rawInt, err := tokenCaller.BalanceOf(opts, address)
 	if err != nil {
-		return 0, fmt.Errorf("reading erc20 balanceOf (block: %d): %w", block, err)
+		return nil, fmt.Errorf("reading erc20 balanceOf (block: %d): %w", block, err)
 	}
 
-	raw := new(big.Float).SetInt(rawInt)
-
-	decimals := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(rawDecimals)), nil)
-
-	parsed, _ := raw.Quo(raw, new(big.Float).SetInt(decimals)).Float64()
-
-	return parsed, nil
+	return dsl.ScaleDecimals(rawInt, int64(rawDecimals)), nil
 }
 
 func (c ChainService) DumpMetrics() {
@@ -40,7 +40,7 @@ func TestExecCallContracts(t *testing.T) {
 	blocks := make(chan *big.Int)
 
 	res := make(chan types.CallResult)
-	service.RunMethodCaller(schema.QuerySchemas[0], true, blocks, res)
+	service.RunMethodCaller(schema.QuerySchemas[0], true, false, blocks, res)
 
 	// Latest block, then close
 	blocks <- nil
@@ -4,8 +4,8 @@ import (
 	"context"
 	"fmt"
 	"math/big"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/chainbound/apollo/dsl"
@@ -17,11 +17,22 @@ import (
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
+// eventLog is a log that was fetched for an event of a query, with everything needed to handle it.
+type eventLog struct {
+	log           types.Log
+	identifier    string
+	address       common.Address
+	abi           abi.ABI
+	event         *dsl.EventSchema
+	indexedEvents map[string]int
+}
+
 // FilterEvents handles the event query from `fromBlock` to `toBlock` concurrently, and sends the results on the
 // `out` channel. It blocks until every event is handled, and won't fail on an error (could be a network timeout).
-// If there is an error, it will be on the Err field of the CallResult.
-func (c ChainService) FilterEvents(query *dsl.QuerySchema, fromBlock, toBlock *big.Int, out chan<- apolloTypes.CallResult) {
-	var wg sync.WaitGroup
+// If there is an error, it will be on the Err field of the CallResult. If ordered is true, the results are sent in
+// chain order (block number, transaction index, log index).
+func (c ChainService) FilterEvents(query *dsl.QuerySchema, fromBlock, toBlock *big.Int, ordered bool, out chan<- apolloTypes.CallResult) {
+	defer close(out)
 
 	if toBlock.Cmp(big.NewInt(0)) == 0 {
 		toBlock = nil
@@ -29,6 +40,7 @@ func (c ChainService) FilterEvents(query *dsl.QuerySchema, fromBlock, toBlock *b
 
 	rlClient := c.clients[query.Chain]
 
+	var logs []eventLog
 	for _, cs := range query.ContractSchemas {
 		for _, event := range cs.Events {
 			c.logger.Debug().Str("contract", cs.Address().String()).
@@ -44,25 +56,10 @@ func (c ChainService) FilterEvents(query *dsl.QuerySchema, fromBlock, toBlock *b
 				return
 			}
 
-			indexedEvents := make(map[string]int)
-			abiEvent := cs.Abi.Events[event.Name()]
-
-			// Collect the indexes for the events that are "indexed" (they appear in the "topics" of the log)
-			for i, arg := range abiEvent.Inputs {
-				if arg.Indexed {
-					for _, o := range event.Outputs() {
-						if arg.Name == o {
-							// First index is always the main topic
-							indexedEvents[arg.Name] = i + 1
-						}
-					}
-				}
-			}
-
 			ctx, cancel := context.WithTimeout(context.Background(), c.defaultTimeout)
 			defer cancel()
 
-			logs, err := rlClient.SmartFilterLogs(ctx, []common.Address{cs.Address()}, [][]common.Hash{{topic}}, fromBlock, toBlock)
+			eventLogs, err := rlClient.SmartFilterLogs(ctx, []common.Address{cs.Address()}, [][]common.Hash{{topic}}, fromBlock, toBlock)
 			if err != nil {
 				c.logger.Debug().Str("chain", string(query.Chain)).Err(err).Msg("getting logs from node")
 				out <- apolloTypes.CallResult{
@@ -71,58 +68,32 @@ func (c ChainService) FilterEvents(query *dsl.QuerySchema, fromBlock, toBlock *b
 				return
 			}
 
-			c.logger.Trace().Str("start_block", fromBlock.String()).Str("end_block", toBlock.String()).Int("n_logs", len(logs)).Msg("filtered logs")
-
-			for _, log := range logs {
-				wg.Add(1)
-				go func(log types.Log) {
-					defer wg.Done()
-					result, err := c.HandleLog(log, query.Chain, cs.Address().String(), cs.Abi, event, indexedEvents)
-					if err != nil {
-						out <- apolloTypes.CallResult{
-							Err: fmt.Errorf("handling log: %w", err),
-						}
-						return
-					}
-
-					if result == nil {
-						return
-					}
-
-					results := []*apolloTypes.CallResult{result}
-					for _, method := range event.Methods {
-						c.logger.Trace().Int64("block_offset", method.BlockOffset).Str("chain", string(query.Chain)).Msg("calling method at event")
-						callResult, err := c.callMethod(query.Chain, cs.Address(), cs.Abi, method, big.NewInt(int64(log.BlockNumber)+method.BlockOffset))
-						if err != nil {
-							out <- apolloTypes.CallResult{
-								Err: fmt.Errorf("calling method on event: %w", err),
-							}
-							return
-						}
-
-						results = append(results, callResult)
-					}
-
-					callResult := aggregateCallResults(results...)
-					callResult.Type = apolloTypes.Event
-					callResult.QueryName = query.Name
-
-					out <- *callResult
-				}(log)
+			c.logger.Trace().Str("start_block", fromBlock.String()).Str("end_block", toBlock.String()).Int("n_logs", len(eventLogs)).Msg("filtered logs")
+
+			indexedEvents := indexedEventOutputs(cs.Abi, event)
+			for _, log := range eventLogs {
+				logs = append(logs, eventLog{
+					log:           log,
+					identifier:    cs.Address().String(),
+					address:       cs.Address(),
+					abi:           cs.Abi,
+					event:         event,
+					indexedEvents: indexedEvents,
+				})
 			}
 		}
 	}
 
-	wg.Wait()
-	close(out)
+	c.processLogs(query, logs, apolloTypes.Event, ordered, out)
 }
 
 // FilterGlobalEvents is like FilterEvents but for global events.
-func (c ChainService) FilterGlobalEvents(query *dsl.QuerySchema, fromBlock, toBlock *big.Int, out chan<- apolloTypes.CallResult) {
-	var wg sync.WaitGroup
+func (c ChainService) FilterGlobalEvents(query *dsl.QuerySchema, fromBlock, toBlock *big.Int, ordered bool, out chan<- apolloTypes.CallResult) {
+	defer close(out)
 
 	rlClient := c.clients[query.Chain]
 
+	var logs []eventLog
 	for _, event := range query.EventSchemas {
 		c.logger.Debug().
 			Str("event", event.Name()).Str("from_block", fromBlock.String()).
@@ -137,25 +108,10 @@ func (c ChainService) FilterGlobalEvents(query *dsl.QuerySchema, fromBlock, toBl
 			return
 		}
 
-		indexedEvents := make(map[string]int)
-		abiEvent := event.Abi.Events[event.Name()]
-
-		// Collect the indexes for the events that are "indexed" (they appear in the "topics" of the log)
-		for i, arg := range abiEvent.Inputs {
-			if arg.Indexed {
-				for _, o := range event.Outputs() {
-					if arg.Name == o {
-						// First index is always the main topic
-						indexedEvents[arg.Name] = i + 1
-					}
-				}
-			}
-		}
-
 		ctx, cancel := context.WithTimeout(context.Background(), c.defaultTimeout)
 		defer cancel()
 
-		logs, err := rlClient.SmartFilterLogs(ctx, nil, [][]common.Hash{{topic}}, fromBlock, toBlock)
+		eventLogs, err := rlClient.SmartFilterLogs(ctx, nil, [][]common.Hash{{topic}}, fromBlock, toBlock)
 		if err != nil {
 			c.logger.Debug().Str("chain", string(query.Chain)).Err(err).Msg("getting logs from node")
 			out <- apolloTypes.CallResult{
@@ -164,55 +120,104 @@ func (c ChainService) FilterGlobalEvents(query *dsl.QuerySchema, fromBlock, toBl
 			return
 		}
 
-		c.logger.Trace().Str("start_block", fromBlock.String()).Str("end_block", toBlock.String()).Int("n_logs", len(logs)).Msg("filtered logs")
+		c.logger.Trace().Str("start_block", fromBlock.String()).Str("end_block", toBlock.String()).Int("n_logs", len(eventLogs)).Msg("filtered logs")
 
-		for _, log := range logs {
-			wg.Add(1)
-			go func(log types.Log) {
-				defer wg.Done()
+		indexedEvents := indexedEventOutputs(event.Abi, event)
+		for _, log := range eventLogs {
+			// If len(log.Data) == 0, we have the wrong log
+			if len(log.Data) == 0 {
+				continue
+			}
 
-				// If len(log.Data) == 0, we have the wrong log
-				if len(log.Data) == 0 {
-					return
-				}
+			logs = append(logs, eventLog{
+				log:           log,
+				identifier:    event.OutputName(),
+				address:       log.Address,
+				abi:           event.Abi,
+				event:         event,
+				indexedEvents: indexedEvents,
+			})
+		}
+	}
 
-				result, err := c.HandleLog(log, query.Chain, event.OutputName(), event.Abi, event, indexedEvents)
+	c.processLogs(query, logs, apolloTypes.GlobalEvent, ordered, out)
+}
+
+// processLogs handles the logs concurrently, and calls the methods of their events at the block of the log.
+// If ordered is true, the logs are sorted and their results are sent in chain order.
+func (c ChainService) processLogs(query *dsl.QuerySchema, logs []eventLog, resultType apolloTypes.ResultType, ordered bool, out chan<- apolloTypes.CallResult) {
+	if ordered {
+		sort.SliceStable(logs, func(i, j int) bool {
+			a, b := logs[i].log, logs[j].log
+			if a.BlockNumber != b.BlockNumber {
+				return a.BlockNumber < b.BlockNumber
+			}
+
+			if a.TxIndex != b.TxIndex {
+				return a.TxIndex < b.TxIndex
+			}
+
+			return a.Index < b.Index
+		})
+	}
+
+	seq := newSequencer(ordered, out)
+	for _, l := range logs {
+		l := l
+		seq.Go(func() []apolloTypes.CallResult {
+			result, err := c.HandleLog(l.log, query.Chain, l.identifier, l.abi, l.event, l.indexedEvents)
+			if err != nil {
+				return []apolloTypes.CallResult{{
+					Err: fmt.Errorf("handling log: %w", err),
+				}}
+			}
+
+			if result == nil {
+				return nil
+			}
+
+			results := []*apolloTypes.CallResult{result}
+			for _, method := range l.event.Methods {
+				c.logger.Trace().Int64("block_offset", method.BlockOffset).Str("chain", string(query.Chain)).Msg("calling method at event")
+				callResult, err := c.callMethod(query.Chain, l.address, l.abi, method, big.NewInt(int64(l.log.BlockNumber)+method.BlockOffset))
 				if err != nil {
-					out <- apolloTypes.CallResult{
-						Err: fmt.Errorf("handling log: %w", err),
-					}
-					return
+					return []apolloTypes.CallResult{{
+						Err: fmt.Errorf("calling method on event: %w", err),
+					}}
 				}
 
-				if result == nil {
-					return
-				}
+				results = append(results, callResult)
+			}
 
-				results := []*apolloTypes.CallResult{result}
-				for _, method := range event.Methods {
-					c.logger.Trace().Int64("block_offset", method.BlockOffset).Str("chain", string(query.Chain)).Msg("calling method at event")
-					callResult, err := c.callMethod(query.Chain, log.Address, event.Abi, method, big.NewInt(int64(log.BlockNumber)+method.BlockOffset))
-					if err != nil {
-						out <- apolloTypes.CallResult{
-							Err: fmt.Errorf("calling method on event: %w", err),
-						}
-						return
-					}
+			callResult := aggregateCallResults(results...)
+			callResult.Type = resultType
+			callResult.QueryName = query.Name
 
-					results = append(results, callResult)
-				}
+			return []apolloTypes.CallResult{*callResult}
+		})
+	}
 
-				callResult := aggregateCallResults(results...)
-				callResult.Type = apolloTypes.GlobalEvent
-				callResult.QueryName = query.Name
+	seq.Wait()
+}
 
-				out <- *callResult
-			}(log)
+// indexedEventOutputs collects the indexes of the outputs of the event that are "indexed"
+// (they appear in the "topics" of the log).
+func indexedEventOutputs(contractAbi abi.ABI, event *dsl.EventSchema) map[string]int {
+	indexedEvents := make(map[string]int)
+	abiEvent := contractAbi.Events[event.Name()]
+
+	for i, arg := range abiEvent.Inputs {
+		if arg.Indexed {
+			for _, o := range event.Outputs() {
+				if arg.Name == o {
+					// First index is always the main topic
+					indexedEvents[arg.Name] = i + 1
+				}
+			}
 		}
 	}
 
-	wg.Wait()
-	close(out)
+	return indexedEvents
 }
 
 // ListenForEvents handles the event query for realtime use, and will open a subscription
@@ -225,7 +230,10 @@ func (c ChainService) ListenForEvents(query *dsl.QuerySchema, out chan<- apolloT
 
 	go func() {
 		for _, cs := range query.ContractSchemas {
+			cs := cs
 			for _, event := range cs.Events {
+				event := event
+
 				// Get first topic in Bytes (to filter events)
 				topic, err := generate.GetTopic(event.Name_, cs.Abi)
 				if err != nil {
@@ -325,6 +333,8 @@ func (c ChainService) ListenForGlobalEvents(query *dsl.QuerySchema, res chan<- a
 	rlClient := c.clients[query.Chain]
 
 	for _, event := range query.EventSchemas {
+		event := event
+
 		// Get first topic in Bytes (to filter events)
 		topic, err := generate.GetTopic(event.Name_, event.Abi)
 		if err != nil {
@@ -478,6 +488,7 @@ func (c ChainService) HandleLog(log types.Log, chain apolloTypes.Chain, queryNam
 		BlockHash:       log.BlockHash,
 		TxHash:          log.TxHash,
 		TxIndex:         log.TxIndex,
+		LogIndex:        log.Index,
 		Timestamp:       h.Time,
 		Outputs:         outputs,
 	}, nil
@@ -17,31 +17,40 @@ import (
 )
 
 // RunMethodCaller starts a listening channel on `blocks`, and on every incoming block it will execute all methods concurrently
-// on the given blockNumber, and send the results on the `out` channel.
-func (c *ChainService) RunMethodCaller(query *dsl.QuerySchema, realtime bool, blocks <-chan *big.Int, out chan<- apolloTypes.CallResult) {
-	var wg sync.WaitGroup
+// on the given blockNumber, and send the results on the `out` channel. If ordered is true, the results are sent in the order
+// of the incoming blocks.
+func (c *ChainService) RunMethodCaller(query *dsl.QuerySchema, realtime, ordered bool, blocks <-chan *big.Int, out chan<- apolloTypes.CallResult) {
+	seq := newSequencer(ordered, out)
 	c.logger.Debug().Msg("contract methods")
 
 	// For every incoming blockNumber, loop over contract methods and starts a goroutine for each method.
 	// This way, every eth_call will happen concurrently.
 	for blockNumber := range blocks {
-		wg.Add(1)
 		c.logger.Trace().Str("block", blockNumber.String()).Msg("new block")
-		go func(blockNumber *big.Int) {
-			defer wg.Done()
+		blockNumber := blockNumber
+		seq.Go(func() []apolloTypes.CallResult {
+			var blockResults []apolloTypes.CallResult
 			for _, contract := range query.ContractSchemas {
-				var wg2 sync.WaitGroup
-				var results []*apolloTypes.CallResult
+				var (
+					wg2     sync.WaitGroup
+					mu      sync.Mutex
+					results []*apolloTypes.CallResult
+				)
+
 				for _, method := range contract.Methods {
 					wg2.Add(1)
 					go func(contract *dsl.ContractSchema, method *dsl.MethodSchema) {
 						defer wg2.Done()
 						c.rateLimiter.Take()
 						result, err := c.callMethod(query.Chain, contract.Address(), contract.Abi, method, blockNumber)
+
+						mu.Lock()
+						defer mu.Unlock()
+
 						if err != nil {
-							out <- apolloTypes.CallResult{
+							blockResults = append(blockResults, apolloTypes.CallResult{
 								Err: err,
-							}
+							})
 							return
 						}
 
@@ -61,13 +70,15 @@ func (c *ChainService) RunMethodCaller(query *dsl.QuerySchema, realtime bool, bl
 					}
 
 					callResult.QueryName = query.Name
-					out <- callResult
+					blockResults = append(blockResults, callResult)
 				}
 			}
-		}(blockNumber)
+
+			return blockResults
+		})
 	}
 
-	wg.Wait()
+	seq.Wait()
 	close(out)
 }
 
@@ -0,0 +1,83 @@
+package chainservice
+
+import (
+	"sync"
+
+	apolloTypes "github.com/chainbound/apollo/types"
+)
+
+// maxPendingJobs is the number of jobs an ordered sequencer runs concurrently. It bounds
+// the number of results that are kept in memory while waiting for earlier jobs.
+const maxPendingJobs = 256
+
+// sequencer runs jobs concurrently and sends their results on the out channel. If it's ordered,
+// the results are sent in the order the jobs were started, otherwise as soon as they're ready.
+type sequencer struct {
+	ordered bool
+	out     chan<- apolloTypes.CallResult
+
+	// wg keeps track of the running jobs in unordered mode
+	wg sync.WaitGroup
+
+	// slots holds a channel for every pending job in ordered mode, in the order they were started.
+	// Its capacity limits the number of pending jobs.
+	slots chan chan []apolloTypes.CallResult
+	done  chan struct{}
+}
+
+func newSequencer(ordered bool, out chan<- apolloTypes.CallResult) *sequencer {
+	s := &sequencer{
+		ordered: ordered,
+		out:     out,
+	}
+
+	if ordered {
+		s.slots = make(chan chan []apolloTypes.CallResult, maxPendingJobs)
+		s.done = make(chan struct{})
+
+		go func() {
+			for slot := range s.slots {
+				for _, res := range <-slot {
+					s.out <- res
+				}
+			}
+
+			close(s.done)
+		}()
+	}
+
+	return s
+}
+
+// Go runs the job in a new goroutine. In ordered mode, it blocks while there are
+// too many pending jobs.
+func (s *sequencer) Go(job func() []apolloTypes.CallResult) {
+	if !s.ordered {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for _, res := range job() {
+				s.out <- res
+			}
+		}()
+
+		return
+	}
+
+	slot := make(chan []apolloTypes.CallResult, 1)
+	s.slots <- slot
+	go func() {
+		slot <- job()
+	}()
+}
+
+// Wait blocks until all jobs are done and their results are sent. No jobs can be started afterwards.
+func (s *sequencer) Wait() {
+	if !s.ordered {
+		s.wg.Wait()
+		return
+	}
+
+	close(s.slots)
+	<-s.done
+}
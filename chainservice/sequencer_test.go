@@ -0,0 +1,41 @@
+package chainservice
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	apolloTypes "github.com/chainbound/apollo/types"
+)
+
+func TestSequencerOrdered(t *testing.T) {
+	out := make(chan apolloTypes.CallResult)
+	n := maxPendingJobs * 2
+
+	go func() {
+		seq := newSequencer(true, out)
+		for i := 0; i < n; i++ {
+			i := i
+			seq.Go(func() []apolloTypes.CallResult {
+				// Finish in random order
+				time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+				return []apolloTypes.CallResult{{BlockNumber: uint64(i)}}
+			})
+		}
+
+		seq.Wait()
+		close(out)
+	}()
+
+	expected := uint64(0)
+	for res := range out {
+		if res.BlockNumber != expected {
+			t.Fatalf("expected block %d, got %d", expected, res.BlockNumber)
+		}
+		expected++
+	}
+
+	if expected != uint64(n) {
+		t.Fatalf("expected %d results, got %d", n, expected)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chainbound/apollo/chainservice"
+	"github.com/chainbound/apollo/dsl"
+	"github.com/chainbound/apollo/output"
+	"github.com/chainbound/apollo/types"
+)
+
+// loadSchema loads the config and the schema, using the paths from the options if they're set.
+func loadSchema(opts types.ApolloOpts) (*Config, *dsl.DynamicSchema, error) {
+	confPath := opts.ConfigPath
+	if confPath == "" {
+		var err error
+		confPath, err = ConfigPath()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	cfg, err := NewConfig(confPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	schemaPath := opts.SchemaPath
+	if schemaPath == "" {
+		schemaPath, err = SchemaPath()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var schemaOpts []dsl.SchemaOption
+	if opts.AbiDir != "" {
+		schemaOpts = append(schemaOpts, dsl.WithAbiDir(opts.AbiDir))
+	}
+
+	schema, err := dsl.NewSchema(schemaPath, schemaOpts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	schema.SetChains(cfg.Chains())
+
+	return cfg, schema, nil
+}
+
+// Validate checks the schema without running it: the block ranges and intervals, the ABIs,
+// the chains in the config and the types of all expressions.
+func Validate(opts types.ApolloOpts) error {
+	cfg, schema, err := loadSchema(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := schema.Validate(opts); err != nil {
+		return err
+	}
+
+	chains := make([]types.Chain, 0, len(cfg.Chains()))
+	for chain := range cfg.Chains() {
+		chains = append(chains, chain)
+	}
+
+	if err := schema.Check(chains); err != nil {
+		errs, ok := err.(dsl.CheckErrors)
+		if !ok {
+			return err
+		}
+
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, dsl.FormatError(e, isTerminal(os.Stderr)))
+		}
+
+		return fmt.Errorf("schema has %d problem(s)", len(errs))
+	}
+
+	fmt.Printf("schema is valid: %d queries, %d derived queries\n", len(schema.QuerySchemas), len(schema.DerivedSchemas))
+
+	return nil
+}
+
+// Plan resolves the block ranges of every query and prints the estimated number of
+// requests and the output tables, without running the queries.
+func Plan(opts types.ApolloOpts) error {
+	cfg, schema, err := loadSchema(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := schema.Validate(opts); err != nil {
+		return err
+	}
+
+	service := chainservice.NewChainService(time.Second*30, opts.RateLimit, opts.LogParts, cfg.Chains())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, q := range schema.QuerySchemas {
+		if err := service.EnsureConnected(ctx, q.Chain); err != nil {
+			return err
+		}
+
+		if err := service.ResolveQuery(ctx, schema, q, opts.Realtime); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+
+		columns, err := q.Columns()
+		if err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+
+		fmt.Fprintf(w, "query %s\t(%s)\n", q.Name, q.Chain)
+		fmt.Fprintf(w, "  blocks\t%s\n", planRange(q, opts.Realtime))
+		for _, line := range planRequests(q, opts) {
+			fmt.Fprintf(w, "  requests\t%s\n", line)
+		}
+		fmt.Fprintf(w, "  output\t%s\n", planOutput(q.Name, columns, opts, cfg.Webhook))
+		fmt.Fprintln(w)
+	}
+
+	for _, d := range schema.DerivedSchemas {
+		columns, err := d.Columns()
+		if err != nil {
+			return fmt.Errorf("derived query %s: %w", d.Name, err)
+		}
+
+		fmt.Fprintf(w, "derived %s\t(joins %s on %s)\n", d.Name, strings.Join(d.Sources, ", "), strings.Join(d.On, ", "))
+		fmt.Fprintf(w, "  output\t%s\n", planOutput(d.Name, columns, opts, cfg.Webhook))
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+func planRange(q *dsl.QuerySchema, realtime bool) string {
+	if realtime {
+		return "realtime"
+	}
+
+	end := "latest"
+	if q.EndBlock != 0 {
+		end = fmt.Sprint(q.EndBlock)
+	}
+
+	if q.BlockInterval != 0 {
+		return fmt.Sprintf("%d to %s, every %d blocks", q.StartBlock, end, q.BlockInterval)
+	}
+
+	return fmt.Sprintf("%d to %s", q.StartBlock, end)
+}
+
+// planRequests estimates the requests the query will make.
+func planRequests(q *dsl.QuerySchema, opts types.ApolloOpts) []string {
+	var lines []string
+
+	methods := 0
+	for _, c := range q.ContractSchemas {
+		methods += len(c.Methods)
+	}
+
+	if methods > 0 {
+		if opts.Realtime {
+			lines = append(lines, fmt.Sprintf("%d eth_call per interval", methods))
+		} else if q.BlockInterval > 0 && q.EndBlock > q.StartBlock {
+			calls := (q.EndBlock - q.StartBlock + q.BlockInterval - 1) / q.BlockInterval
+			lines = append(lines, fmt.Sprintf("%d eth_call (%d blocks x %d methods)", calls*int64(methods), calls, methods))
+		}
+	}
+
+	var events []*dsl.EventSchema
+	for _, c := range q.ContractSchemas {
+		events = append(events, c.Events...)
+	}
+	events = append(events, q.EventSchemas...)
+
+	if len(events) == 0 {
+		return lines
+	}
+
+	if opts.Realtime {
+		lines = append(lines, fmt.Sprintf("%d log subscriptions", len(events)))
+	} else {
+		lines = append(lines, fmt.Sprintf("at least %d eth_getLogs (%d events x %d parts)", len(events)*opts.LogParts, len(events), opts.LogParts))
+	}
+
+	perLog := 0
+	for _, e := range events {
+		perLog += len(e.Methods)
+	}
+
+	if perLog > 0 {
+		lines = append(lines, fmt.Sprintf("%d eth_call per log", perLog))
+	}
+
+	lines = append(lines, "1 eth_getBlockByNumber per block with logs")
+
+	return lines
+}
+
+func planOutput(name string, columns []string, opts types.ApolloOpts, webhook output.WebhookSettings) string {
+	var sinks []string
+	if opts.StdoutFormat == "json" {
+		sinks = append(sinks, "stdout (json)")
+	} else if opts.Stdout {
+		sinks = append(sinks, "stdout")
+	}
+
+	if opts.Json {
+		sinks = append(sinks, filepath.Join(opts.OutputDir, name+".ndjson"))
+	}
+
+	if opts.Parquet {
+		file := name + ".parquet"
+		if opts.ParquetMaxRows > 0 || opts.ParquetMaxBlocks > 0 {
+			file = name + "-*.parquet"
+		}
+
+		sinks = append(sinks, filepath.Join(opts.OutputDir, file))
+	}
+
+	if opts.Csv {
+		sinks = append(sinks, filepath.Join(opts.OutputDir, name+".csv"))
+	}
+
+	if opts.Db {
+		sinks = append(sinks, "table "+name)
+	}
+
+	if opts.SQLitePath != "" {
+		sinks = append(sinks, fmt.Sprintf("table %s in %s", name, opts.SQLitePath))
+	}
+
+	if url := webhook.URLFor(name); opts.Webhook && url != "" {
+		sinks = append(sinks, "POST "+url)
+	}
+
+	if opts.StreamAddr != "" {
+		sinks = append(sinks, fmt.Sprintf("streams %s/ws/%s and %s/sse/%s", opts.StreamAddr, name, opts.StreamAddr, name))
+	}
+
+	if len(sinks) == 0 {
+		sinks = append(sinks, "no output selected")
+	}
+
+	return fmt.Sprintf("%s [%s]", strings.Join(sinks, ", "), strings.Join(columns, ", "))
+}
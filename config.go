@@ -1,20 +1,42 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/chainbound/apollo/db"
+	"github.com/chainbound/apollo/generate"
+	"github.com/chainbound/apollo/log"
+	"github.com/chainbound/apollo/output"
 	"github.com/chainbound/apollo/types"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Rpc        map[types.Chain]string `yaml:"rpc"`
-	DbSettings db.DbSettings          `yaml:"postgres"`
+	Rpc map[types.Chain]string `yaml:"rpc"`
+	// ChainInfos defines custom chains, or overrides the metadata of the default chains.
+	ChainInfos map[types.Chain]types.ChainInfo `yaml:"chains"`
+	// DbSettings are the settings of the database output. The dialect selects the database.
+	DbSettings db.DbSettings `yaml:"db"`
+	// PostgresSettings is the `postgres` section of configs from before dialects were added.
+	// It's used if there is no `db` section.
+	PostgresSettings db.DbSettings `yaml:"postgres"`
+	// Webhook are the settings of the webhook output.
+	Webhook output.WebhookSettings `yaml:"webhook"`
+
+	// chains contains every configured chain, with its metadata.
+	chains map[types.Chain]types.ChainInfo
 }
 
+// interpolation matches `${env:NAME}` and `${file:PATH}` references in config values.
+// A reference can be escaped as `$${...}`.
+var interpolation = regexp.MustCompile(`\$?\$\{(env|file):([^}]+)\}`)
+
 func NewConfig(path string) (*Config, error) {
 	var c Config
 
@@ -23,13 +45,188 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	if err = yaml.Unmarshal(f, &c); err != nil {
+	var root yaml.Node
+	if err = yaml.Unmarshal(f, &root); err != nil {
 		return nil, err
 	}
 
+	if err = interpolateNode(&root, filepath.Dir(path), false); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	// Decode the interpolated values into the config
+	if !root.IsZero() {
+		if err = root.Decode(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	if c.DbSettings == (db.DbSettings{}) {
+		c.DbSettings = c.PostgresSettings
+		c.DbSettings.Dialect = "postgres"
+	}
+
+	log.AddSecret(c.DbSettings.Password)
+	log.AddSecret(c.Webhook.Secret)
+
+	if _, err := generate.NewDialect(c.DbSettings.Dialect); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	if c.chains, err = c.buildChains(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
 	return &c, nil
 }
 
+// Chains returns every chain that has an RPC, with its metadata.
+func (c Config) Chains() map[types.Chain]types.ChainInfo {
+	return c.chains
+}
+
+// buildChains merges the RPCs, the chain definitions and the metadata of the default chains.
+// Every chain needs an RPC and a chain ID, the other metadata is optional.
+func (c Config) buildChains() (map[types.Chain]types.ChainInfo, error) {
+	chains := make(map[types.Chain]types.ChainInfo, len(c.Rpc)+len(c.ChainInfos))
+
+	for chain, rpc := range c.Rpc {
+		chains[chain] = types.DefaultChains[chain].Merge(types.ChainInfo{Rpc: rpc})
+	}
+
+	for chain, info := range c.ChainInfos {
+		existing, ok := chains[chain]
+		if !ok {
+			existing = types.DefaultChains[chain]
+		}
+
+		chains[chain] = existing.Merge(info)
+	}
+
+	for chain, info := range chains {
+		if info.Rpc == "" {
+			return nil, fmt.Errorf("chain %s has no rpc", chain)
+		}
+
+		if info.ChainID == 0 {
+			return nil, fmt.Errorf("chain %s has no chain_id", chain)
+		}
+
+		if info.NativeDecimals == 0 {
+			info.NativeDecimals = 18
+			chains[chain] = info
+		}
+	}
+
+	return chains, nil
+}
+
+// secretFields are the config fields that contain credentials, like the API keys in RPC URLs.
+// Values that are interpolated into them, or into any field below them, are secrets.
+var secretFields = map[string]bool{
+	"password": true,
+	"secret":   true,
+	"rpc":      true,
+	"url":      true,
+	"urls":     true,
+}
+
+// interpolateNode interpolates every scalar in the YAML node n. secret is true if n is
+// in a secret field.
+func interpolateNode(n *yaml.Node, dir string, secret bool) error {
+	switch n.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range n.Content {
+			if err := interpolateNode(child, dir, secret); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			if err := interpolateNode(n.Content[i+1], dir, secret || secretFields[key]); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		value, err := interpolate(n.Value, dir, secret)
+		if err != nil {
+			return err
+		}
+
+		if value == n.Value {
+			return nil
+		}
+
+		n.Value = value
+
+		// Plain scalars get the type of their interpolated value, so `chain_id: ${env:CHAIN_ID}`
+		// is a number. The text is kept as is for string fields.
+		if n.Style == 0 {
+			n.Tag = "!!str"
+			switch tag := (&yaml.Node{Kind: yaml.ScalarNode, Value: value}).ShortTag(); tag {
+			case "!!int", "!!float", "!!bool":
+				n.Tag = tag
+			}
+		}
+	}
+
+	return nil
+}
+
+// interpolate replaces `${env:NAME}` with the environment variable NAME, and `${file:PATH}` with
+// the contents of the file at PATH, without surrounding whitespace. Relative paths are relative to dir.
+// Files hold secrets, so their contents are redacted in the logs, like every value that is
+// interpolated into a secret field. Other environment variables, like hosts, are not.
+func interpolate(s, dir string, secret bool) (string, error) {
+	var err error
+
+	out := interpolation.ReplaceAllStringFunc(s, func(ref string) string {
+		if strings.HasPrefix(ref, "$$") {
+			return ref[1:]
+		}
+
+		m := interpolation.FindStringSubmatch(ref)
+		kind, name := m[1], strings.TrimSpace(m[2])
+
+		var value string
+		switch kind {
+		case "env":
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				err = fmt.Errorf("environment variable %s is not set", name)
+				return ref
+			}
+
+			value = v
+		case "file":
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(dir, name)
+			}
+
+			contents, readErr := os.ReadFile(name)
+			if readErr != nil {
+				err = fmt.Errorf("reading secret file: %w", readErr)
+				return ref
+			}
+
+			value = strings.TrimSpace(string(contents))
+		}
+
+		if kind == "file" || secret {
+			log.AddSecret(value)
+		}
+
+		return value
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return out, nil
+}
+
 func ConfigPath() (string, error) {
 	confDir, err := os.UserConfigDir()
 	if err != nil {
@@ -54,5 +251,5 @@ func SchemaPath() (string, error) {
 		return "", err
 	}
 
-	return path.Join(confDir, "apollo", "schema.yml"), nil
+	return path.Join(confDir, "apollo", "schema.hcl"), nil
 }
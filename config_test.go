@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainbound/apollo/log"
+	"github.com/chainbound/apollo/types"
+)
+
+func TestNewConfigInterpolation(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("APOLLO_TEST_KEY", "secret-api-key")
+	t.Setenv("APOLLO_TEST_HOST", "db.example")
+
+	if err := os.WriteFile(filepath.Join(dir, "db_password"), []byte("secret-password\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "config.yml")
+	conf := `
+rpc:
+  ethereum: https://eth-mainnet.alchemyapi.io/v2/${env:APOLLO_TEST_KEY}
+  polygon: https://polygon.example/$${env:NOT_INTERPOLATED}
+postgres:
+  host: ${env:APOLLO_TEST_HOST}
+  password: ${file:db_password}
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.Rpc[types.ETHEREUM]; got != "https://eth-mainnet.alchemyapi.io/v2/secret-api-key" {
+		t.Fatalf("unexpected rpc %s", got)
+	}
+
+	if got := c.Rpc[types.POLYGON]; got != "https://polygon.example/${env:NOT_INTERPOLATED}" {
+		t.Fatalf("unexpected rpc %s", got)
+	}
+
+	if c.DbSettings.Password != "secret-password" {
+		t.Fatalf("unexpected password %s", c.DbSettings.Password)
+	}
+
+	redacted := log.Redact("key secret-api-key and password secret-password")
+	if strings.Contains(redacted, "secret-api-key") || strings.Contains(redacted, "secret-password") {
+		t.Fatalf("secrets not redacted: %s", redacted)
+	}
+
+	// Only the values of secret fields are redacted
+	if c.DbSettings.Host != "db.example" || log.Redact("host db.example") != "host db.example" {
+		t.Fatalf("unexpected host %s", c.DbSettings.Host)
+	}
+}
+
+func TestNewConfigMissingEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("rpc:\n  ethereum: ${env:APOLLO_TEST_UNSET}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewConfig(path); err == nil || !strings.Contains(err.Error(), "APOLLO_TEST_UNSET") {
+		t.Fatalf("expected missing variable error, got %v", err)
+	}
+}
+
+func TestNewConfigInterpolatedTypes(t *testing.T) {
+	t.Setenv("APOLLO_TEST_CHAIN_ID", "1337")
+	t.Setenv("APOLLO_TEST_BLOCK_TIME", "0.5")
+	t.Setenv("APOLLO_TEST_BATCH_SIZE", "10")
+	t.Setenv("APOLLO_TEST_INTERVAL", "5s")
+	t.Setenv("APOLLO_TEST_PASSWORD", "0123")
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	conf := `
+chains:
+  devnet:
+    rpc: http://localhost:8545
+    chain_id: ${env:APOLLO_TEST_CHAIN_ID}
+    native_decimals: ${env:APOLLO_TEST_BATCH_SIZE}
+    block_time: ${env:APOLLO_TEST_BLOCK_TIME}
+db:
+  password: ${env:APOLLO_TEST_PASSWORD}
+  name: "${env:APOLLO_TEST_CHAIN_ID}"
+webhook:
+  url: http://localhost:8080
+  batch_size: ${env:APOLLO_TEST_BATCH_SIZE}
+  flush_interval: ${env:APOLLO_TEST_INTERVAL}
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devnet := c.ChainInfos["devnet"]
+	if devnet.ChainID != 1337 || devnet.NativeDecimals != 10 || devnet.BlockTime != 0.5 {
+		t.Fatalf("unexpected chain %+v", devnet)
+	}
+
+	if c.Webhook.BatchSize != 10 || c.Webhook.FlushInterval.String() != "5s" {
+		t.Fatalf("unexpected webhook settings %+v", c.Webhook)
+	}
+
+	// Strings keep the text of the value
+	if c.DbSettings.Password != "0123" || c.DbSettings.Name != "1337" {
+		t.Fatalf("unexpected db settings %+v", c.DbSettings)
+	}
+}
+
+func TestNewConfigChains(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	conf := `
+rpc:
+  ethereum: http://localhost:8545
+chains:
+  polygon:
+    rpc: http://localhost:8546
+    block_time: 2
+  devnet:
+    rpc: http://localhost:8547
+    chain_id: 31337
+    native_symbol: DEV
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chains := c.Chains()
+	if len(chains) != 3 {
+		t.Fatalf("expected 3 chains, got %d", len(chains))
+	}
+
+	if eth := chains[types.ETHEREUM]; eth.ChainID != 1 || eth.NativeSymbol != "ETH" || eth.Rpc != "http://localhost:8545" {
+		t.Fatalf("unexpected ethereum info %+v", eth)
+	}
+
+	// The defaults are kept when a chain is overridden
+	if polygon := chains[types.POLYGON]; polygon.ChainID != 137 || polygon.BlockTime != 2 {
+		t.Fatalf("unexpected polygon info %+v", polygon)
+	}
+
+	if devnet := chains["devnet"]; devnet.ChainID != 31337 || devnet.NativeSymbol != "DEV" || devnet.NativeDecimals != 18 {
+		t.Fatalf("unexpected devnet info %+v", devnet)
+	}
+}
+
+func TestNewConfigChainWithoutID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("chains:\n  devnet:\n    rpc: http://localhost:8545\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewConfig(path); err == nil || !strings.Contains(err.Error(), "chain_id") {
+		t.Fatalf("expected missing chain_id error, got %v", err)
+	}
+}
+
+func TestNewConfigDialect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte("db:\n  dialect: clickhouse\n  host: localhost\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DbSettings.Dialect != "clickhouse" || c.DbSettings.Host != "localhost" {
+		t.Fatalf("unexpected db settings %+v", c.DbSettings)
+	}
+
+	if err := os.WriteFile(path, []byte("db:\n  dialect: oracle\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewConfig(path); err == nil || !strings.Contains(err.Error(), "oracle") {
+		t.Fatalf("expected unknown dialect error, got %v", err)
+	}
+}
@@ -5,10 +5,17 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	_ "github.com/ClickHouse/clickhouse-go"
 	"github.com/chainbound/apollo/generate"
 	"github.com/chainbound/apollo/log"
+	"github.com/chainbound/apollo/types"
+	"github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	"github.com/rs/zerolog"
 	"github.com/zclconf/go-cty/cty"
@@ -18,9 +25,25 @@ var (
 	ErrNotConnected = errors.New("not connected to database, use Connect() or check if DB is accessible")
 )
 
+const (
+	// DefaultBatchSize is the number of rows inserted in a single transaction.
+	DefaultBatchSize = 1000
+	// DefaultFlushInterval is how often pending rows are committed, so that
+	// results show up in realtime mode, when batches fill up slowly.
+	DefaultFlushInterval = time.Second
+	// maxParams is the maximum number of parameters of a statement. Postgres and
+	// MySQL both support at most 65535.
+	maxParams = 65535
+	// mysqlDupKeyName is the MySQL error of creating an index that exists.
+	mysqlDupKeyName = 1061
+)
+
 // DbSettings contains the database connection settings read from the
 // YAML configuration file, and also an optional default timeout.
 type DbSettings struct {
+	// Dialect is the SQL dialect of the database: postgres (the default), mysql, clickhouse or sqlite.
+	// For sqlite, Name is the path of the database file.
+	Dialect        string `yaml:"dialect"`
 	User           string `yaml:"user"`
 	Password       string `yaml:"password"`
 	Name           string `yaml:"name"`
@@ -28,40 +51,160 @@ type DbSettings struct {
 	DefaultTimeout time.Duration
 }
 
+// TableOptions configures the table of a query.
+type TableOptions struct {
+	Mode types.TableMode
+	// Keys are the columns that identify a row. They're unique in the table, and rows with
+	// the same keys are updated instead of inserted. They're needed for TableUpsert.
+	Keys []string
+	// Types are the types of the columns that are known before the results, from the ABI
+	// or type annotations. The types of the other columns are derived from the first result.
+	Types map[string]generate.ColumnType
+}
+
+// DB saves results in a SQL database. Rows are buffered and inserted in a transaction
+// when BatchSize rows are pending, every FlushInterval, on Flush and on Close.
 type DB struct {
-	Settings DbSettings
+	Settings      DbSettings
+	BatchSize     int
+	FlushInterval time.Duration
+	// FlushOnly only inserts the rows on Flush and Close, not when the batch is full or on
+	// the interval. Progress is saved right after a Flush, so every commit ends at a checkpoint,
+	// and the results after it are not in the database when they're replayed after a crash.
+	FlushOnly bool
 	// pdb wraps the underlying sql connection
-	pdb     *sql.DB
-	connStr string
-	logger  zerolog.Logger
+	pdb *sql.DB
+	// dialect generates the SQL of the configured database
+	dialect generate.Dialect
+
+	// mu guards the pending rows
+	mu sync.Mutex
+	// pending are the arguments of the rows that are not inserted yet, per table
+	pending map[string][][]any
+	rows    int
+	// columns are the columns of the created tables
+	columns map[string][]string
+	// kinds are the kinds of the values of the columns, per table
+	kinds map[string]map[string]generate.Kind
+	// options are the table options per table, the default is TableAppend
+	options map[string]TableOptions
+
+	done   chan struct{}
+	wg     sync.WaitGroup
+	logger zerolog.Logger
 }
 
 func NewDB(s DbSettings) *DB {
-	connStr := fmt.Sprintf("postgresql://%s:%s@%s/%s?sslmode=disable", s.User, s.Password, s.Host, s.Name)
+	log.AddSecret(s.Password)
 
 	return &DB{
-		Settings: s,
-		connStr:  connStr,
-		logger:   log.NewLogger("db"),
+		Settings:      s,
+		BatchSize:     DefaultBatchSize,
+		FlushInterval: DefaultFlushInterval,
+		pending:       make(map[string][][]any),
+		columns:       make(map[string][]string),
+		kinds:         make(map[string]map[string]generate.Kind),
+		options:       make(map[string]TableOptions),
+		done:          make(chan struct{}),
+		logger:        log.NewLogger("db"),
 	}
 }
 
 func (db *DB) Connect() (*DB, error) {
-	pdb, err := sql.Open("postgres", db.connStr)
+	dialect, err := generate.NewDialect(db.Settings.Dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, connStr := dataSource(dialect.Name(), db.Settings)
+	pdb, err := sql.Open(driver, connStr)
 	if err != nil {
 		return nil, err
 	}
 
+	// SQLite only supports a single writer
+	if dialect.Name() == "sqlite" {
+		pdb.SetMaxOpenConns(1)
+	}
+
 	db.pdb = pdb
+	db.dialect = dialect
 	if !db.IsConnected() {
-		return nil, fmt.Errorf("can't connect to db at %s", db.connStr)
+		return nil, fmt.Errorf("can't connect to %s db at %s", dialect.Name(), log.RedactURL(connStr))
 	}
 
-	db.logger.Debug().Str("conn_str", db.connStr).Msg("connected to db")
+	db.logger.Debug().Str("dialect", dialect.Name()).Str("host", db.Settings.Host).Str("name", db.Settings.Name).Str("user", db.Settings.User).Msg("connected to db")
+
+	if !db.FlushOnly {
+		db.wg.Add(1)
+		go db.flushLoop()
+	}
 
 	return db, nil
 }
 
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Flush(); err != nil {
+				db.logger.Error().Err(err).Msg("inserting rows")
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// Dialect returns the SQL dialect of the database.
+func (db *DB) Dialect() generate.Dialect {
+	return db.dialect
+}
+
+// dataSource returns the driver and the connection string of the dialect.
+func dataSource(dialect string, s DbSettings) (string, string) {
+	switch dialect {
+	case "mysql":
+		cfg := mysql.NewConfig()
+		cfg.User = s.User
+		cfg.Passwd = s.Password
+		cfg.Net = "tcp"
+		cfg.Addr = s.Host
+		cfg.DBName = s.Name
+
+		return "mysql", cfg.FormatDSN()
+	case "sqlite":
+		return "sqlite3", s.Name
+	case "clickhouse":
+		host := s.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, "9000")
+		}
+
+		q := url.Values{}
+		q.Set("username", s.User)
+		q.Set("password", s.Password)
+		q.Set("database", s.Name)
+
+		return "clickhouse", (&url.URL{Scheme: "tcp", Host: host, RawQuery: q.Encode()}).String()
+	default:
+		u := url.URL{
+			Scheme:   "postgresql",
+			User:     url.UserPassword(s.User, s.Password),
+			Host:     s.Host,
+			Path:     "/" + s.Name,
+			RawQuery: "sslmode=disable",
+		}
+
+		return "postgres", u.String()
+	}
+}
+
 func (db *DB) Ping(ctx context.Context) error {
 	return db.pdb.PingContext(ctx)
 }
@@ -74,38 +217,399 @@ func (db *DB) IsConnected() bool {
 	}
 }
 
-// CreateTable drops and creates the table with `name` if it exists, otherwise just creates it.
-// `cols` contains the results, which in this case are used to determine the types of the tables.
-func (db DB) CreateTable(ctx context.Context, name string, cols map[string]cty.Value) error {
-	ddl, err := generate.GenerateCreateDDL(name, cols)
+// SetTableOptions sets the options of the table with `name`, before it's created.
+func (db *DB) SetTableOptions(name string, opts TableOptions) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.options[name] = opts
+}
+
+// HasTable returns true if the table was created by CreateTable.
+func (db *DB) HasTable(name string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	_, ok := db.columns[name]
+	return ok
+}
+
+// CreateTable prepares the table with `name` for the results. `cols` contains the results, which
+// in this case are used to determine the types of the columns that have no type in the table
+// options. If the table exists, it's only
+// dropped in TableReplace mode. Otherwise the columns it's missing are added, and its existing
+// columns have to be compatible with the results.
+func (db *DB) CreateTable(ctx context.Context, name string, cols map[string]cty.Value, exact bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if len(cols) == 0 {
+		return fmt.Errorf("table %s: no columns to save", name)
+	}
+
+	opts := db.tableOptions(name)
+	if opts.Mode == types.TableUpsert && len(opts.Keys) == 0 {
+		return fmt.Errorf("table %s: upsert mode needs keys", name)
+	}
+
+	if opts.Mode == types.TableReplace {
+		db.logger.Info().Str("table_name", name).Msg("replacing table")
+		if err := db.exec(ctx, db.dialect.DropTableSQL(name)); err != nil {
+			return fmt.Errorf("dropping table: %w", err)
+		}
+	}
+
+	existing, err := db.tableColumns(ctx, name)
 	if err != nil {
+		return fmt.Errorf("reading columns of table %s: %w", name, err)
+	}
+
+	colTypes := columnTypes(cols, opts.Types)
+	kinds := make(map[string]generate.Kind, len(colTypes))
+	for col, t := range colTypes {
+		kinds[col] = t.Kind
+	}
+
+	if len(existing) == 0 {
+		if err := db.exec(ctx, db.dialect.CreateTableSQL(name, colTypes, opts.Keys, exact)); err != nil {
+			return fmt.Errorf("creating table: %w", err)
+		}
+
+		db.logger.Debug().Str("table_name", name).Msg("created table")
+	} else if err := db.migrateTable(ctx, name, colTypes, existing, kinds, exact); err != nil {
 		return err
 	}
 
-	db.logger.Trace().Str("ddl", ddl).Msg("generated create stmt")
-	_, err = db.pdb.ExecContext(ctx, ddl)
-	if err != nil {
-		return fmt.Errorf("creating table: %w", err)
+	if err := db.addUniqueKey(ctx, name, opts.Keys); err != nil {
+		return err
 	}
 
-	db.logger.Debug().Str("table_name", name).Msg("created table")
+	db.columns[name] = generate.SortedColumns(cols)
+	db.kinds[name] = kinds
 
 	return nil
 }
 
-// InsertResult converts the result map into the table with name `name`.
-func (db DB) InsertResult(name string, toInsert map[string]string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), db.Settings.DefaultTimeout)
-	defer cancel()
+// columnTypes returns the types of the columns of the result: the known types, or the
+// types of the values.
+func columnTypes(cols map[string]cty.Value, known map[string]generate.ColumnType) map[string]generate.ColumnType {
+	colTypes := make(map[string]generate.ColumnType, len(cols))
+	for col, v := range cols {
+		t, ok := known[col]
+		if !ok {
+			t = generate.CtyColumnType(v.Type())
+		} else if t.Kind == "" {
+			// A type of the database is converted like the values
+			t.Kind = generate.CtyColumnType(v.Type()).Kind
+		}
+
+		colTypes[col] = t
+	}
+
+	return colTypes
+}
+
+// migrateTable adds the columns the existing table is missing, and checks that the
+// types of the other columns are compatible with the results. The values of compatible
+// columns that store something else are converted to what the column stores in kinds.
+func (db *DB) migrateTable(ctx context.Context, name string, cols map[string]generate.ColumnType, existing map[string]string,
+	kinds map[string]generate.Kind, exact bool) error {
+	for _, col := range generate.SortedColumns(cols) {
+		t := cols[col]
+
+		dbType, ok := existing[strings.ToLower(col)]
+		if !ok {
+			if err := db.exec(ctx, db.dialect.AddColumnSQL(name, col, t, exact)); err != nil {
+				return fmt.Errorf("adding column %s to table %s: %w", col, name, err)
+			}
+
+			db.logger.Info().Str("table_name", name).Str("column", col).Msg("added column")
+			continue
+		}
+
+		if !generate.CompatibleType(db.dialect, dbType, t, exact) {
+			return fmt.Errorf("column %s of table %s has type %s, which can't store the %s values of the query; "+
+				"set table_mode = \"replace\" to recreate the table", col, name, dbType, generate.TypeSQL(db.dialect, t, exact))
+		}
+
+		kinds[col] = generate.StoredKind(dbType, t)
+	}
 
-	ddl := generate.GenerateInsertSQL(name, toInsert)
-	db.logger.Trace().Str("ddl", ddl).Msg("generated insert stmt")
+	db.logger.Debug().Str("table_name", name).Msg("using existing table")
 
+	return nil
+}
+
+// addUniqueKey adds a unique index on the keys to the table, if it doesn't have it yet.
+func (db *DB) addUniqueKey(ctx context.Context, name string, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ddl := db.dialect.UniqueKeySQL(name, keys)
+	if ddl == "" {
+		return nil
+	}
+
+	err := db.exec(ctx, ddl)
+
+	// MySQL can't create the index only if it doesn't exist
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDupKeyName {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("adding unique key (%s) to table %s: %w; if the table has rows with the same keys, "+
+			"set table_mode = \"replace\" to recreate it", strings.Join(keys, ", "), name, err)
+	}
+
+	return nil
+}
+
+// tableColumns returns the types of the columns of the table by their lowercased names,
+// or nothing if the table doesn't exist.
+func (db *DB) tableColumns(ctx context.Context, name string) (map[string]string, error) {
+	query, args := db.dialect.ColumnsSQL(name)
+	rows, err := db.pdb.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var col, dbType string
+		if err := rows.Scan(&col, &dbType); err != nil {
+			return nil, err
+		}
+
+		columns[strings.ToLower(col)] = dbType
+	}
+
+	return columns, rows.Err()
+}
+
+func (db *DB) exec(ctx context.Context, ddl string) error {
+	db.logger.Trace().Str("ddl", ddl).Msg("generated stmt")
 	_, err := db.pdb.ExecContext(ctx, ddl)
+	return err
+}
+
+// tableOptions returns the options of the table. db.mu must be held.
+func (db *DB) tableOptions(name string) TableOptions {
+	opts, ok := db.options[name]
+	if !ok {
+		return TableOptions{Mode: types.TableAppend}
+	}
+
+	return opts
+}
+
+// InsertResult adds the result map to the pending rows of the table with name `name`,
+// and inserts the pending rows if the batch is full.
+func (db *DB) InsertResult(name string, res map[string]cty.Value, exact bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	columns, ok := db.columns[name]
+	if !ok {
+		return fmt.Errorf("table %s doesn't exist", name)
+	}
+
+	args := make([]any, len(columns))
+	for i, col := range columns {
+		v, err := db.dialect.Value(res[col], db.kinds[name][col], exact)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col, err)
+		}
+
+		args[i] = v
+	}
+
+	db.pending[name] = append(db.pending[name], args)
+	db.rows++
+	if !db.FlushOnly && db.rows >= db.BatchSize {
+		return db.flush()
+	}
+
+	return nil
+}
+
+// Flush inserts the pending rows. Outputs are flushed before progress is saved, so
+// everything up to a checkpoint is committed.
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.flush()
+}
+
+// Close inserts the pending rows and closes the connection.
+func (db *DB) Close() error {
+	close(db.done)
+	db.wg.Wait()
+
+	if err := db.Flush(); err != nil {
+		db.pdb.Close()
+		return err
+	}
+
+	return db.pdb.Close()
+}
+
+// flush inserts the pending rows of every table in a single transaction. If it fails, the
+// rows stay pending, so the next flush retries them. db.mu must be held.
+func (db *DB) flush() error {
+	if db.rows == 0 {
+		return nil
+	}
+
+	ctx, cancel := db.timeoutContext()
+	defer cancel()
+
+	tx, err := db.pdb.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("inserting result: %w", err)
+		return fmt.Errorf("starting transaction: %w", err)
+	}
+
+	for name, tableRows := range db.pending {
+		if err := db.insertRows(ctx, tx, name, tableRows); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("inserting rows into %s: %w", name, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("committing rows: %w", err)
+	}
+
+	db.logger.Debug().Int("rows", db.rows).Msg("inserted rows")
+
+	db.pending = make(map[string][][]any)
+	db.rows = 0
+
+	return nil
+}
+
+// insertRows inserts the rows with the bulk loading of the dialect, or with prepared
+// multi-row inserts if it has none. If the table has keys, existing rows are updated.
+func (db *DB) insertRows(ctx context.Context, tx *sql.Tx, name string, rows [][]any) error {
+	columns := db.columns[name]
+
+	keys := db.tableOptions(name).Keys
+	if len(keys) > 0 {
+		// A row can only be upserted once per statement
+		rows = dedupeRows(columns, keys, rows)
+	}
+
+	if bulk := db.dialect.BulkLoadSQL(name, columns, keys); bulk != "" {
+		stmt, err := tx.PrepareContext(ctx, bulk)
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if _, err := stmt.ExecContext(ctx, row...); err != nil {
+				stmt.Close()
+				return err
+			}
+		}
+
+		// The rows are sent when the statement is closed
+		return stmt.Close()
+	}
+
+	perStmt := maxParams / len(columns)
+	if perStmt > db.BatchSize {
+		perStmt = db.BatchSize
+	}
+
+	if perStmt < 1 {
+		perStmt = 1
+	}
+
+	// Full statements are prepared once, the last one has the remaining rows
+	stmts := make(map[int]*sql.Stmt)
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}()
+
+	for len(rows) > 0 {
+		n := perStmt
+		if len(rows) < n {
+			n = len(rows)
+		}
+
+		stmt, ok := stmts[n]
+		if !ok {
+			var err error
+			insert := db.dialect.InsertSQL(name, columns, n)
+			if len(keys) > 0 {
+				insert = db.dialect.UpsertSQL(name, columns, keys, n)
+			}
+
+			stmt, err = tx.PrepareContext(ctx, insert)
+			if err != nil {
+				return err
+			}
+
+			stmts[n] = stmt
+		}
+
+		args := make([]any, 0, n*len(columns))
+		for _, row := range rows[:n] {
+			args = append(args, row...)
+		}
+
+		if _, err := stmt.ExecContext(ctx, args...); err != nil {
+			return err
+		}
+
+		rows = rows[n:]
 	}
 
-	db.logger.Debug().Str("table_name", name).Msg("inserted result")
 	return nil
 }
+
+// timeoutContext returns a context with the default timeout, if there is one.
+func (db *DB) timeoutContext() (context.Context, context.CancelFunc) {
+	if db.Settings.DefaultTimeout > 0 {
+		return context.WithTimeout(context.Background(), db.Settings.DefaultTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// dedupeRows keeps the last of the rows with the same keys, in the order of their first occurrence.
+func dedupeRows(columns, keys []string, rows [][]any) [][]any {
+	idx := make([]int, 0, len(keys))
+	for _, k := range keys {
+		for i, c := range columns {
+			if c == k {
+				idx = append(idx, i)
+			}
+		}
+	}
+
+	positions := make(map[string]int, len(rows))
+	deduped := make([][]any, 0, len(rows))
+	for _, row := range rows {
+		var key strings.Builder
+		for _, i := range idx {
+			fmt.Fprintf(&key, "%v\x00", row[i])
+		}
+
+		if pos, ok := positions[key.String()]; ok {
+			deduped[pos] = row
+			continue
+		}
+
+		positions[key.String()] = len(deduped)
+		deduped = append(deduped, row)
+	}
+
+	return deduped
+}
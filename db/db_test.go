@@ -1,11 +1,22 @@
 package db
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/chainbound/apollo/generate"
+	"github.com/chainbound/apollo/types"
+	"github.com/zclconf/go-cty/cty"
 )
 
-func newDB() *DB {
+// newDB connects to the Postgres test database, and skips the test if it's not available.
+func newDB(t *testing.T) *DB {
+	t.Helper()
+
 	db, err := NewDB(DbSettings{
 		Host:     "172.17.0.2",
 		User:     "chainreader",
@@ -14,21 +25,22 @@ func newDB() *DB {
 	}).Connect()
 
 	if err != nil {
-		log.Fatal(err)
+		t.Skipf("postgres is not available: %v", err)
 	}
+	t.Cleanup(func() { db.Close() })
 
 	return db
 }
 
 func TestConnect(t *testing.T) {
-	db := newDB()
+	db := newDB(t)
 	if !db.IsConnected() {
 		t.Fatal("not connected")
 	}
 }
 
 func TestCreateTable(t *testing.T) {
-	// db := newDB()
+	// db := newDB(t)
 	// schema, err := generate.ParseV2("../schema.v2.yml")
 	// if err != nil {
 	// 	t.Fatal(err)
@@ -45,3 +57,312 @@ func TestCreateTable(t *testing.T) {
 	// }
 
 }
+
+// TestInsertBatches runs the batching on SQLite, which uses the same code as the other databases.
+func TestInsertBatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	db := NewSQLite(path)
+	db.BatchSize = 2
+	db, err := db.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sdb := db.pdb
+
+	names := []string{"Tether USD", "O'Reilly Token", "'); DROP TABLE tokens; --", "Dai", "Wrapped Ether"}
+	for i, n := range names {
+		res := map[string]cty.Value{"id_": cty.NumberIntVal(int64(i)), "name": cty.StringVal(n)}
+		if i == 0 {
+			if err := db.CreateTable(context.Background(), "tokens", res, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := db.InsertResult("tokens", res, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Full batches are inserted, the last row is pending until the flush
+	var count int
+	if err := sdb.QueryRow("SELECT COUNT(*) FROM tokens").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 4 {
+		t.Fatalf("expected 4 rows, got %d", count)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := sdb.Query("SELECT name FROM tokens ORDER BY id_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for i := 0; rows.Next(); i++ {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+
+		if name != names[i] {
+			t.Fatalf("expected %s, got %s", names[i], name)
+		}
+	}
+}
+
+func TestTableModes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+	ctx := context.Background()
+
+	// run saves the results in the table like a run of a query
+	run := func(opts TableOptions, results ...map[string]cty.Value) error {
+		db, err := NewSQLite(path).Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db.SetTableOptions("swaps", opts)
+		if err := db.CreateTable(ctx, "swaps", results[0], false); err != nil {
+			db.Close()
+			return err
+		}
+
+		for _, res := range results {
+			if err := db.InsertResult("swaps", res, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return db.Close()
+	}
+
+	// rows returns the rows of the table
+	rows := func() []string {
+		sdb, err := NewSQLite(path).Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sdb.Close()
+
+		rows, err := sdb.pdb.Query(`SELECT block, pair FROM swaps ORDER BY id`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var got []string
+		for rows.Next() {
+			var (
+				block int64
+				pair  any
+			)
+
+			if err := rows.Scan(&block, &pair); err != nil {
+				t.Fatal(err)
+			}
+
+			got = append(got, fmt.Sprintf("%d:%v", block, pair))
+		}
+
+		return got
+	}
+
+	appendOpts := TableOptions{Mode: types.TableAppend}
+	if err := run(appendOpts, map[string]cty.Value{"block": cty.NumberIntVal(1)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rerunning keeps the rows and adds the new column
+	if err := run(appendOpts, map[string]cty.Value{"block": cty.NumberIntVal(2), "pair": cty.StringVal("0xabc")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(rows(), ","); got != "1:<nil>,2:0xabc" {
+		t.Fatalf("unexpected rows %s", got)
+	}
+
+	// Strings can't be stored in the numeric block column
+	err := run(appendOpts, map[string]cty.Value{"block": cty.StringVal("latest")})
+	if err == nil || !strings.Contains(err.Error(), "replace") {
+		t.Fatalf("expected incompatible type error, got %v", err)
+	}
+
+	// Only replacing drops the rows
+	if err := run(TableOptions{Mode: types.TableReplace}, map[string]cty.Value{"block": cty.NumberIntVal(3), "pair": cty.StringVal("0xabc")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(rows(), ","); got != "3:0xabc" {
+		t.Fatalf("expected replaced table, got %s", got)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	db, err := NewSQLite(path).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.SetTableOptions("reserves", TableOptions{Mode: types.TableUpsert, Keys: []string{"pair"}})
+
+	results := []map[string]cty.Value{
+		{"pair": cty.StringVal("0xabc"), "reserve": cty.NumberIntVal(1)},
+		{"pair": cty.StringVal("0xdef"), "reserve": cty.NumberIntVal(2)},
+		// Updated in the same batch
+		{"pair": cty.StringVal("0xabc"), "reserve": cty.NumberIntVal(3)},
+	}
+
+	if err := db.CreateTable(context.Background(), "reserves", results[0], false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, res := range results {
+		if err := db.InsertResult("reserves", res, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updated in a later batch
+	if err := db.InsertResult("reserves", map[string]cty.Value{"pair": cty.StringVal("0xdef"), "reserve": cty.NumberIntVal(4)}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	rows, err := db.pdb.Query(`SELECT pair, reserve FROM reserves ORDER BY pair`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			pair    string
+			reserve int64
+		)
+
+		if err := rows.Scan(&pair, &reserve); err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, fmt.Sprintf("%s:%d", pair, reserve))
+	}
+
+	if strings.Join(got, ",") != "0xabc:3,0xdef:4" {
+		t.Fatalf("unexpected rows %v", got)
+	}
+}
+
+func TestUniqueKeyExistingTable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.db")
+	res := map[string]cty.Value{"pair": cty.StringVal("0xabc"), "reserve": cty.NumberIntVal(1)}
+
+	insert := func(path string, opts TableOptions, res map[string]cty.Value) error {
+		db, err := NewSQLite(path).Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		db.SetTableOptions("reserves", opts)
+		if err := db.CreateTable(context.Background(), "reserves", res, false); err != nil {
+			return err
+		}
+
+		if err := db.InsertResult("reserves", res, false); err != nil {
+			t.Fatal(err)
+		}
+
+		return db.Flush()
+	}
+
+	// A table without keys gets a unique index when the query gets keys
+	if err := insert(path, TableOptions{}, res); err != nil {
+		t.Fatal(err)
+	}
+
+	keyed := TableOptions{Keys: []string{"pair"}}
+	for _, reserve := range []int64{2, 3} {
+		res := map[string]cty.Value{"pair": cty.StringVal("0xabc"), "reserve": cty.NumberIntVal(reserve)}
+		if err := insert(path, keyed, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	var (
+		count   int
+		reserve int64
+	)
+
+	if err := sdb.QueryRow(`SELECT COUNT(*), MAX(reserve) FROM reserves`).Scan(&count, &reserve); err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 1 || reserve != 3 {
+		t.Fatalf("expected 1 upserted row, got %d rows with reserve %d", count, reserve)
+	}
+
+	// Duplicate rows can't get a unique index
+	dupes := filepath.Join(dir, "dupes.db")
+	for i := 0; i < 2; i++ {
+		if err := insert(dupes, TableOptions{}, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := insert(dupes, keyed, res); err == nil || !strings.Contains(err.Error(), "replace") {
+		t.Fatalf("expected an error suggesting replace mode, got %v", err)
+	}
+}
+
+// TestMigrateClickHouseJSON migrates a ClickHouse table with a JSON column. Every column
+// exists already, so no statements are executed.
+func TestMigrateClickHouseJSON(t *testing.T) {
+	db := NewDB(DbSettings{Dialect: "clickhouse"})
+	db.dialect = generate.ClickHouse{}
+
+	existing := map[string]string{
+		"position": "Nullable(JSON)",
+		"ticks":    "Nullable(String)",
+	}
+
+	cols := map[string]generate.ColumnType{
+		"position": {Kind: generate.KindJSON},
+		"ticks":    {Kind: generate.KindJSON},
+	}
+
+	kinds := map[string]generate.Kind{}
+	if err := db.migrateTable(context.Background(), "positions", cols, existing, kinds, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// JSON columns get JSON, String columns keep getting text
+	if kinds["position"] != generate.KindJSON || kinds["ticks"] != generate.KindText {
+		t.Fatalf("unexpected kinds %v", kinds)
+	}
+}
@@ -0,0 +1,22 @@
+package db
+
+import (
+	"time"
+
+	"github.com/chainbound/apollo/log"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// NewSQLite returns a DB that saves results in the SQLite database file at path. The file
+// is created if it doesn't exist. Tables are named after the queries, like for the other databases.
+func NewSQLite(path string) *DB {
+	db := NewDB(DbSettings{
+		Dialect:        "sqlite",
+		Name:           path,
+		DefaultTimeout: time.Second * 20,
+	})
+
+	db.logger = log.NewLogger("sqlite")
+
+	return db
+}
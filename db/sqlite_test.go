@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainbound/apollo/generate"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestSQLiteInsert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	s := NewSQLite(path)
+	s.BatchSize = 2
+	s, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := []map[string]cty.Value{
+		{"blocknumber": cty.NumberIntVal(100), "pair": cty.StringVal("0xabc"), "price": cty.NumberFloatVal(1.5), "swapped": cty.True},
+		{"blocknumber": cty.NumberIntVal(101), "pair": cty.StringVal("0xdef"), "price": cty.NumberFloatVal(2.25), "swapped": cty.False},
+		{"blocknumber": cty.NumberIntVal(102), "pair": cty.StringVal("0x123"), "price": cty.NumberFloatVal(3), "swapped": cty.True},
+	}
+
+	for _, res := range results {
+		if !s.HasTable("swaps") {
+			if err := s.CreateTable(context.Background(), "swaps", res, false); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := s.InsertResult("swaps", res, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The last row is only committed on Close
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	rows, err := sdb.Query(`SELECT blocknumber, pair, price, swapped FROM swaps ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var blocks []int64
+	for rows.Next() {
+		var (
+			block   int64
+			pair    string
+			price   float64
+			swapped bool
+		)
+
+		if err := rows.Scan(&block, &pair, &price, &swapped); err != nil {
+			t.Fatal(err)
+		}
+
+		i := len(blocks)
+		if pair != results[i]["pair"].AsString() || swapped != results[i]["swapped"].True() {
+			t.Fatalf("unexpected row %d: %s %t", i, pair, swapped)
+		}
+
+		if f, _ := results[i]["price"].AsBigFloat().Float64(); price != f {
+			t.Fatalf("expected price %f, got %f", f, price)
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) != 3 || blocks[0] != 100 || blocks[2] != 102 {
+		t.Fatalf("unexpected blocks %v", blocks)
+	}
+}
+
+func TestSQLiteExact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	s, err := NewSQLite(path).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amount, _ := cty.ParseNumberVal("115792089237316195423570985008687907853269984665640564039457584007913129639935")
+	res := map[string]cty.Value{"amount": amount}
+
+	if err := s.CreateTable(context.Background(), "transfers", res, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.InsertResult("transfers", res, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	var got string
+	if err := sdb.QueryRow(`SELECT amount FROM transfers`).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got != amount.AsBigFloat().Text('f', 0) {
+		t.Fatalf("expected %s, got %s", amount.AsBigFloat().Text('f', 0), got)
+	}
+}
+
+func TestSQLiteColumnTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.db")
+
+	s, err := NewSQLite(path).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetTableOptions("transfers", TableOptions{Types: map[string]generate.ColumnType{
+		"time":     generate.ParseColumnType("timestamptz"),
+		"decimals": {Kind: generate.KindInteger},
+		"memo":     generate.ParseColumnType("VARCHAR(500)"),
+	}})
+
+	res := map[string]cty.Value{
+		"time":     cty.NumberIntVal(1650000000),
+		"decimals": cty.NumberIntVal(6),
+		"memo":     cty.StringVal("gm"),
+		"mint":     cty.True,
+	}
+
+	if err := s.CreateTable(context.Background(), "transfers", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.InsertResult("transfers", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	rows, err := sdb.Query(`SELECT name, type FROM pragma_table_info('transfers') ORDER BY name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var got []string
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+
+		got = append(got, name+" "+typ)
+	}
+
+	want := "decimals INTEGER,id INTEGER,memo VARCHAR(500),mint BOOLEAN,time TIMESTAMP"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("expected columns %s, got %s", want, strings.Join(got, ","))
+	}
+
+	// The driver reads TIMESTAMP columns as times
+	var ts time.Time
+	if err := sdb.QueryRow(`SELECT time FROM transfers`).Scan(&ts); err != nil {
+		t.Fatal(err)
+	}
+
+	if !ts.Equal(time.Unix(1650000000, 0)) {
+		t.Fatalf("expected timestamp 1650000000, got %s", ts)
+	}
+}
+
+func TestSQLiteFlushRetry(t *testing.T) {
+	s, err := NewSQLite(filepath.Join(t.TempDir(), "out.db")).Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res := map[string]cty.Value{"blocknumber": cty.NumberIntVal(100)}
+	if err := s.CreateTable(context.Background(), "blocks", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.InsertResult("blocks", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The insert fails while the table is missing
+	if _, err := s.pdb.Exec(`ALTER TABLE blocks RENAME TO moved`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Flush(); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+
+	// The rows of the failed flush are kept, and inserted by the next one
+	if _, err := s.pdb.Exec(`ALTER TABLE moved RENAME TO blocks`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := s.pdb.QueryRow(`SELECT COUNT(*) FROM blocks`).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 row, got %d", n)
+	}
+}
+
+func TestSQLiteFlushOnly(t *testing.T) {
+	s := NewSQLite(filepath.Join(t.TempDir(), "out.db"))
+	s.BatchSize = 1
+	s.FlushInterval = time.Millisecond
+	s.FlushOnly = true
+
+	s, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A table needs columns
+	if err := s.CreateTable(context.Background(), "empty", map[string]cty.Value{}, false); err == nil {
+		t.Fatal("expected an error for a table without columns")
+	}
+
+	res := map[string]cty.Value{"blocknumber": cty.NumberIntVal(100)}
+	if err := s.CreateTable(context.Background(), "blocks", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := s.InsertResult("blocks", res, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func() (n int) {
+		if err := s.pdb.QueryRow(`SELECT COUNT(*) FROM blocks`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+
+		return n
+	}
+
+	// Neither full batches nor the interval commit the rows
+	time.Sleep(20 * time.Millisecond)
+	if n := count(); n != 0 {
+		t.Fatalf("expected no rows before the flush, got %d", n)
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count(); n != 3 {
+		t.Fatalf("expected 3 rows, got %d", n)
+	}
+}
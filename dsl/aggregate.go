@@ -0,0 +1,404 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+var ErrNoWindowRealtime = errors.New("no window defined for realtime aggregation")
+
+// aggregateFunctions maps the supported aggregate functions to their number of arguments.
+var aggregateFunctions = map[string]int{
+	"sum":   1,
+	"avg":   1,
+	"min":   1,
+	"max":   1,
+	"count": 0,
+	"first": 1,
+	"last":  1,
+	"vwap":  2,
+}
+
+// AggregateSchema defines a DSL aggregate block. The results of the save block are grouped by
+// the group_by keys and time windows, and every other attribute defines an aggregated column, like:
+//
+//	volume = sum(size)
+//	price = vwap(price, size)
+type AggregateSchema struct {
+	// Window is the size of the time windows in seconds, based on the timestamp of
+	// the results. If it's 0, all results are aggregated into one window.
+	Window int64 `hcl:"window,optional"`
+	// Lateness is the number of seconds a window stays open after it ends, to wait
+	// for late results. Only used in realtime mode, historical results are in order.
+	Lateness int64 `hcl:"lateness,optional"`
+	// GroupBy is an optional object of key expressions. Every key becomes a column.
+	GroupBy hcl.Expression `hcl:"group_by,optional"`
+
+	Columns hcl.Body `hcl:",remain"`
+}
+
+// aggregateColumn is a parsed aggregated column, like `volume = sum(size)`.
+type aggregateColumn struct {
+	name     string
+	function string
+	args     []hcl.Expression
+}
+
+func (a AggregateSchema) columns() ([]aggregateColumn, error) {
+	attrs, diags := a.Columns.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diagError(diags)
+	}
+
+	var columns []aggregateColumn
+	for name, attr := range attrs {
+		call, ok := attr.Expr.(*hclsyntax.FunctionCallExpr)
+		if !ok {
+			return nil, fmt.Errorf("aggregate column %s must be an aggregate function call", name)
+		}
+
+		n, ok := aggregateFunctions[call.Name]
+		if !ok {
+			return nil, fmt.Errorf("aggregate column %s: unknown aggregate function %s", name, call.Name)
+		}
+
+		// count can optionally have an argument, it then counts the non-null values
+		if len(call.Args) != n && !(call.Name == "count" && len(call.Args) == 1) {
+			return nil, fmt.Errorf("aggregate column %s: %s expects %d arguments", name, call.Name, n)
+		}
+
+		args := make([]hcl.Expression, len(call.Args))
+		for i, arg := range call.Args {
+			args[i] = arg
+		}
+
+		columns = append(columns, aggregateColumn{name: name, function: call.Name, args: args})
+	}
+
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].name < columns[j].name
+	})
+
+	return columns, nil
+}
+
+// position is used to determine the first and last values in a window. Results
+// at the same position on the chain are ordered by arrival.
+type position struct {
+	types.Position
+	seq uint64
+}
+
+func (p position) before(o position) bool {
+	if p.Position != o.Position {
+		return p.Position.Before(o.Position)
+	}
+
+	return p.seq < o.seq
+}
+
+// accumulator keeps the state of an aggregated column in a window.
+type accumulator struct {
+	sum    *big.Float
+	weight *big.Float
+	count  int64
+	value  cty.Value
+	pos    position
+}
+
+func newAccumulator() *accumulator {
+	return &accumulator{
+		sum:    new(big.Float).SetPrec(numberPrecision),
+		weight: new(big.Float).SetPrec(numberPrecision),
+		value:  cty.NullVal(cty.DynamicPseudoType),
+	}
+}
+
+func (acc *accumulator) add(function string, args []cty.Value, pos position) error {
+	for _, arg := range args {
+		// Null values are ignored, like in SQL
+		if arg.IsNull() {
+			return nil
+		}
+	}
+
+	if function != "first" && function != "last" && function != "count" {
+		for _, arg := range args {
+			if arg.Type() != cty.Number {
+				return fmt.Errorf("%s expects numbers, not %s", function, arg.Type().FriendlyName())
+			}
+		}
+	}
+
+	first := acc.count == 0
+	acc.count++
+
+	switch function {
+	case "sum", "avg":
+		acc.sum.Add(acc.sum, args[0].AsBigFloat())
+	case "min":
+		if first || args[0].AsBigFloat().Cmp(acc.value.AsBigFloat()) < 0 {
+			acc.value = args[0]
+		}
+	case "max":
+		if first || args[0].AsBigFloat().Cmp(acc.value.AsBigFloat()) > 0 {
+			acc.value = args[0]
+		}
+	case "first":
+		if first || pos.before(acc.pos) {
+			acc.value, acc.pos = args[0], pos
+		}
+	case "last":
+		if first || !pos.before(acc.pos) {
+			acc.value, acc.pos = args[0], pos
+		}
+	case "vwap":
+		volume := args[1].AsBigFloat()
+		acc.sum.Add(acc.sum, new(big.Float).SetPrec(numberPrecision).Mul(args[0].AsBigFloat(), volume))
+		acc.weight.Add(acc.weight, volume)
+	}
+
+	return nil
+}
+
+func (acc *accumulator) result(function string) cty.Value {
+	switch function {
+	case "count":
+		return cty.NumberIntVal(acc.count)
+	case "sum":
+		return cty.NumberVal(acc.sum)
+	case "avg":
+		if acc.count == 0 {
+			return cty.NullVal(cty.Number)
+		}
+
+		return cty.NumberVal(new(big.Float).SetPrec(numberPrecision).Quo(acc.sum, new(big.Float).SetInt64(acc.count)))
+	case "vwap":
+		if acc.weight.Sign() == 0 {
+			return cty.NullVal(cty.Number)
+		}
+
+		return cty.NumberVal(new(big.Float).SetPrec(numberPrecision).Quo(acc.sum, acc.weight))
+	default:
+		return acc.value
+	}
+}
+
+// window is the state of a single group in a single time window.
+type window struct {
+	start int64
+	// block is the highest block of the results in the window
+	block        uint64
+	groupKey     string
+	groupValues  map[string]cty.Value
+	accumulators []*accumulator
+}
+
+// Aggregator aggregates the results of a query, according to its aggregate block.
+type Aggregator struct {
+	schema  *AggregateSchema
+	columns []aggregateColumn
+	ctx     *hcl.EvalContext
+
+	// closeOnWatermark closes windows once the watermark (the highest timestamp seen)
+	// passes their end and the lateness. Otherwise, windows are only emitted on Flush.
+	closeOnWatermark bool
+	watermark        int64
+	lateness         int64
+
+	windows map[string]*window
+	seq     uint64
+
+	// Late counts the results that arrived after their window was closed. They are dropped.
+	Late int64
+}
+
+// WindowResult is the result of a closed window.
+type WindowResult struct {
+	// Block is the highest block of the results in the window.
+	Block  uint64
+	Values map[string]cty.Value
+}
+
+// NewAggregator returns an aggregator for the query. ordered is true if the results of the
+// query are in chain order. In realtime mode, and for ordered historical results, windows are
+// closed on the watermark. Otherwise they're all kept until Flush is called.
+func NewAggregator(q *QuerySchema, realtime, ordered bool) (*Aggregator, error) {
+	if q.Aggregate == nil {
+		return nil, fmt.Errorf("query %s has no aggregate block", q.Name)
+	}
+
+	if realtime && q.Aggregate.Window == 0 {
+		return nil, ErrNoWindowRealtime
+	}
+
+	columns, err := q.Aggregate.columns()
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Aggregator{
+		schema:           q.Aggregate,
+		columns:          columns,
+		ctx:              q.EvalContext,
+		closeOnWatermark: realtime || (ordered && q.Aggregate.Window > 0),
+		windows:          make(map[string]*window),
+	}
+
+	if realtime {
+		a.lateness = q.Aggregate.Lateness
+	}
+
+	return a, nil
+}
+
+// Add adds the save result of a call result to its window. The save columns are available
+// as variables to the group_by keys and the aggregate function arguments. It returns the
+// windows that were closed by this result.
+func (a *Aggregator) Add(res types.CallResult, save map[string]cty.Value) ([]WindowResult, error) {
+	ctx := a.ctx.NewChild()
+	ctx.Variables = save
+
+	ts := int64(res.Timestamp)
+	start := int64(0)
+	if a.schema.Window > 0 {
+		start = ts - ts%a.schema.Window
+	}
+
+	if a.closeOnWatermark && start+a.schema.Window+a.lateness <= a.watermark {
+		a.Late++
+		return nil, nil
+	}
+
+	groupValues, groupKey, err := a.group(ctx)
+	if err != nil {
+		return nil, newEvalError(res, err)
+	}
+
+	key := fmt.Sprintf("%d-%s", start, groupKey)
+	w, ok := a.windows[key]
+	if !ok {
+		w = &window{
+			start:        start,
+			groupKey:     groupKey,
+			groupValues:  groupValues,
+			accumulators: make([]*accumulator, len(a.columns)),
+		}
+
+		for i := range w.accumulators {
+			w.accumulators[i] = newAccumulator()
+		}
+
+		a.windows[key] = w
+	}
+
+	if res.BlockNumber > w.block {
+		w.block = res.BlockNumber
+	}
+
+	a.seq++
+	pos := position{Position: res.Position(), seq: a.seq}
+
+	for i, col := range a.columns {
+		args := make([]cty.Value, len(col.args))
+		for j, expr := range col.args {
+			v, diags := expr.Value(ctx)
+			if diags.HasErrors() {
+				return nil, newEvalError(res, diagError(diags))
+			}
+
+			args[j] = v
+		}
+
+		if err := w.accumulators[i].add(col.function, args, pos); err != nil {
+			return nil, newEvalError(res, fmt.Errorf("aggregate column %s: %w", col.name, err))
+		}
+	}
+
+	if !a.closeOnWatermark || ts <= a.watermark {
+		return nil, nil
+	}
+
+	a.watermark = ts
+
+	return a.emit(func(w *window) bool {
+		return w.start+a.schema.Window+a.lateness <= a.watermark
+	}), nil
+}
+
+// Flush returns all windows that are still open, and closes them.
+func (a *Aggregator) Flush() []WindowResult {
+	return a.emit(func(*window) bool { return true })
+}
+
+func (a *Aggregator) group(ctx *hcl.EvalContext) (map[string]cty.Value, string, error) {
+	v, diags := a.schema.GroupBy.Value(ctx)
+	if diags.HasErrors() {
+		return nil, "", diagError(diags)
+	}
+
+	if v.IsNull() {
+		return nil, "", nil
+	}
+
+	if !v.Type().IsObjectType() && !v.Type().IsMapType() {
+		return nil, "", fmt.Errorf("group_by must be an object, not %s", v.Type().FriendlyName())
+	}
+
+	key, err := ctyjson.Marshal(v, v.Type())
+	if err != nil {
+		return nil, "", err
+	}
+
+	return v.AsValueMap(), string(key), nil
+}
+
+// emit removes the windows that should be closed, and converts them into rows, ordered
+// by window start and group.
+func (a *Aggregator) emit(shouldClose func(*window) bool) []WindowResult {
+	var closed []*window
+	for k, w := range a.windows {
+		if shouldClose(w) {
+			closed = append(closed, w)
+			delete(a.windows, k)
+		}
+	}
+
+	sort.Slice(closed, func(i, j int) bool {
+		if closed[i].start != closed[j].start {
+			return closed[i].start < closed[j].start
+		}
+
+		return closed[i].groupKey < closed[j].groupKey
+	})
+
+	rows := make([]WindowResult, len(closed))
+	for i, w := range closed {
+		row := make(map[string]cty.Value)
+		for k, v := range w.groupValues {
+			row[k] = v
+		}
+
+		if a.schema.Window > 0 {
+			row["window_start"] = cty.NumberIntVal(w.start)
+			row["window_end"] = cty.NumberIntVal(w.start + a.schema.Window)
+		}
+
+		for j, col := range a.columns {
+			row[col.name] = w.accumulators[j].result(col.function)
+		}
+
+		rows[i] = WindowResult{Block: w.block, Values: row}
+	}
+
+	return rows
+}
@@ -0,0 +1,173 @@
+package dsl
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const aggregateSchema = `
+query swaps {
+  chain = "ethereum"
+
+  save {
+    pair = "weth_usdc"
+  }
+
+  aggregate {
+    window = 3600
+    group_by = {
+      pair = pair
+    }
+
+    trades = count()
+    volume = sum(size)
+    avg_price = avg(price)
+    low = min(price)
+    high = max(price)
+    open = first(price)
+    close = last(price)
+    vwap = vwap(price, size)
+  }
+}
+`
+
+func newTestAggregator(t *testing.T, realtime, ordered bool) *Aggregator {
+	s, err := NewSchema(writeSchema(t, aggregateSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agg, err := NewAggregator(s.QuerySchemas[0], realtime, ordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return agg
+}
+
+func swap(price, size int64) map[string]cty.Value {
+	return map[string]cty.Value{
+		"pair":  cty.StringVal("weth_usdc"),
+		"price": cty.NumberIntVal(price),
+		"size":  cty.NumberIntVal(size),
+	}
+}
+
+func TestAggregateHistorical(t *testing.T) {
+	agg := newTestAggregator(t, false, false)
+
+	results := []struct {
+		res  types.CallResult
+		save map[string]cty.Value
+	}{
+		// Out of order on purpose
+		{types.CallResult{BlockNumber: 2, Timestamp: 3700}, swap(4, 1)},
+		{types.CallResult{BlockNumber: 1, Timestamp: 3650}, swap(2, 1)},
+		{types.CallResult{BlockNumber: 3, Timestamp: 3800}, swap(3, 2)},
+		{types.CallResult{BlockNumber: 4, Timestamp: 7300}, swap(10, 5)},
+	}
+
+	for _, r := range results {
+		rows, err := agg.Add(r.res, r.save)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(rows) != 0 {
+			t.Fatal("historical windows should only be emitted on flush")
+		}
+	}
+
+	rows := agg.Flush()
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 windows, got %d", len(rows))
+	}
+
+	expected := map[string]string{
+		"window_start": "3600",
+		"window_end":   "7200",
+		"trades":       "3",
+		"volume":       "4",
+		"avg_price":    "3",
+		"low":          "2",
+		"high":         "4",
+		"open":         "2",
+		"close":        "3",
+		"vwap":         "3",
+	}
+
+	for k, v := range expected {
+		if got := rows[0].Values[k].AsBigFloat().Text('f', -1); got != v {
+			t.Fatalf("%s: expected %s, got %s", k, v, got)
+		}
+	}
+
+	if rows[0].Values["pair"].AsString() != "weth_usdc" {
+		t.Fatal("expected group column")
+	}
+
+	// The rows have the last block of their window
+	if rows[0].Block != 3 || rows[1].Block != 4 {
+		t.Fatalf("unexpected blocks %d and %d", rows[0].Block, rows[1].Block)
+	}
+}
+
+func TestAggregateOrdered(t *testing.T) {
+	agg := newTestAggregator(t, false, true)
+
+	if rows, err := agg.Add(types.CallResult{BlockNumber: 1, Timestamp: 3650}, swap(2, 1)); err != nil || len(rows) != 0 {
+		t.Fatalf("unexpected result: %v %v", rows, err)
+	}
+
+	if rows, err := agg.Add(types.CallResult{BlockNumber: 2, Timestamp: 3700}, swap(4, 1)); err != nil || len(rows) != 0 {
+		t.Fatalf("unexpected result: %v %v", rows, err)
+	}
+
+	// Ordered historical windows are closed as soon as a result passes their end
+	rows, err := agg.Add(types.CallResult{BlockNumber: 3, Timestamp: 7200}, swap(3, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Block != 2 || rows[0].Values["trades"].AsBigFloat().Text('f', -1) != "2" {
+		t.Fatalf("expected the first window to be closed, got %v", rows)
+	}
+
+	if rows := agg.Flush(); len(rows) != 1 || rows[0].Block != 3 {
+		t.Fatalf("expected 1 open window, got %v", rows)
+	}
+}
+
+func TestAggregateRealtime(t *testing.T) {
+	agg := newTestAggregator(t, true, false)
+
+	rows, err := agg.Add(types.CallResult{Timestamp: 3650}, swap(2, 1))
+	if err != nil || len(rows) != 0 {
+		t.Fatalf("unexpected result: %v %v", rows, err)
+	}
+
+	// This result passes the end of the first window
+	rows, err = agg.Add(types.CallResult{Timestamp: 7250}, swap(3, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || rows[0].Values["trades"].AsBigFloat().Text('f', -1) != "1" {
+		t.Fatalf("expected the first window to be closed, got %v", rows)
+	}
+
+	// Late result for the closed window
+	if _, err := agg.Add(types.CallResult{Timestamp: 3700}, swap(2, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if agg.Late != 1 {
+		t.Fatalf("expected 1 late result, got %d", agg.Late)
+	}
+
+	if rows := agg.Flush(); len(rows) != 1 {
+		t.Fatalf("expected 1 open window, got %d", len(rows))
+	}
+}
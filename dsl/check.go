@@ -0,0 +1,490 @@
+package dsl
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hcldec"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// CheckErrors contains all problems found by Check.
+type CheckErrors []error
+
+func (e CheckErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// checkProvider is used to type-check the chain functions, without calling a node.
+type checkProvider struct{}
+
+func (checkProvider) Balance(types.Chain, common.Address, *big.Int) (*big.Float, error) {
+	return new(big.Float), nil
+}
+
+func (checkProvider) TokenBalance(types.Chain, common.Address, common.Address, *big.Int) (*big.Float, error) {
+	return new(big.Float), nil
+}
+
+// Check checks the schema without running it. It makes sure every query runs on one of the
+// given chains, that the methods, events, inputs and outputs exist in the ABIs, and it
+// type-checks every expression with unknown values of the types the results will have.
+// All problems are returned at once, as CheckErrors.
+func (s *DynamicSchema) Check(chains []types.Chain) error {
+	var errs CheckErrors
+
+	// Like in EvalSave, the queries get the chain functions
+	for _, q := range s.QuerySchemas {
+		q.setChainFunctions(BuildChainFunctions(checkProvider{}, "", nil))
+	}
+
+	known := make(map[types.Chain]bool, len(chains))
+	for _, c := range chains {
+		known[c] = true
+	}
+
+	saves := make(map[string]map[string]cty.Value)
+	for _, q := range s.QuerySchemas {
+		fail := func(err error) {
+			errs = append(errs, fmt.Errorf("query %s: %w", q.Name, err))
+		}
+
+		if !known[q.Chain] {
+			fail(fmt.Errorf("chain %s is not defined in the config", q.Chain))
+		}
+
+		for _, err := range q.checkAbis() {
+			fail(err)
+		}
+
+		save, exprErrs := q.checkExpressions()
+		for _, err := range exprErrs {
+			fail(err)
+		}
+
+		saves[q.Name] = save
+	}
+
+	for _, d := range s.DerivedSchemas {
+		for _, err := range d.checkExpressions(saves) {
+			errs = append(errs, fmt.Errorf("derived query %s: %w", d.Name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// checkAbis makes sure the methods and events of the query and their inputs and outputs exist in the ABIs.
+func (q QuerySchema) checkAbis() []error {
+	var errs []error
+	for _, c := range q.ContractSchemas {
+		for _, m := range c.Methods {
+			errs = append(errs, checkMethod(c.Abi, m, c.Address_)...)
+		}
+
+		for _, e := range c.Events {
+			errs = append(errs, checkEvent(c.Abi, e, c.Address_)...)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		errs = append(errs, checkEvent(e.Abi, e, e.OutputName())...)
+	}
+
+	return errs
+}
+
+func checkMethod(contractAbi abi.ABI, m *MethodSchema, source string) []error {
+	abiMethod, ok := contractAbi.Methods[m.Name()]
+	if !ok {
+		return []error{fmt.Errorf("%s: method %s not found in ABI", source, m.Name())}
+	}
+
+	var errs []error
+	for name := range m.Inputs() {
+		if !hasArgument(abiMethod.Inputs, name) {
+			errs = append(errs, fmt.Errorf("%s: method %s has no input %s", source, m.Name(), name))
+		}
+	}
+
+	// A single output is always matched, regardless of its name
+	if len(abiMethod.Outputs) > 1 {
+		for _, name := range m.Outputs {
+			if !hasArgument(abiMethod.Outputs, name) {
+				errs = append(errs, fmt.Errorf("%s: method %s has no output %s", source, m.Name(), name))
+			}
+		}
+	}
+
+	return errs
+}
+
+func checkEvent(contractAbi abi.ABI, e *EventSchema, source string) []error {
+	abiEvent, ok := contractAbi.Events[e.Name()]
+	if !ok {
+		return []error{fmt.Errorf("%s: event %s not found in ABI", source, e.Name())}
+	}
+
+	var errs []error
+	for _, name := range e.Outputs() {
+		if !hasArgument(abiEvent.Inputs, name) {
+			errs = append(errs, fmt.Errorf("%s: event %s has no output %s", source, e.Name(), name))
+		}
+	}
+
+	for _, m := range e.Methods {
+		errs = append(errs, checkMethod(contractAbi, m, source)...)
+	}
+
+	return errs
+}
+
+func hasArgument(args abi.Arguments, name string) bool {
+	for _, arg := range args {
+		if arg.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// abiType returns the type a value of an ABI argument has in the evaluation context.
+func abiType(arg abi.Argument, indexed bool) cty.Type {
+	// Indexed event outputs are converted to addresses
+	if indexed {
+		return cty.String
+	}
+
+	switch arg.Type.T {
+	case abi.IntTy, abi.UintTy:
+		return cty.Number
+	case abi.BoolTy:
+		return cty.Bool
+	case abi.StringTy, abi.AddressTy, abi.BytesTy, abi.FixedBytesTy, abi.HashTy:
+		return cty.String
+	default:
+		return cty.DynamicPseudoType
+	}
+}
+
+// checkVariables returns the variables a result of this query can have, as unknown values of
+// their types: the context variables, and the inputs and outputs of all methods and events.
+func (q QuerySchema) checkVariables() map[string]cty.Value {
+	vars := map[string]cty.Value{
+		"contract_address": cty.UnknownVal(cty.String),
+		"blocknumber":      cty.UnknownVal(cty.Number),
+		"timestamp":        cty.UnknownVal(cty.Number),
+		"block_hash":       cty.UnknownVal(cty.String),
+		"chain":            cty.UnknownVal(cty.String),
+	}
+
+	// The chain metadata is known if SetChains was called
+	for k, v := range chainVars(types.ChainInfo{}) {
+		if known, ok := q.EvalContext.Variables[k]; ok {
+			vars[k] = known
+		} else {
+			vars[k] = cty.UnknownVal(v.Type())
+		}
+	}
+
+	if q.HasContractEvents() || q.HasGlobalEvents() {
+		vars["tx_hash"] = cty.UnknownVal(cty.String)
+		vars["event_name"] = cty.UnknownVal(cty.String)
+		vars["tx_index"] = cty.UnknownVal(cty.Number)
+		vars["log_index"] = cty.UnknownVal(cty.Number)
+	}
+
+	addMethod := func(contractAbi abi.ABI, m *MethodSchema) {
+		abiMethod, ok := contractAbi.Methods[m.Name()]
+		if !ok {
+			return
+		}
+
+		for name := range m.Inputs() {
+			vars[name] = cty.UnknownVal(cty.DynamicPseudoType)
+		}
+
+		for _, name := range m.Outputs {
+			ty := cty.DynamicPseudoType
+			for _, arg := range abiMethod.Outputs {
+				if arg.Name == name || len(abiMethod.Outputs) == 1 {
+					ty = abiType(arg, false)
+				}
+			}
+
+			vars[name] = cty.UnknownVal(ty)
+		}
+	}
+
+	addEvent := func(contractAbi abi.ABI, e *EventSchema) {
+		if abiEvent, ok := contractAbi.Events[e.Name()]; ok {
+			for _, name := range e.Outputs() {
+				for _, arg := range abiEvent.Inputs {
+					if arg.Name == name {
+						vars[name] = cty.UnknownVal(abiType(arg, arg.Indexed))
+					}
+				}
+			}
+		}
+
+		for _, m := range e.Methods {
+			addMethod(contractAbi, m)
+		}
+	}
+
+	for _, c := range q.ContractSchemas {
+		for _, m := range c.Methods {
+			addMethod(c.Abi, m)
+		}
+
+		for _, e := range c.Events {
+			addEvent(c.Abi, e)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		addEvent(e.Abi, e)
+	}
+
+	return vars
+}
+
+// checkExpressions evaluates the transforms, state updates, filter, save and aggregate blocks
+// of the query with unknown values, which catches unknown variables and functions, wrong arguments
+// and type errors. It returns the save columns, so derived queries can be checked too.
+func (q QuerySchema) checkExpressions() (map[string]cty.Value, []error) {
+	var errs []error
+
+	ctx := q.EvalContext.NewChild()
+	ctx.Variables = q.checkVariables()
+
+	var transforms []*Transform
+	for _, c := range q.ContractSchemas {
+		for _, m := range c.Methods {
+			if m.Transforms != nil {
+				transforms = append(transforms, m.Transforms)
+			}
+		}
+
+		for _, e := range c.Events {
+			transforms = append(transforms, e.transforms()...)
+		}
+
+		if c.Transforms != nil {
+			transforms = append(transforms, c.Transforms)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		transforms = append(transforms, e.transforms()...)
+	}
+
+	for _, st := range q.States {
+		ctx.Variables[st.Name] = cty.UnknownVal(q.state.values[st.Name].Type())
+	}
+
+	for _, t := range transforms {
+		mv, tErrs := checkAttributes(t.Options, ctx, "transform")
+		errs = append(errs, tErrs...)
+
+		for k, v := range mv {
+			ctx.Variables[k] = v
+		}
+	}
+
+	for _, st := range q.States {
+		if _, diags := st.Update.Value(ctx); diags.HasErrors() {
+			errs = append(errs, fmt.Errorf("state %s: %w", st.Name, diagError(diags)))
+		}
+	}
+
+	if err := checkFilter(q.Filters, ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	save, saveErrs := checkAttributes(q.Saves.Options, ctx, "save")
+	errs = append(errs, saveErrs...)
+	q.Saves.unwrap(save)
+
+	if q.Aggregate != nil {
+		if err := q.Aggregate.check(ctx, save); err != nil {
+			errs = append(errs, fmt.Errorf("aggregate: %w", err))
+		}
+	} else if keys, err := q.Keys(); err != nil {
+		errs = append(errs, err)
+	} else if save != nil {
+		if err := addKeyColumns(keys, ctx, save); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Derived queries see the context variables of their sources too
+	columns := q.checkVariables()
+	for k, v := range save {
+		columns[k] = v
+	}
+
+	return columns, errs
+}
+
+// checkAttributes evaluates the attributes of body. Attributes with errors get an unknown value
+// of any type, so they don't cause more errors later on.
+func checkAttributes(body hcl.Body, ctx *hcl.EvalContext, block string) (map[string]cty.Value, []error) {
+	attrs, diags := body.JustAttributes()
+	if diags.HasErrors() {
+		return nil, []error{fmt.Errorf("%s: %w", block, diagError(diags))}
+	}
+
+	var errs []error
+	values := make(map[string]cty.Value, len(attrs))
+	for name, attr := range attrs {
+		v, diags := attr.Expr.Value(ctx)
+		if diags.HasErrors() {
+			errs = append(errs, fmt.Errorf("%s: %w", block, diagError(diags)))
+			v = cty.DynamicVal
+		}
+
+		values[name] = v
+	}
+
+	// Sort the errors, since the attributes are unordered
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return values, errs
+}
+
+func (a AggregateSchema) check(parent *hcl.EvalContext, save map[string]cty.Value) error {
+	ctx := parent.NewChild()
+	ctx.Variables = save
+
+	if _, diags := a.GroupBy.Value(ctx); diags.HasErrors() {
+		return diagError(diags)
+	}
+
+	columns, err := a.columns()
+	if err != nil {
+		return err
+	}
+
+	for _, col := range columns {
+		for _, arg := range col.args {
+			if _, diags := arg.Value(ctx); diags.HasErrors() {
+				return fmt.Errorf("column %s: %w", col.name, diagError(diags))
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkExpressions evaluates the filter and save block of the derived query with the
+// checked save columns of its sources.
+func (d DerivedSchema) checkExpressions(saves map[string]map[string]cty.Value) []error {
+	vars := make(map[string]cty.Value)
+	for _, source := range d.Sources {
+		columns := saves[source]
+		for _, key := range d.On {
+			v, ok := columns[key]
+			if !ok {
+				return []error{fmt.Errorf("join key %s not found in query %s", key, source)}
+			}
+
+			vars[key] = v
+		}
+
+		vars[source] = cty.ObjectVal(columns)
+	}
+
+	ctx := d.EvalContext.NewChild()
+	ctx.Variables = vars
+
+	var errs []error
+	if err := checkFilter(d.Filters, ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	_, saveErrs := checkAttributes(d.Saves.Options, ctx, "save")
+
+	return append(errs, saveErrs...)
+}
+
+// checkFilter type-checks the filter list, without requiring the values to be known.
+func checkFilter(body hcl.Body, ctx *hcl.EvalContext) error {
+	if body == nil {
+		return nil
+	}
+
+	_, diags := hcldec.Decode(body, &hcldec.AttrSpec{Name: "filter", Type: cty.List(cty.Bool)}, ctx)
+	if diags.HasErrors() {
+		return fmt.Errorf("filter: %w", diagError(diags))
+	}
+
+	return nil
+}
+
+// Columns returns the sorted output columns of the query: the save columns, or the
+// group_by keys, window and aggregated columns if it has an aggregate block.
+func (q QuerySchema) Columns() ([]string, error) {
+	if q.Aggregate == nil {
+		return q.Saves.columns()
+	}
+
+	aggregated, err := q.Aggregate.columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []string
+	for _, col := range aggregated {
+		columns = append(columns, col.name)
+	}
+
+	if q.Aggregate.Window > 0 {
+		columns = append(columns, "window_start", "window_end")
+	}
+
+	columns = append(columns, q.Aggregate.groupByColumns()...)
+	sort.Strings(columns)
+
+	return columns, nil
+}
+
+// Columns returns the sorted output columns of the derived query.
+func (d DerivedSchema) Columns() ([]string, error) {
+	return d.Saves.columns()
+}
+
+func (s Save) columns() ([]string, error) {
+	attrs, diags := s.Options.JustAttributes()
+	if diags.HasErrors() {
+		return nil, diagError(diags)
+	}
+
+	columns := make([]string, 0, len(attrs))
+	for name := range attrs {
+		columns = append(columns, name)
+	}
+
+	sort.Strings(columns)
+
+	return columns, nil
+}
@@ -0,0 +1,97 @@
+package dsl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+)
+
+func TestCheck(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query transfers {
+  chain = "ethereum"
+  template = "erc20"
+
+  contract {
+    address = "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+    event Transfer {}
+  }
+
+  save {
+    value = parse_decimals(value, 6)
+    mint = mint
+    sender_balance = balance(from)
+  }
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Check([]types.Chain{types.ETHEREUM}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query transfers {
+  chain = "polygon"
+  template = "erc20"
+
+  contract {
+    address = "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+
+    event Transfer {
+      outputs = ["from", "to", "amount"]
+    }
+
+    method balanceOf {
+      inputs = {
+        owner = "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48"
+      }
+    }
+  }
+
+  filter = [
+    blocknumber + 1
+  ]
+
+  save {
+    value = unknown_variable
+  }
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Check([]types.Chain{types.ETHEREUM})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+
+	errs, ok := err.(CheckErrors)
+	if !ok {
+		t.Fatalf("expected CheckErrors, got %T", err)
+	}
+
+	expected := []string{
+		"chain polygon is not defined",
+		"method balanceOf has no input owner",
+		"event Transfer has no output amount",
+		"filter",
+		"save",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+
+	for i, e := range expected {
+		if !strings.Contains(errs[i].Error(), e) {
+			t.Fatalf("expected error %q to contain %q", errs[i], e)
+		}
+	}
+}
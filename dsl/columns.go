@@ -0,0 +1,303 @@
+package dsl
+
+import (
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var (
+	int64Type, _ = abi.NewType("int64", "", nil)
+	uint8Type, _ = abi.NewType("uint8", "", nil)
+)
+
+// contextAbiTypes are the ABI types of the numeric context variables.
+var contextAbiTypes = map[string]abi.Type{
+	"blocknumber":     int64Type,
+	"timestamp":       int64Type,
+	"tx_index":        int64Type,
+	"log_index":       int64Type,
+	"chain_id":        int64Type,
+	"native_decimals": uint8Type,
+}
+
+// ColumnAbiTypes returns the ABI types of the save columns that are a plain reference to an input
+// or output of a method or event, or to a numeric context variable, like `block = blocknumber`,
+// and of the numeric context variables that are keys. Variables that a transform assigns can
+// have any type, so they have no ABI types.
+// Outputs can use them to pick more precise column types than the values alone would give.
+// Columns of aggregated queries are computed, so they have no ABI types, except for the
+// window bounds.
+func (q QuerySchema) ColumnAbiTypes() map[string]abi.Type {
+	types := make(map[string]abi.Type)
+	if q.Aggregate != nil {
+		if q.Aggregate.Window > 0 {
+			types["window_start"] = int64Type
+			types["window_end"] = int64Type
+		}
+
+		return types
+	}
+
+	attrs, diags := q.Saves.Options.JustAttributes()
+	if diags.HasErrors() {
+		return types
+	}
+
+	args := q.abiArguments()
+	transformed := q.transformed()
+	annotated := q.Saves.annotations()
+	for name, attr := range attrs {
+		if _, ok := annotated[name]; ok {
+			continue
+		}
+
+		traversal, diags := hcl.AbsTraversalForExpr(attr.Expr)
+		if diags.HasErrors() || len(traversal) != 1 {
+			continue
+		}
+
+		ref := traversal.RootName()
+		if transformed[ref] {
+			continue
+		}
+
+		if t, ok := contextAbiTypes[ref]; ok {
+			types[name] = t
+		} else if t, ok := args[ref]; ok {
+			types[name] = t
+		}
+	}
+
+	// Keys that are not saved are added from the context variables
+	keys, _ := q.Keys()
+	for _, k := range keys {
+		if _, ok := attrs[k]; ok || transformed[k] {
+			continue
+		}
+
+		if t, ok := contextAbiTypes[k]; ok {
+			types[k] = t
+		}
+	}
+
+	return types
+}
+
+// ColumnAbiTypes returns the ABI types of the save columns that are a plain reference to
+// a numeric context variable, like `block = blocknumber` or `time = swaps.timestamp`.
+// Save columns of the sources replace their context variables, so those are left out.
+func (d DerivedSchema) ColumnAbiTypes() map[string]abi.Type {
+	types := make(map[string]abi.Type)
+
+	attrs, diags := d.Saves.Options.JustAttributes()
+	if diags.HasErrors() {
+		return types
+	}
+
+	sources := make(map[string]bool, len(d.Sources))
+	for _, source := range d.Sources {
+		sources[source] = true
+	}
+
+	annotated := d.Saves.annotations()
+	for name, attr := range attrs {
+		if _, ok := annotated[name]; ok {
+			continue
+		}
+
+		traversal, diags := hcl.AbsTraversalForExpr(attr.Expr)
+		if diags.HasErrors() {
+			continue
+		}
+
+		// A join key, or a variable of a source
+		ref := traversal.RootName()
+		switch {
+		case len(traversal) == 1:
+		case len(traversal) == 2 && sources[ref]:
+			attr, ok := traversal[1].(hcl.TraverseAttr)
+			if !ok {
+				continue
+			}
+
+			ref = attr.Name
+		default:
+			continue
+		}
+
+		if t, ok := contextAbiTypes[ref]; ok && !d.sourceColumns[ref] {
+			types[name] = t
+		}
+	}
+
+	return types
+}
+
+// TypeAnnotations returns the types of the save columns with a type annotation, like
+// `timestamp = { value = timestamp, type = "timestamptz" }`. Columns of aggregated queries
+// are computed, so they have no annotations.
+func (q QuerySchema) TypeAnnotations() map[string]string {
+	if q.Aggregate != nil {
+		return make(map[string]string)
+	}
+
+	return q.Saves.annotations()
+}
+
+// TypeAnnotations returns the types of the save columns with a type annotation.
+func (d DerivedSchema) TypeAnnotations() map[string]string {
+	return d.Saves.annotations()
+}
+
+// annotations returns the types of the columns that are an object with only a value
+// and a type, which is a string literal.
+func (s Save) annotations() map[string]string {
+	types := make(map[string]string)
+
+	attrs, diags := s.Options.JustAttributes()
+	if diags.HasErrors() {
+		return types
+	}
+
+	for name, attr := range attrs {
+		obj, ok := attr.Expr.(*hclsyntax.ObjectConsExpr)
+		if !ok || len(obj.Items) != 2 {
+			continue
+		}
+
+		var hasValue bool
+		var typ string
+		for _, item := range obj.Items {
+			key, diags := item.KeyExpr.Value(nil)
+			if diags.HasErrors() || key.Type() != cty.String {
+				break
+			}
+
+			switch key.AsString() {
+			case "value":
+				hasValue = true
+			case "type":
+				if v, diags := item.ValueExpr.Value(nil); !diags.HasErrors() && v.Type() == cty.String && !v.IsNull() {
+					typ = v.AsString()
+				}
+			}
+		}
+
+		if hasValue && typ != "" {
+			types[name] = typ
+		}
+	}
+
+	return types
+}
+
+// unwrap replaces the annotated columns of the evaluated save block by their values.
+func (s Save) unwrap(outputs map[string]cty.Value) {
+	for name := range s.annotations() {
+		v, ok := outputs[name]
+		if ok && v.Type().IsObjectType() && v.Type().HasAttribute("value") && !v.IsNull() {
+			outputs[name] = v.GetAttr("value")
+		}
+	}
+}
+
+// transformed returns the names of the variables that are assigned by any transform of the query.
+func (q QuerySchema) transformed() map[string]bool {
+	names := make(map[string]bool)
+
+	add := func(t *Transform) {
+		if t == nil {
+			return
+		}
+
+		attrs, _ := t.Options.JustAttributes()
+		for name := range attrs {
+			names[name] = true
+		}
+	}
+
+	addEvent := func(e *EventSchema) {
+		add(e.Transforms)
+		for _, m := range e.Methods {
+			add(m.Transforms)
+		}
+	}
+
+	for _, c := range q.ContractSchemas {
+		add(c.Transforms)
+		for _, m := range c.Methods {
+			add(m.Transforms)
+		}
+
+		for _, e := range c.Events {
+			addEvent(e)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		addEvent(e)
+	}
+
+	return names
+}
+
+// abiArguments returns the ABI types of the method inputs and outputs, and the event outputs of the query.
+// Indexed event outputs are left out, because they're converted to strings.
+func (q QuerySchema) abiArguments() map[string]abi.Type {
+	args := make(map[string]abi.Type)
+
+	addMethod := func(contractAbi abi.ABI, m *MethodSchema) {
+		abiMethod, ok := contractAbi.Methods[m.Name()]
+		if !ok {
+			return
+		}
+
+		for _, arg := range abiMethod.Inputs {
+			if _, ok := m.Inputs()[arg.Name]; ok {
+				args[arg.Name] = arg.Type
+			}
+		}
+
+		for _, name := range m.Outputs {
+			for _, arg := range abiMethod.Outputs {
+				if arg.Name == name || len(abiMethod.Outputs) == 1 {
+					args[name] = arg.Type
+				}
+			}
+		}
+	}
+
+	addEvent := func(contractAbi abi.ABI, e *EventSchema) {
+		if abiEvent, ok := contractAbi.Events[e.Name()]; ok {
+			for _, name := range e.Outputs() {
+				for _, arg := range abiEvent.Inputs {
+					if arg.Name == name && !arg.Indexed {
+						args[name] = arg.Type
+					}
+				}
+			}
+		}
+
+		for _, m := range e.Methods {
+			addMethod(contractAbi, m)
+		}
+	}
+
+	for _, c := range q.ContractSchemas {
+		for _, m := range c.Methods {
+			addMethod(c.Abi, m)
+		}
+
+		for _, e := range c.Events {
+			addEvent(c.Abi, e)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		addEvent(e.Abi, e)
+	}
+
+	return args
+}
@@ -0,0 +1,154 @@
+package dsl
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTypeAnnotations(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query transfers {
+  chain = "ethereum"
+  table_mode = "upsert"
+
+  event Transfer {
+    abi = "erc20.abi.json"
+    outputs = ["from", "value"]
+  }
+
+  save {
+    time = { value = timestamp, type = "timestamptz" }
+    sender = from
+    amount = value
+    // Not an annotation, the type is not a string
+    pair = { value = value, type = 1 }
+  }
+}
+`), WithAbiDir("templates/erc20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := s.QuerySchemas[0]
+	annotations := q.TypeAnnotations()
+	if len(annotations) != 1 || annotations["time"] != "timestamptz" {
+		t.Fatalf("unexpected annotations %v", annotations)
+	}
+
+	abiTypes := q.ColumnAbiTypes()
+	if abiTypes["amount"].String() != "uint256" || abiTypes["log_index"].String() != "int64" {
+		t.Fatalf("unexpected ABI types %v", abiTypes)
+	}
+
+	// Annotated columns have the type of their annotation
+	if _, ok := abiTypes["time"]; ok {
+		t.Fatal("expected no ABI type for an annotated column")
+	}
+
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{
+		QueryName: "transfers",
+		Type:      types.GlobalEvent,
+		Timestamp: 1650000000,
+		TxHash:    common.HexToHash("0x01"),
+		Outputs:   map[string]any{"from": "0xabc", "value": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := save["time"].AsBigFloat().Text('f', 0); got != "1650000000" {
+		t.Fatalf("expected the annotated value, got %s", got)
+	}
+
+	if !save["pair"].Type().IsObjectType() {
+		t.Fatalf("expected an object, got %s", save["pair"].Type().FriendlyName())
+	}
+}
+
+func TestColumnAbiTypesTransformed(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query transfers {
+  chain = "ethereum"
+
+  event Transfer {
+    abi = "erc20.abi.json"
+    outputs = ["from", "to", "value"]
+
+    transform {
+      value = value / 1000000
+    }
+  }
+
+  save {
+    amount = value
+    receiver = to
+    block = blocknumber
+  }
+}
+`), WithAbiDir("templates/erc20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transformed value is a fraction, not an uint256
+	abiTypes := s.QuerySchemas[0].ColumnAbiTypes()
+	if _, ok := abiTypes["amount"]; ok {
+		t.Fatalf("expected no ABI type for a transformed column, got %s", abiTypes["amount"].String())
+	}
+
+	if abiTypes["block"].String() != "int64" {
+		t.Fatalf("unexpected ABI types %v", abiTypes)
+	}
+}
+
+func TestDerivedColumnAbiTypes(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+  save {
+    size = 1
+  }
+}
+
+query prices {
+  chain = "ethereum"
+  save {
+    price = 1
+    timestamp = 1.5
+  }
+
+  aggregate {
+    window = 60
+    close = last(price)
+  }
+}
+
+derived priced_swaps {
+  sources = ["swaps", "prices"]
+  on = ["blocknumber"]
+  save {
+    block = blocknumber
+    index = swaps.log_index
+    time = prices.timestamp
+    size = swaps.size
+  }
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The timestamp of prices is a save column, which can be a fraction
+	abiTypes := s.DerivedSchemas[0].ColumnAbiTypes()
+	if len(abiTypes) != 2 || abiTypes["block"].String() != "int64" || abiTypes["index"].String() != "int64" {
+		t.Fatalf("unexpected ABI types %v", abiTypes)
+	}
+
+	// Aggregates only have the window bounds
+	abiTypes = s.QuerySchemas[1].ColumnAbiTypes()
+	if len(abiTypes) != 2 || abiTypes["window_start"].String() != "int64" {
+		t.Fatalf("unexpected ABI types %v", abiTypes)
+	}
+}
@@ -0,0 +1,113 @@
+package dsl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/hashicorp/hcl/v2"
+)
+
+// diagnosticsWidth is the width the diagnostic messages are wrapped at.
+const diagnosticsWidth = 100
+
+// sources keeps every parsed schema and template file, so diagnostics can be rendered with
+// a snippet of their source, even after the schema failed to load.
+var sources = struct {
+	sync.Mutex
+	files map[string]*hcl.File
+}{files: make(map[string]*hcl.File)}
+
+func addSource(name string, file *hcl.File) {
+	if file == nil {
+		return
+	}
+
+	sources.Lock()
+	defer sources.Unlock()
+
+	sources.files[name] = file
+}
+
+// DiagnosticsError contains all diagnostics of a failed decoding or evaluation step.
+type DiagnosticsError struct {
+	Diags hcl.Diagnostics
+}
+
+func diagError(diags hcl.Diagnostics) error {
+	return &DiagnosticsError{Diags: diags}
+}
+
+func (e *DiagnosticsError) Error() string {
+	return e.Diags.Error()
+}
+
+// Render renders every diagnostic with its file, line and column and a highlighted snippet of the source.
+func (e *DiagnosticsError) Render(color bool) string {
+	sources.Lock()
+	defer sources.Unlock()
+
+	var buf bytes.Buffer
+	wr := hcl.NewDiagnosticTextWriter(&buf, sources.files, diagnosticsWidth, color)
+	if err := wr.WriteDiagnostics(e.Diags); err != nil {
+		return e.Error()
+	}
+
+	return buf.String()
+}
+
+// EvalError annotates an evaluation error with the result that caused it.
+type EvalError struct {
+	Query       string
+	BlockNumber uint64
+	// TxHash is empty for method results
+	TxHash string
+	Err    error
+}
+
+func newEvalError(res types.CallResult, err error) error {
+	e := &EvalError{
+		Query:       res.QueryName,
+		BlockNumber: res.BlockNumber,
+		Err:         err,
+	}
+
+	if res.Type != types.Method {
+		e.TxHash = res.TxHash.String()
+	}
+
+	return e
+}
+
+func (e *EvalError) Error() string {
+	if e.TxHash != "" {
+		return fmt.Sprintf("query %s at block %d (tx %s): %s", e.Query, e.BlockNumber, e.TxHash, e.Err)
+	}
+
+	return fmt.Sprintf("query %s at block %d: %s", e.Query, e.BlockNumber, e.Err)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
+
+// FormatError formats err for the terminal. If it contains diagnostics, they are rendered
+// with their source snippets, after the context of the error.
+func FormatError(err error, color bool) string {
+	var diagErr *DiagnosticsError
+	if !errors.As(err, &diagErr) {
+		return err.Error()
+	}
+
+	rendered := strings.TrimRight(diagErr.Render(color), "\n")
+	prefix := strings.TrimSuffix(strings.TrimSuffix(err.Error(), diagErr.Error()), ": ")
+	if prefix == "" {
+		return rendered
+	}
+
+	return prefix + ":\n" + rendered
+}
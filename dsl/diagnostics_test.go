@@ -0,0 +1,64 @@
+package dsl
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFormatError(t *testing.T) {
+	_, err := NewSchema(writeSchema(t, `
+query swaps {
+  chain =
+}
+`))
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+
+	formatted := FormatError(err, false)
+	for _, expected := range []string{"schema.hcl line 3", "chain =", "Invalid expression"} {
+		if !strings.Contains(formatted, expected) {
+			t.Fatalf("expected %q in:\n%s", expected, formatted)
+		}
+	}
+}
+
+func TestEvalError(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+
+  save {
+    size = size * 2
+  }
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txHash := common.HexToHash("0x01")
+	_, err = s.EvalSave(mockProvider{}, types.CallResult{
+		QueryName:   "swaps",
+		Type:        types.Event,
+		BlockNumber: 15,
+		TxHash:      txHash,
+	})
+
+	var evalErr *EvalError
+	if !errors.As(err, &evalErr) {
+		t.Fatalf("expected an EvalError, got %v", err)
+	}
+
+	if evalErr.Query != "swaps" || evalErr.BlockNumber != 15 || evalErr.TxHash != txHash.String() {
+		t.Fatalf("unexpected annotation: %s", evalErr)
+	}
+
+	if !strings.Contains(FormatError(err, false), "size = size * 2") {
+		t.Fatalf("expected a source snippet in:\n%s", FormatError(err, false))
+	}
+}
@@ -0,0 +1,165 @@
+package dsl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// includeSchema is the part of a schema file that is decoded before anything else,
+// because it determines which other files belong to the schema.
+var includeSchema = &hcl.BodySchema{
+	Attributes: []hcl.AttributeSchema{
+		{Name: "include"},
+	},
+}
+
+// schemaFile is a parsed schema file, without its include directive.
+type schemaFile struct {
+	Name string
+	Body hcl.Body
+}
+
+// loadSchemaFiles parses the schema at schemaPath. If schemaPath is a directory, every
+// *.hcl file in it is loaded. If it's a file, only that file is loaded. In both cases,
+// the include directives are followed, relative to the file they are defined in.
+// It also returns the base directory of the schema, in which the ABIs can be found.
+func loadSchemaFiles(parser *hclparse.Parser, schemaPath string) ([]schemaFile, string, error) {
+	info, err := os.Stat(schemaPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	baseDir := schemaPath
+	paths := []string{schemaPath}
+	if info.IsDir() {
+		paths, err = filepath.Glob(filepath.Join(schemaPath, "*.hcl"))
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(paths) == 0 {
+			return nil, "", fmt.Errorf("no schema files found in %s", schemaPath)
+		}
+	} else {
+		baseDir = filepath.Dir(schemaPath)
+	}
+
+	var files []schemaFile
+	visited := make(map[string]bool)
+
+	var load func(p string) error
+	load = func(p string) error {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+
+		if visited[abs] {
+			return nil
+		}
+		visited[abs] = true
+
+		file, diags := parser.ParseHCLFile(p)
+		addSource(p, file)
+		if diags.HasErrors() {
+			return diagError(diags)
+		}
+
+		content, body, diags := file.Body.PartialContent(includeSchema)
+		if diags.HasErrors() {
+			return diagError(diags)
+		}
+
+		files = append(files, schemaFile{Name: p, Body: body})
+
+		attr, ok := content.Attributes["include"]
+		if !ok {
+			return nil
+		}
+
+		var patterns []string
+		diags = gohcl.DecodeExpression(attr.Expr, nil, &patterns)
+		if diags.HasErrors() {
+			return diagError(diags)
+		}
+
+		for _, pattern := range patterns {
+			matches, err := filepath.Glob(filepath.Join(filepath.Dir(p), pattern))
+			if err != nil {
+				return fmt.Errorf("%s: invalid include %q: %w", p, pattern, err)
+			}
+
+			if len(matches) == 0 {
+				return fmt.Errorf("%s: include %q matches no files", p, pattern)
+			}
+
+			for _, match := range matches {
+				if err := load(match); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for _, p := range paths {
+		if err := load(p); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return files, baseDir, nil
+}
+
+// merge adds the settings and variables of a schema file to the schema. A setting or
+// variable can only be defined in one file. defined keeps track of where everything was defined.
+func (s *DynamicSchema) merge(other *DynamicSchema, filename string, defined map[string]string) error {
+	settings := []struct {
+		name string
+		dst  *int64
+		src  int64
+	}{
+		{"start_time", &s.StartTime, other.StartTime},
+		{"end_time", &s.EndTime, other.EndTime},
+		{"time_interval", &s.TimeInterval, other.TimeInterval},
+		{"start_block", &s.StartBlock, other.StartBlock},
+		{"end_block", &s.EndBlock, other.EndBlock},
+		{"block_interval", &s.BlockInterval, other.BlockInterval},
+	}
+
+	for _, setting := range settings {
+		if setting.src == 0 {
+			continue
+		}
+
+		if f, ok := defined[setting.name]; ok {
+			return fmt.Errorf("%s is defined in both %s and %s", setting.name, f, filename)
+		}
+
+		defined[setting.name] = filename
+		*setting.dst = setting.src
+	}
+
+	if s.Variables == nil {
+		s.Variables = make(map[string]cty.Value)
+	}
+
+	for k, v := range other.Variables {
+		key := "variable " + k
+		if f, ok := defined[key]; ok {
+			return fmt.Errorf("variable %s is defined in both %s and %s", k, f, filename)
+		}
+
+		defined[key] = filename
+		s.Variables[k] = v
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package dsl
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+const balanceQuery = `
+query %s {
+  chain = "arbitrum"
+
+  save {
+    account = account
+  }
+}
+`
+
+func TestSchemaDirectory(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"main.hcl": `
+start_block = 10
+include = ["dex/*.hcl"]
+
+variables = {
+  account = "0xe1Dd30fecAb8a63105F2C035B084BfC6Ca5B1493"
+}
+` + strings.ReplaceAll(balanceQuery, "%s", "main_balances"),
+		"other.hcl":       strings.ReplaceAll(balanceQuery, "%s", "other_balances"),
+		"dex/uniswap.hcl": strings.ReplaceAll(balanceQuery, "%s", "uniswap_balances"),
+	})
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.QuerySchemas) != 3 {
+		t.Fatalf("expected 3 queries, got %d", len(s.QuerySchemas))
+	}
+
+	if s.StartBlock != 10 {
+		t.Fatalf("expected start block 10, got %d", s.StartBlock)
+	}
+
+	// Loading a single file should only follow its includes
+	s, err = NewSchema(path.Join(dir, "main.hcl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.QuerySchemas) != 2 {
+		t.Fatalf("expected 2 queries, got %d", len(s.QuerySchemas))
+	}
+}
+
+func TestSchemaCollisions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.hcl": strings.ReplaceAll(balanceQuery, "%s", "balances"),
+		"b.hcl": `variables = { account = "0x0" }` + strings.ReplaceAll(balanceQuery, "%s", "balances"),
+	})
+
+	if _, err := NewSchema(dir); err == nil || !strings.Contains(err.Error(), "query balances is defined in both") {
+		t.Fatalf("expected query collision, got %v", err)
+	}
+
+	dir = writeFiles(t, map[string]string{
+		"a.hcl": `variables = { account = "0x0" }`,
+		"b.hcl": `variables = { account = "0x1" }`,
+	})
+
+	if _, err := NewSchema(dir); err == nil || !strings.Contains(err.Error(), "variable account is defined in both") {
+		t.Fatalf("expected variable collision, got %v", err)
+	}
+}
@@ -1,7 +1,11 @@
 package dsl
 
 import (
+	"errors"
+	"fmt"
 	"math/big"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/chainbound/apollo/types"
@@ -18,6 +22,36 @@ var Functions = map[string]function.Function{
 	"abs":            stdlib.AbsoluteFunc,
 	"parse_decimals": ParseDecimals,
 	"format_date":    FormatDate,
+	"mul_div":        MulDiv,
+	"pow":            Pow,
+	"env":            Env,
+}
+
+// numberPrecision is the precision cty uses for numbers parsed from strings.
+// Intermediate results are computed at this precision too.
+const numberPrecision = 512
+
+// ScaleDecimals divides a raw on-chain integer by 10^decimals without going through
+// a float64. The result is built from its exact decimal representation, so it survives
+// the round trip to the outputs with full precision.
+func ScaleDecimals(raw *big.Int, decimals int64) *big.Float {
+	digits := new(big.Int).Abs(raw).String()
+	if decimals > 0 {
+		if pad := int(decimals) - len(digits) + 1; pad > 0 {
+			digits = strings.Repeat("0", pad) + digits
+		}
+
+		digits = digits[:len(digits)-int(decimals)] + "." + digits[len(digits)-int(decimals):]
+	} else if decimals < 0 {
+		digits += strings.Repeat("0", int(-decimals))
+	}
+
+	if raw.Sign() < 0 {
+		digits = "-" + digits
+	}
+
+	f, _, _ := big.ParseFloat(digits, 10, numberPrecision, big.ToNearestEven)
+	return f
 }
 
 // The definition of the `parse_decimals` function.
@@ -35,10 +69,142 @@ var ParseDecimals = function.New(&function.Spec{
 		raw := args[0].AsBigFloat()
 		decimalsInt, _ := args[1].AsBigFloat().Int64()
 
+		// Raw on-chain values are integers, which we can scale exactly.
+		if raw.IsInt() {
+			rawInt, _ := raw.Int(nil)
+			return cty.NumberVal(ScaleDecimals(rawInt, decimalsInt)), nil
+		}
+
 		divider := new(big.Int).Exp(big.NewInt(10), big.NewInt(decimalsInt), nil)
-		parsed, _ := raw.Quo(raw, new(big.Float).SetInt(divider)).Float64()
+		parsed := new(big.Float).SetPrec(numberPrecision).Quo(raw, new(big.Float).SetInt(divider))
+
+		return cty.NumberVal(parsed), nil
+	},
+})
+
+// The definition of the `mul_div` function.
+//
+// Calculates a * b / c. If all arguments are integers, the calculation is done
+// with integer arithmetic and the result is truncated, like it would be on-chain.
+var MulDiv = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "a", Type: cty.Number},
+		{Name: "b", Type: cty.Number},
+		{Name: "c", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.Number),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		a, b, c := args[0].AsBigFloat(), args[1].AsBigFloat(), args[2].AsBigFloat()
+		if c.Sign() == 0 {
+			return cty.NilVal, errors.New("mul_div: division by zero")
+		}
+
+		if a.IsInt() && b.IsInt() && c.IsInt() {
+			aInt, _ := a.Int(nil)
+			bInt, _ := b.Int(nil)
+			cInt, _ := c.Int(nil)
+
+			res := new(big.Int).Mul(aInt, bInt)
+			res.Quo(res, cInt)
+
+			return cty.NumberVal(new(big.Float).SetInt(res)), nil
+		}
+
+		res := new(big.Float).SetPrec(numberPrecision).Mul(a, b)
+		res.Quo(res, c)
+
+		return cty.NumberVal(res), nil
+	},
+})
+
+// maxPowBits is the maximum size of an exact result of `pow`, so a huge exponent returns
+// an error instead of running out of memory. It's far more than the 256 bits of EVM integers.
+const maxPowBits = 8192
 
-		return cty.NumberFloatVal(parsed), nil
+// The definition of the `pow` function.
+//
+// Raises base to the power of exponent. Integer exponents are calculated exactly, up to
+// results of maxPowBits bits. Fractional exponents fall back to floating point.
+var Pow = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "base", Type: cty.Number},
+		{Name: "exponent", Type: cty.Number},
+	},
+	Type: function.StaticReturnType(cty.Number),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		base, exp := args[0].AsBigFloat(), args[1].AsBigFloat()
+		if !exp.IsInt() {
+			return stdlib.PowFunc.Call(args)
+		}
+
+		n, acc := exp.Int64()
+		if acc != big.Exact {
+			return cty.NilVal, errors.New("pow: exponent out of range")
+		}
+
+		if base.IsInt() && n >= 0 {
+			baseInt, _ := base.Int(nil)
+
+			// The result has more than (BitLen - 1) * n bits. 0, 1 and -1 never grow.
+			if bits := int64(baseInt.BitLen() - 1); bits > 0 && n > maxPowBits/bits {
+				return cty.NilVal, fmt.Errorf("pow: result of %s^%d is larger than %d bits", baseInt, n, maxPowBits)
+			}
+
+			res := new(big.Int).Exp(baseInt, big.NewInt(n), nil)
+			return cty.NumberVal(new(big.Float).SetInt(res)), nil
+		}
+
+		neg := n < 0
+		if neg {
+			n = -n
+		}
+
+		// Exponentiation by squaring
+		res := new(big.Float).SetPrec(numberPrecision).SetInt64(1)
+		sq := new(big.Float).SetPrec(numberPrecision).Set(base)
+		for ; n > 0; n >>= 1 {
+			if n&1 == 1 {
+				res.Mul(res, sq)
+			}
+			sq.Mul(sq, sq)
+		}
+
+		if neg {
+			if res.Sign() == 0 {
+				return cty.NilVal, errors.New("pow: division by zero")
+			}
+			res.Quo(new(big.Float).SetPrec(numberPrecision).SetInt64(1), res)
+		}
+
+		return cty.NumberVal(res), nil
+	},
+})
+
+// The definition of the `env` function
+//
+// Returns the value of an environment variable. If it isn't set, the optional default
+// is returned, or an error if there is none. The values are not redacted in the logs,
+// so secrets belong in the config.
+var Env = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "name", Type: cty.String},
+	},
+	VarParam: &function.Parameter{Name: "default", Type: cty.String},
+	Type:     function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, retType cty.Type) (cty.Value, error) {
+		name := args[0].AsString()
+		if v, ok := os.LookupEnv(name); ok {
+			return cty.StringVal(v), nil
+		}
+
+		switch len(args) {
+		case 1:
+			return cty.NilVal, fmt.Errorf("environment variable %s is not set", name)
+		case 2:
+			return args[1], nil
+		default:
+			return cty.NilVal, errors.New("env takes at most one default")
+		}
 	},
 })
 
@@ -80,7 +246,7 @@ func BuildChainFunctions(provider ChainFunctionProvider, chain types.Chain, bloc
 					return cty.NilVal, err
 				}
 
-				return cty.NumberFloatVal(b), nil
+				return cty.NumberVal(b), nil
 			},
 		}),
 
@@ -98,7 +264,7 @@ func BuildChainFunctions(provider ChainFunctionProvider, chain types.Chain, bloc
 					return cty.NilVal, err
 				}
 
-				return cty.NumberFloatVal(b), nil
+				return cty.NumberVal(b), nil
 			},
 		}),
 
@@ -0,0 +1,110 @@
+package dsl
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestParseDecimals(t *testing.T) {
+	raw, _ := new(big.Int).SetString("123456789012345678901234567", 10)
+	v, err := ParseDecimals.Call([]cty.Value{cty.NumberVal(new(big.Float).SetInt(raw)), cty.NumberIntVal(18)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.AsBigFloat().Text('f', -1); got != "123456789.012345678901234567" {
+		t.Fatalf("expected 123456789.012345678901234567, got %s", got)
+	}
+
+	v, err = ParseDecimals.Call([]cty.Value{cty.NumberIntVal(5), cty.NumberIntVal(6)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.AsBigFloat().Text('f', -1); got != "0.000005" {
+		t.Fatalf("expected 0.000005, got %s", got)
+	}
+}
+
+func TestMulDiv(t *testing.T) {
+	a, _ := new(big.Int).SetString("340282366920938463463374607431768211456", 10)
+	v, err := MulDiv.Call([]cty.Value{cty.NumberVal(new(big.Float).SetInt(a)), cty.NumberIntVal(3), cty.NumberIntVal(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Integer arithmetic truncates like Solidity does
+	if got := v.AsBigFloat().Text('f', -1); got != "145835300108973627198589117470757804909" {
+		t.Fatalf("unexpected result %s", got)
+	}
+
+	if _, err := MulDiv.Call([]cty.Value{cty.NumberIntVal(1), cty.NumberIntVal(1), cty.NumberIntVal(0)}); err == nil {
+		t.Fatal("expected division by zero error")
+	}
+}
+
+func TestPow(t *testing.T) {
+	v, err := Pow.Call([]cty.Value{cty.NumberIntVal(10), cty.NumberIntVal(30)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.AsBigFloat().Text('f', -1); got != "1000000000000000000000000000000" {
+		t.Fatalf("unexpected result %s", got)
+	}
+
+	v, err = Pow.Call([]cty.Value{cty.NumberIntVal(2), cty.NumberIntVal(-2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.AsBigFloat().Text('f', -1); got != "0.25" {
+		t.Fatalf("unexpected result %s", got)
+	}
+
+	// Huge exact results are refused
+	if _, err := Pow.Call([]cty.Value{cty.NumberIntVal(10), cty.NumberIntVal(1000000000000)}); err == nil {
+		t.Fatal("expected an error for a result that is too large")
+	}
+
+	if _, err := Pow.Call([]cty.Value{cty.NumberIntVal(2), cty.NumberIntVal(maxPowBits)}); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = Pow.Call([]cty.Value{cty.NumberIntVal(-1), cty.NumberIntVal(1000000000001)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := v.AsBigFloat().Text('f', -1); got != "-1" {
+		t.Fatalf("unexpected result %s", got)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("APOLLO_TEST_ENV", "value")
+
+	v, err := Env.Call([]cty.Value{cty.StringVal("APOLLO_TEST_ENV")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.AsString() != "value" {
+		t.Fatalf("expected value, got %s", v.AsString())
+	}
+
+	v, err = Env.Call([]cty.Value{cty.StringVal("APOLLO_TEST_UNSET"), cty.StringVal("default")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.AsString() != "default" {
+		t.Fatalf("expected default, got %s", v.AsString())
+	}
+
+	if _, err := Env.Call([]cty.Value{cty.StringVal("APOLLO_TEST_UNSET")}); err == nil {
+		t.Fatal("expected error for unset variable")
+	}
+}
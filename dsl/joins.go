@@ -0,0 +1,396 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+var (
+	ErrNotEnoughSources = errors.New("derived query needs at least 2 sources")
+	ErrNoJoinKeys       = errors.New("derived query needs at least 1 join key")
+)
+
+// DerivedSchema defines a DSL derived query. It doesn't fetch anything itself, but joins
+// the results of other queries on the keys in `on`, like:
+//
+//	derived priced_swaps {
+//	  sources = ["swaps", "prices"]
+//	  on = ["blocknumber"]
+//
+//	  save {
+//	    value = swaps.size * prices.price
+//	  }
+//	}
+type DerivedSchema struct {
+	Name string `hcl:"name,label"`
+
+	// Sources are the names of the queries that are joined.
+	Sources []string `hcl:"sources"`
+	// On are the join keys. They are looked up in the save columns of every source first,
+	// and in the context variables (like tx_hash or blocknumber) of its results otherwise.
+	On []string `hcl:"on"`
+	// Window is the number of seconds results are kept to be joined, based on their timestamp.
+	// Only used in realtime mode. Historical runs keep the results until every source has
+	// passed their block if one of the join keys is blocknumber, block_hash or tx_hash, and
+	// the results are in chain order. Otherwise, they keep all results until the end, so
+	// their memory grows with the number of results.
+	Window int64 `hcl:"window,optional"`
+	// TableMode_ is the table mode of the derived query, like for queries.
+	TableMode_ string `hcl:"table_mode,optional"`
+	// PrimaryKey is an optional list of save columns that identify a joined result.
+	PrimaryKey hcl.Expression `hcl:"primary_key,optional"`
+
+	Saves   Save     `hcl:"save,block"`
+	Filters hcl.Body `hcl:"filter,remain"`
+
+	EvalContext *hcl.EvalContext
+
+	// joinsOnBlock is true if only results of the same block can be joined.
+	joinsOnBlock bool
+	// sourceColumns are the save columns of the sources.
+	sourceColumns map[string]bool
+}
+
+// blockKeys are the context variables that belong to a single block.
+var blockKeys = map[string]bool{
+	"blocknumber": true,
+	"block_hash":  true,
+	"tx_hash":     true,
+}
+
+// TableMode returns the table mode of the derived query, append if it's not defined.
+func (d DerivedSchema) TableMode() types.TableMode {
+	mode, _ := types.ParseTableMode(d.TableMode_)
+	return mode
+}
+
+// validate checks that the derived query joins existing and distinct queries.
+func (d DerivedSchema) validate(queries []*QuerySchema) error {
+	if len(d.Sources) < 2 {
+		return ErrNotEnoughSources
+	}
+
+	if len(d.On) == 0 {
+		return ErrNoJoinKeys
+	}
+
+	if _, err := types.ParseTableMode(d.TableMode_); err != nil {
+		return err
+	}
+
+	keys, err := d.Keys()
+	if err != nil {
+		return err
+	}
+
+	columns, err := d.Columns()
+	if err != nil {
+		return err
+	}
+
+	if err := keysInColumns(keys, columns); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, source := range d.Sources {
+		if seen[source] {
+			return fmt.Errorf("source %s is joined more than once", source)
+		}
+		seen[source] = true
+
+		found := false
+		for _, q := range queries {
+			if q.Name == source {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("source %s is not a query", source)
+		}
+	}
+
+	return nil
+}
+
+// saveColumns returns the save columns of the sources, which replace the context variables
+// with the same name.
+func (d DerivedSchema) saveColumns(queries []*QuerySchema) (map[string]bool, error) {
+	sources := make(map[string]bool, len(d.Sources))
+	for _, source := range d.Sources {
+		sources[source] = true
+	}
+
+	columns := make(map[string]bool)
+	for _, q := range queries {
+		if !sources[q.Name] {
+			continue
+		}
+
+		cols, err := q.Saves.columns()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, col := range cols {
+			columns[col] = true
+		}
+	}
+
+	return columns, nil
+}
+
+// onBlock returns whether one of the join keys is a context variable of a single block,
+// that is not replaced by a save column of a source.
+func (d DerivedSchema) onBlock() bool {
+	for _, key := range d.On {
+		if blockKeys[key] && !d.sourceColumns[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// joinRow is a buffered result of one of the sources.
+type joinRow struct {
+	values    map[string]cty.Value
+	block     uint64
+	timestamp int64
+}
+
+// Joiner joins the results of the sources of a derived query. Every combination of
+// matching results is emitted once, when the last of its results arrives.
+type Joiner struct {
+	schema *DerivedSchema
+
+	// evictOnWatermark removes results that are older than the window from the
+	// watermark (the highest timestamp seen). Otherwise, all results are kept.
+	evictOnWatermark bool
+	watermark        int64
+
+	// evictOnBlock removes the results of the blocks every source has passed, which can't
+	// be joined anymore. blocks holds the last block of every source.
+	evictOnBlock bool
+	blocks       map[string]uint64
+	lowBlock     uint64
+
+	// rows holds the buffered results per source and join key.
+	rows map[string]map[string][]joinRow
+
+	// Late counts the results that arrived after their window had passed. They are dropped.
+	Late int64
+}
+
+// NewJoiner returns a joiner for the derived query. In realtime mode, results are only
+// joined within the window, otherwise all results are joined. ordered is true if the
+// results of every source are in chain order.
+func NewJoiner(d *DerivedSchema, realtime, ordered bool) (*Joiner, error) {
+	if realtime && d.Window == 0 {
+		return nil, fmt.Errorf("no window defined for realtime derived query %s", d.Name)
+	}
+
+	rows := make(map[string]map[string][]joinRow, len(d.Sources))
+	for _, source := range d.Sources {
+		rows[source] = make(map[string][]joinRow)
+	}
+
+	return &Joiner{
+		schema:           d,
+		evictOnWatermark: realtime,
+		evictOnBlock:     !realtime && ordered && d.joinsOnBlock,
+		blocks:           make(map[string]uint64, len(d.Sources)),
+		rows:             rows,
+	}, nil
+}
+
+// Name returns the name of the derived query.
+func (j *Joiner) Name() string {
+	return j.schema.Name
+}
+
+// Sources returns the names of the joined queries.
+func (j *Joiner) Sources() []string {
+	return j.schema.Sources
+}
+
+// Add adds the save result of a source query, and returns the save results of
+// the derived query for all new matches. Every source is available as an object variable
+// with its save columns and context variables, and the join keys as variables themselves.
+func (j *Joiner) Add(source string, res types.CallResult, save map[string]cty.Value) ([]map[string]cty.Value, error) {
+	sourceRows, ok := j.rows[source]
+	if !ok {
+		return nil, fmt.Errorf("%s is not a source of derived query %s", source, j.schema.Name)
+	}
+
+	values := GenerateContextVars(res)
+	for k, v := range save {
+		values[k] = v
+	}
+
+	ts := int64(res.Timestamp)
+	if j.evictOnWatermark {
+		if ts+j.schema.Window < j.watermark {
+			j.Late++
+			return nil, nil
+		}
+
+		if ts > j.watermark {
+			j.watermark = ts
+			j.evict(func(r joinRow) bool { return r.timestamp+j.schema.Window >= j.watermark })
+		}
+	}
+
+	if j.evictOnBlock {
+		j.passBlock(source, res.BlockNumber)
+	}
+
+	keyValues := make(map[string]cty.Value, len(j.schema.On))
+	for _, name := range j.schema.On {
+		v, ok := values[name]
+		if !ok {
+			return nil, newEvalError(res, fmt.Errorf("join key %s not found in query %s", name, source))
+		}
+
+		keyValues[name] = v
+	}
+
+	key, err := joinKey(keyValues)
+	if err != nil {
+		return nil, err
+	}
+
+	row := joinRow{values: values, block: res.BlockNumber, timestamp: ts}
+	sourceRows[key] = append(sourceRows[key], row)
+
+	// Build every combination of the new row with the matching rows of the other sources
+	combinations := []map[string]cty.Value{{source: cty.ObjectVal(values)}}
+	for _, other := range j.schema.Sources {
+		if other == source {
+			continue
+		}
+
+		matches := j.rows[other][key]
+		if len(matches) == 0 {
+			return nil, nil
+		}
+
+		var next []map[string]cty.Value
+		for _, c := range combinations {
+			for _, m := range matches {
+				combination := make(map[string]cty.Value, len(c)+1)
+				for k, v := range c {
+					combination[k] = v
+				}
+
+				combination[other] = cty.ObjectVal(m.values)
+				next = append(next, combination)
+			}
+		}
+
+		combinations = next
+	}
+
+	var results []map[string]cty.Value
+	for _, c := range combinations {
+		for k, v := range keyValues {
+			c[k] = v
+		}
+
+		out, err := j.eval(c)
+		if err != nil {
+			return nil, newEvalError(res, err)
+		}
+
+		if out != nil {
+			results = append(results, out)
+		}
+	}
+
+	return results, nil
+}
+
+// eval evaluates the filter and save block of the derived query with the variables of a match.
+func (j *Joiner) eval(vars map[string]cty.Value) (map[string]cty.Value, error) {
+	ctx := j.schema.EvalContext.NewChild()
+	ctx.Variables = vars
+
+	ok, err := evalFilter(j.schema.Filters, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, nil
+	}
+
+	outputs := make(map[string]cty.Value)
+	diags := gohcl.DecodeBody(j.schema.Saves.Options, ctx, &outputs)
+	if diags.HasErrors() {
+		return nil, diagError(diags)
+	}
+
+	j.schema.Saves.unwrap(outputs)
+
+	return outputs, nil
+}
+
+// passBlock records that the source is at block, and evicts the rows below the lowest
+// block of all sources once it increases.
+func (j *Joiner) passBlock(source string, block uint64) {
+	j.blocks[source] = block
+	if len(j.blocks) < len(j.schema.Sources) {
+		return
+	}
+
+	low := block
+	for _, b := range j.blocks {
+		if b < low {
+			low = b
+		}
+	}
+
+	if low > j.lowBlock {
+		j.lowBlock = low
+		j.evict(func(r joinRow) bool { return r.block >= low })
+	}
+}
+
+// evict removes the rows that shouldn't be kept.
+func (j *Joiner) evict(keep func(joinRow) bool) {
+	for _, keys := range j.rows {
+		for key, rows := range keys {
+			kept := rows[:0]
+			for _, r := range rows {
+				if keep(r) {
+					kept = append(kept, r)
+				}
+			}
+
+			if len(kept) == 0 {
+				delete(keys, key)
+			} else {
+				keys[key] = kept
+			}
+		}
+	}
+}
+
+func joinKey(keyValues map[string]cty.Value) (string, error) {
+	v := cty.ObjectVal(keyValues)
+	key, err := ctyjson.Marshal(v, v.Type())
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
@@ -0,0 +1,215 @@
+package dsl
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const joinSchema = `
+query swaps {
+  chain = "ethereum"
+
+  save {
+    size = 1
+  }
+}
+
+query prices {
+  chain = "ethereum"
+
+  save {
+    price = 1
+  }
+}
+
+derived priced_swaps {
+  sources = ["swaps", "prices"]
+  on = ["blocknumber"]
+  window = 60
+
+  filter = [
+    swaps.size > 0
+  ]
+
+  save {
+    block = blocknumber
+    value = swaps.size * prices.price
+  }
+}
+`
+
+func newTestJoiner(t *testing.T, realtime, ordered bool) *Joiner {
+	s, err := NewSchema(writeSchema(t, joinSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJoiner(s.DerivedSchemas[0], realtime, ordered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return j
+}
+
+func addRow(t *testing.T, j *Joiner, source string, block, ts uint64, column string, value int64) []map[string]cty.Value {
+	rows, err := j.Add(source, types.CallResult{BlockNumber: block, Timestamp: ts}, map[string]cty.Value{column: cty.NumberIntVal(value)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rows
+}
+
+func TestJoin(t *testing.T) {
+	j := newTestJoiner(t, false, false)
+
+	if rows := addRow(t, j, "swaps", 1, 100, "size", 2); len(rows) != 0 {
+		t.Fatal("expected no match without a price")
+	}
+
+	// Filtered out by the derived query filter
+	addRow(t, j, "swaps", 1, 100, "size", 0)
+	addRow(t, j, "prices", 2, 112, "price", 5)
+
+	rows := addRow(t, j, "prices", 1, 100, "price", 3)
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(rows))
+	}
+
+	value, _ := rows[0]["value"].AsBigFloat().Int64()
+	block, _ := rows[0]["block"].AsBigFloat().Int64()
+	if value != 6 || block != 1 {
+		t.Fatalf("expected value 6 at block 1, got %d at block %d", value, block)
+	}
+
+	if rows := addRow(t, j, "swaps", 2, 112, "size", 4); len(rows) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(rows))
+	}
+}
+
+func TestJoinWindow(t *testing.T) {
+	j := newTestJoiner(t, true, false)
+
+	addRow(t, j, "swaps", 1, 100, "size", 2)
+	addRow(t, j, "swaps", 10, 200, "size", 2)
+
+	// The swap at block 1 was evicted, so this one is late
+	if rows := addRow(t, j, "prices", 1, 100, "price", 3); len(rows) != 0 {
+		t.Fatal("expected no match outside of the window")
+	}
+
+	if j.Late != 1 {
+		t.Fatalf("expected 1 late result, got %d", j.Late)
+	}
+
+	if rows := addRow(t, j, "prices", 10, 200, "price", 3); len(rows) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(rows))
+	}
+}
+
+func TestJoinEvictBlocks(t *testing.T) {
+	j := newTestJoiner(t, false, true)
+
+	addRow(t, j, "swaps", 1, 100, "size", 2)
+	addRow(t, j, "swaps", 2, 112, "size", 2)
+	addRow(t, j, "swaps", 3, 124, "size", 2)
+
+	// Nothing is evicted until every source has a result
+	if len(j.rows["swaps"]) != 3 {
+		t.Fatalf("expected 3 blocks of swaps, got %d", len(j.rows["swaps"]))
+	}
+
+	// Both sources passed block 1
+	if rows := addRow(t, j, "prices", 2, 112, "price", 3); len(rows) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(rows))
+	}
+
+	if len(j.rows["swaps"]) != 2 || len(j.rows["prices"]) != 1 {
+		t.Fatalf("expected the swap at block 1 to be evicted, got %d swaps", len(j.rows["swaps"]))
+	}
+
+	if rows := addRow(t, j, "prices", 3, 124, "price", 3); len(rows) != 1 {
+		t.Fatalf("expected 1 match, got %d", len(rows))
+	}
+
+	if len(j.rows["swaps"]) != 1 || len(j.rows["prices"]) != 1 {
+		t.Fatal("expected only the rows of block 3")
+	}
+
+	// Rows are kept if the results aren't ordered
+	j = newTestJoiner(t, false, false)
+	addRow(t, j, "swaps", 1, 100, "size", 2)
+	addRow(t, j, "prices", 2, 112, "price", 3)
+
+	if len(j.rows["swaps"]) != 1 {
+		t.Fatal("expected the swap to be kept")
+	}
+}
+
+func TestDerivedOnBlock(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+  save {
+    pool = "a"
+  }
+}
+
+query prices {
+  chain = "ethereum"
+  save {
+    pool = "a"
+    blocknumber = 1
+  }
+}
+
+derived by_pool {
+  sources = ["swaps", "prices"]
+  on = ["pool"]
+  save {}
+}
+
+derived by_block {
+  sources = ["swaps", "prices"]
+  on = ["pool", "blocknumber"]
+  save {}
+}
+
+derived by_tx {
+  sources = ["swaps", "prices"]
+  on = ["tx_hash"]
+  save {}
+}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocknumber of prices is a save column, which can be any block
+	for i, want := range []bool{false, false, true} {
+		if d := s.DerivedSchemas[i]; d.joinsOnBlock != want {
+			t.Fatalf("derived query %s: expected joinsOnBlock %v", d.Name, want)
+		}
+	}
+}
+
+func TestDerivedValidation(t *testing.T) {
+	_, err := NewSchema(writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+  save {}
+}
+
+derived broken {
+  sources = ["swaps", "unknown"]
+  on = ["blocknumber"]
+  save {}
+}
+`))
+	if err == nil {
+		t.Fatal("expected an error for an unknown source")
+	}
+}
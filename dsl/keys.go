@@ -0,0 +1,187 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var ErrNoDefaultKeys = errors.New("query has no default keys, define a primary_key to upsert")
+
+var (
+	// eventKeys identify the log that produced a result.
+	eventKeys = []string{"chain", "tx_hash", "log_index"}
+	// snapshotKeys identify the method results of a contract at a block, which
+	// are merged into one result.
+	snapshotKeys = []string{"chain", "blocknumber", "contract_address"}
+)
+
+// parseKeys parses a primary_key list of column names, like `[chain, tx_hash, log_index]`.
+// The names can be quoted too. It returns nil if the attribute is not defined.
+func parseKeys(expr hcl.Expression) ([]string, error) {
+	if expr == nil {
+		return nil, nil
+	}
+
+	if v, diags := expr.Value(nil); !diags.HasErrors() && v.IsNull() {
+		return nil, nil
+	}
+
+	items, diags := hcl.ExprList(expr)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("primary_key: %w", diagError(diags))
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("primary_key: expected at least 1 column")
+	}
+
+	keys := make([]string, 0, len(items))
+	seen := make(map[string]bool, len(items))
+	for _, item := range items {
+		key := hcl.ExprAsKeyword(item)
+		if key == "" {
+			v, diags := item.Value(nil)
+			if diags.HasErrors() || v.Type() != cty.String || v.IsNull() {
+				return nil, errors.New("primary_key: expected a list of column names")
+			}
+
+			key = v.AsString()
+		}
+
+		if seen[key] {
+			return nil, fmt.Errorf("primary_key: column %s is listed more than once", key)
+		}
+		seen[key] = true
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Keys returns the columns that identify a result of the query, which the outputs use to
+// upsert or deduplicate it. These are the columns of the primary_key, or the default keys
+// in upsert mode:
+//   - chain, tx_hash and log_index for events;
+//   - chain, blocknumber and contract_address for method snapshots;
+//   - the group_by keys and window_start for aggregates.
+//
+// It returns nil if the query doesn't upsert.
+func (q QuerySchema) Keys() ([]string, error) {
+	keys, err := parseKeys(q.PrimaryKey)
+	if err != nil || keys != nil {
+		return keys, err
+	}
+
+	if q.TableMode() != types.TableUpsert {
+		return nil, nil
+	}
+
+	hasEvents := q.HasContractEvents() || q.HasGlobalEvents()
+
+	switch {
+	case q.Aggregate != nil:
+		keys = q.Aggregate.groupByColumns()
+		if q.Aggregate.Window > 0 {
+			keys = append(keys, "window_start")
+		}
+	case hasEvents && q.HasContractMethods():
+		// Method snapshots and events have different keys
+		return nil, ErrNoDefaultKeys
+	case hasEvents:
+		keys = eventKeys
+	case q.HasContractMethods():
+		keys = snapshotKeys
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoDefaultKeys
+	}
+
+	return keys, nil
+}
+
+// validateKeys checks that the keys of an aggregated query are output columns. Other queries
+// can also use context variables as keys, those are checked with the expressions.
+func (q QuerySchema) validateKeys() error {
+	keys, err := q.Keys()
+	if err != nil || q.Aggregate == nil {
+		return err
+	}
+
+	columns, err := q.Columns()
+	if err != nil {
+		return err
+	}
+
+	return keysInColumns(keys, columns)
+}
+
+// Keys returns the columns of the primary_key of the derived query, which has no default keys.
+func (d DerivedSchema) Keys() ([]string, error) {
+	keys, err := parseKeys(d.PrimaryKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if keys == nil && d.TableMode() == types.TableUpsert {
+		return nil, ErrNoDefaultKeys
+	}
+
+	return keys, nil
+}
+
+func keysInColumns(keys, columns []string) error {
+	isColumn := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		isColumn[c] = true
+	}
+
+	for _, k := range keys {
+		if !isColumn[k] {
+			return fmt.Errorf("primary_key: %s is not an output column", k)
+		}
+	}
+
+	return nil
+}
+
+// addKeyColumns adds the keys that are not saved to the result, with the value of the
+// variable with the same name. A key can then be a context variable, like tx_hash.
+func addKeyColumns(keys []string, ctx *hcl.EvalContext, outputs map[string]cty.Value) error {
+	for _, k := range keys {
+		if _, ok := outputs[k]; ok {
+			continue
+		}
+
+		v, ok := ctx.Variables[k]
+		if !ok {
+			return fmt.Errorf("primary_key: %s is neither saved nor a variable", k)
+		}
+
+		outputs[k] = v
+	}
+
+	return nil
+}
+
+// groupByColumns returns the keys of the group_by object, which become columns.
+func (a AggregateSchema) groupByColumns() []string {
+	var columns []string
+	if obj, ok := a.GroupBy.(*hclsyntax.ObjectConsExpr); ok {
+		for _, item := range obj.Items {
+			key, diags := item.KeyExpr.Value(nil)
+			if !diags.HasErrors() && key.Type() == cty.String {
+				columns = append(columns, key.AsString())
+			}
+		}
+	}
+
+	return columns
+}
@@ -0,0 +1,109 @@
+package dsl
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+func TestKeys(t *testing.T) {
+	expr, diags := hclsyntax.ParseExpression([]byte(`[chain, "tx_hash", log_index]`), "", hcl.InitialPos)
+	if diags.HasErrors() {
+		t.Fatal(diags)
+	}
+
+	// A primary_key makes any query upsert
+	keys, err := QuerySchema{PrimaryKey: expr}.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"chain", "tx_hash", "log_index"}) {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	methods := []*ContractSchema{{Methods: []*MethodSchema{{Name_: "getReserves"}}}}
+	events := []*EventSchema{{Name_: "Transfer"}}
+
+	tests := []struct {
+		name string
+		q    QuerySchema
+		keys []string
+		err  error
+	}{
+		{"append", QuerySchema{EventSchemas: events}, nil, nil},
+		{"events", QuerySchema{TableMode_: "upsert", EventSchemas: events}, eventKeys, nil},
+		{"snapshots", QuerySchema{TableMode_: "upsert", ContractSchemas: methods}, snapshotKeys, nil},
+		{"mixed", QuerySchema{TableMode_: "upsert", ContractSchemas: methods, EventSchemas: events}, nil, ErrNoDefaultKeys},
+		{"aggregate", QuerySchema{TableMode_: "upsert", EventSchemas: events, Aggregate: &AggregateSchema{Window: 60}}, []string{"window_start"}, nil},
+		{"single window", QuerySchema{TableMode_: "upsert", EventSchemas: events, Aggregate: &AggregateSchema{}}, nil, ErrNoDefaultKeys},
+	}
+
+	for _, tt := range tests {
+		keys, err := tt.q.Keys()
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+
+		if !reflect.DeepEqual(keys, tt.keys) {
+			t.Fatalf("%s: expected keys %v, got %v", tt.name, tt.keys, keys)
+		}
+	}
+
+	invalid, _ := hclsyntax.ParseExpression([]byte(`[chain, chain]`), "", hcl.InitialPos)
+	if _, err := (QuerySchema{PrimaryKey: invalid}).Keys(); err == nil {
+		t.Fatal("expected an error for a duplicate key")
+	}
+
+	// Derived queries have no default keys
+	if _, err := (DerivedSchema{TableMode_: "upsert"}).Keys(); !errors.Is(err, ErrNoDefaultKeys) {
+		t.Fatalf("expected ErrNoDefaultKeys, got %v", err)
+	}
+}
+
+func TestKeyColumns(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, `
+query transfers {
+  chain = "ethereum"
+  primary_key = [chain, tx_hash, log_index]
+
+  event Transfer {
+    abi = "erc20.abi.json"
+    outputs = ["value"]
+  }
+
+  save {
+    amount = value
+  }
+}
+`), WithAbiDir("templates/erc20"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{
+		QueryName: "transfers",
+		Type:      types.GlobalEvent,
+		Chain:     types.ETHEREUM,
+		TxHash:    common.HexToHash("0x01"),
+		LogIndex:  7,
+		Outputs:   map[string]any{"value": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys that aren't saved are added from the context variables
+	if save["chain"].AsString() != "ethereum" || save["tx_hash"].AsString() != common.HexToHash("0x01").String() {
+		t.Fatalf("unexpected keys %v", save)
+	}
+
+	if got := save["log_index"].AsBigFloat().Text('f', 0); got != "7" {
+		t.Fatalf("expected log_index 7, got %s", got)
+	}
+}
@@ -0,0 +1,151 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/zclconf/go-cty/cty"
+)
+
+var (
+	ErrNoLoopItems       = errors.New("loop needs either items or for_each")
+	ErrLoopItemsConflict = errors.New("loop can't have both items and for_each")
+)
+
+// defaultIterator is the name of the loop variable if no iterator is defined.
+const defaultIterator = "item"
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9_]+`)
+
+// LoopSchema defines a DSL loop block. It contains the items,
+// and for every item the queries and nested loops are generated.
+type LoopSchema struct {
+	// Items is a list of values. The iterator is the item itself.
+	Items []cty.Value `hcl:"items,optional"`
+	// ForEach is a map or a list. The iterator is an object with
+	// a key (or index) and a value.
+	ForEach cty.Value `hcl:"for_each,optional"`
+	// Iterator is the name of the loop variable. It defaults to "item",
+	// and should be set for nested loops.
+	Iterator string `hcl:"iterator,optional"`
+
+	// QuerySchema contains the queries and nested loops. It's decoded
+	// once for every iteration, with the iterator in the evaluation context.
+	QuerySchema hcl.Body `hcl:",remain"`
+}
+
+// loopIteration is a single iteration of a loop. The key is used
+// to give every generated query a unique name.
+type loopIteration struct {
+	key   string
+	value cty.Value
+}
+
+func (l LoopSchema) iterations() ([]loopIteration, error) {
+	hasForEach := !l.ForEach.IsNull()
+	if l.Items != nil && hasForEach {
+		return nil, ErrLoopItemsConflict
+	}
+
+	var iterations []loopIteration
+	if l.Items != nil {
+		for i, item := range l.Items {
+			key := fmt.Sprint(i)
+			if item.Type() == cty.String && item.IsKnown() && !item.IsNull() {
+				key = item.AsString()
+			}
+
+			iterations = append(iterations, loopIteration{key: key, value: item})
+		}
+
+		return iterations, nil
+	}
+
+	if !hasForEach {
+		return nil, ErrNoLoopItems
+	}
+
+	ty := l.ForEach.Type()
+	if !ty.IsMapType() && !ty.IsObjectType() && !ty.IsListType() && !ty.IsTupleType() && !ty.IsSetType() {
+		return nil, fmt.Errorf("for_each must be a map or a list, not %s", ty.FriendlyName())
+	}
+
+	it := l.ForEach.ElementIterator()
+	for it.Next() {
+		k, v := it.Element()
+
+		key := fmt.Sprint(len(iterations))
+		if k.Type() == cty.String {
+			key = k.AsString()
+		}
+
+		iterations = append(iterations, loopIteration{
+			key:   key,
+			value: cty.ObjectVal(map[string]cty.Value{"key": k, "value": v}),
+		})
+	}
+
+	return iterations, nil
+}
+
+// expandLoop decodes the body of the loop for every iteration, with the iterator available
+// in a child of ctx. The names of the generated queries get the keys of the iterations
+// as suffix (outer loops first), so that they are unique. Nested loops are expanded recursively.
+// The iterators of the loop and its parents are kept on the queries, so they are available
+// in the transform, filter and save blocks too.
+func expandLoop(loop *LoopSchema, ctx *hcl.EvalContext, suffix string, parentVars map[string]cty.Value) ([]*QuerySchema, error) {
+	iterations, err := loop.iterations()
+	if err != nil {
+		return nil, err
+	}
+
+	iterator := loop.Iterator
+	if iterator == "" {
+		iterator = defaultIterator
+	}
+
+	var queries []*QuerySchema
+	for _, iteration := range iterations {
+		var loopLevel struct {
+			Loops   []*LoopSchema  `hcl:"loop,block"`
+			Queries []*QuerySchema `hcl:"query,block"`
+		}
+
+		loopVars := map[string]cty.Value{iterator: iteration.value}
+		for k, v := range parentVars {
+			if k != iterator {
+				loopVars[k] = v
+			}
+		}
+
+		loopCtx := ctx.NewChild()
+		loopCtx.Variables = map[string]cty.Value{iterator: iteration.value}
+		diags := gohcl.DecodeBody(loop.QuerySchema, loopCtx, &loopLevel)
+		if diags.HasErrors() {
+			return nil, diagError(diags)
+		}
+
+		key := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(iteration.key), "_"), "_")
+		for _, q := range loopLevel.Queries {
+			q.Name = q.Name + suffix + "_" + key
+			q.loopVariables = loopVars
+		}
+
+		queries = append(queries, loopLevel.Queries...)
+
+		for _, nested := range loopLevel.Loops {
+			nestedQueries, err := expandLoop(nested, loopCtx, suffix+"_"+key, loopVars)
+			if err != nil {
+				return nil, err
+			}
+
+			queries = append(queries, nestedQueries...)
+		}
+	}
+
+	return queries, nil
+}
@@ -0,0 +1,118 @@
+package dsl
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+)
+
+func TestNestedLoops(t *testing.T) {
+	dir := writeSchema(t, `
+variables = {
+  chains = {
+    eth = {
+      name = "ethereum"
+      pools = ["0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc", "0x0d4a11d5EEaaC28EC3F61d100daF4d40471f1852"]
+    }
+    arb = {
+      name = "arbitrum"
+      pools = ["0x905dfCD5649217c42684f23958568e533C711Aa3"]
+    }
+  }
+}
+
+loop {
+  items = ["ethereum", "polygon"]
+
+  query blocks {
+    chain = item
+
+    save {
+      block = blocknumber
+    }
+  }
+}
+
+loop {
+  for_each = chains
+  iterator = "chain"
+
+  loop {
+    for_each = chain.value.pools
+    iterator = "pool"
+
+    query swaps {
+      chain = chain.value.name
+      template = "uniswapv2"
+
+      contract {
+        address = pool.value
+        event Swap {}
+      }
+
+      save {
+        pool = pool.value
+      }
+    }
+  }
+}
+`)
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"blocks_ethereum": "ethereum",
+		"blocks_polygon":  "polygon",
+		"swaps_arb_0":     "arbitrum",
+		"swaps_eth_0":     "ethereum",
+		"swaps_eth_1":     "ethereum",
+	}
+
+	if len(s.QuerySchemas) != len(expected) {
+		t.Fatalf("expected %d queries, got %d", len(expected), len(s.QuerySchemas))
+	}
+
+	for _, q := range s.QuerySchemas {
+		chain, ok := expected[q.Name]
+		if !ok {
+			t.Fatalf("unexpected query %s", q.Name)
+		}
+
+		if string(q.Chain) != chain {
+			t.Fatalf("expected chain %s for %s, got %s", chain, q.Name, q.Chain)
+		}
+	}
+
+	// The iterators should be available when evaluating the save block
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{QueryName: "swaps_arb_0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if save["pool"].AsString() != "0x905dfCD5649217c42684f23958568e533C711Aa3" {
+		t.Fatalf("unexpected pool %s", save["pool"].AsString())
+	}
+}
+
+func TestLoopNameCollision(t *testing.T) {
+	dir := writeSchema(t, `
+loop {
+  items = ["ethereum", "ethereum"]
+
+  query blocks {
+    chain = item
+
+    save {
+      block = blocknumber
+    }
+  }
+}
+`)
+
+	if _, err := NewSchema(dir); err == nil {
+		t.Fatal("expected name collision")
+	}
+}
@@ -3,10 +3,9 @@ package dsl
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/big"
 	"os"
-	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/chainbound/apollo/types"
@@ -14,10 +13,12 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/userfunc"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hcldec"
-	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
 	"github.com/zclconf/go-cty/cty/gocty"
 )
 
@@ -44,24 +45,23 @@ type DynamicSchema struct {
 
 	// These queries will be added later.
 	QuerySchemas []*QuerySchema
+	// DerivedSchemas join the results of other queries.
+	DerivedSchemas []*DerivedSchema
 
 	// EvalContext is what defines the functions and variables that are available to the parser
 	// and can thus be used by the schema. They will be different at each step of the execution.
 	EvalContext *hcl.EvalContext
 }
 
-// LoopSchema defines a DSL loop block. It contains the items,
-// and for every item a query is generated.
-type LoopSchema struct {
-	Items       []cty.Value `hcl:"items"`
-	QuerySchema hcl.Body    `hcl:",remain"`
-}
-
 // QuerySchema defines a DSL query block.
 type QuerySchema struct {
 	Name  string      `hcl:"name,label"`
 	Chain types.Chain `hcl:"chain"`
 
+	// Template is the name of an optional template pack, which provides
+	// ABIs, methods, events, transforms, variables and functions.
+	Template string `hcl:"template,optional"`
+
 	// ContractSchemas holds an array of contract schemas
 	ContractSchemas []*ContractSchema `hcl:"contract,block"`
 	// EventSchemas holds an array of event schemas
@@ -72,54 +72,73 @@ type QuerySchema struct {
 	Saves   Save     `hcl:"save,block"`
 	Filters hcl.Body `hcl:"filter,remain"`
 
-	// Every query can have its own block intervals,
-	// since it can run on different chains.
-	StartBlock    int64
-	EndBlock      int64
-	BlockInterval int64
+	// Aggregate is an optional block that aggregates the results
+	// of the save block into time windows.
+	Aggregate *AggregateSchema `hcl:"aggregate,block"`
+
+	// States are accumulators that are kept across the results of the query.
+	States []*StateSchema `hcl:"state,block"`
+
+	// Every query can have its own block range and intervals, since it can
+	// run on different chains. If they're not defined, the top-level settings are used.
+	StartTime     int64 `hcl:"start_time,optional"`
+	EndTime       int64 `hcl:"end_time,optional"`
+	TimeInterval  int64 `hcl:"time_interval,optional"`
+	StartBlock    int64 `hcl:"start_block,optional"`
+	EndBlock      int64 `hcl:"end_block,optional"`
+	BlockInterval int64 `hcl:"block_interval,optional"`
+
+	// TableMode_ determines what the database outputs do with an existing table:
+	// append (the default), replace or upsert.
+	TableMode_ string `hcl:"table_mode,optional"`
+	// PrimaryKey is an optional list of columns that identify a result, like
+	// `[chain, tx_hash, log_index]`. Keys that are not saved are added from the variables.
+	PrimaryKey hcl.Expression `hcl:"primary_key,optional"`
 
 	EvalContext *hcl.EvalContext
-}
 
-// EvalTransforms evaluates the transformation block per contract / top-level method.
-// The identifier is the OutputName of the method or the name of the contract in other
-// cases.
-func (q *QuerySchema) EvalTransforms(tp types.ResultType, identifier string) error {
-	if tp == types.GlobalEvent {
-		for _, event := range q.EventSchemas {
-			if event.Transforms == nil {
-				return nil
-			}
+	// functionContext is the parent of EvalContext. It has the chain functions at the block
+	// of the current result, and its own copy of the user-defined functions, so they can call them.
+	functionContext *hcl.EvalContext
 
-			if event.OutputName() == identifier {
-				mv := make(map[string]cty.Value)
-				diags := gohcl.DecodeBody(event.Transforms.Options, q.EvalContext, &mv)
-				if diags.HasErrors() {
-					return diags.Errs()[0]
-				}
+	// The template will get injected when decoding the schema
+	TemplateSchema *TemplateSchema
 
-				for k, v := range mv {
-					q.EvalContext.Variables[k] = v
-				}
+	// loopVariables contains the iterators of the loops that generated this query
+	loopVariables map[string]cty.Value
+
+	state *queryState
+}
+
+// EvalTransforms evaluates the transformation blocks that apply to the result. These are
+// the transforms of the methods and events that produced it, followed by the transform of
+// the contract (or the global event) it came from. The identifier of the result is the
+// OutputName of a global event or the address of the contract in other cases.
+func (q *QuerySchema) EvalTransforms(res types.CallResult) error {
+	var transforms []*Transform
+	if res.Type == types.GlobalEvent {
+		for _, event := range q.EventSchemas {
+			if event.OutputName() == res.Identifier {
+				transforms = append(transforms, event.transforms()...)
 			}
 		}
 	} else {
 		for _, c := range q.ContractSchemas {
-			if c.Transforms == nil {
-				return nil
+			if c.Address().String() == res.Identifier {
+				transforms = append(transforms, c.transforms(res)...)
 			}
+		}
+	}
 
-			if c.Address().String() == identifier {
-				mv := make(map[string]cty.Value)
-				diags := gohcl.DecodeBody(c.Transforms.Options, q.EvalContext, &mv)
-				if diags.HasErrors() {
-					return diags.Errs()[0]
-				}
+	for _, t := range transforms {
+		mv := make(map[string]cty.Value)
+		diags := gohcl.DecodeBody(t.Options, q.EvalContext, &mv)
+		if diags.HasErrors() {
+			return diagError(diags)
+		}
 
-				for k, v := range mv {
-					q.EvalContext.Variables[k] = v
-				}
-			}
+		for k, v := range mv {
+			q.EvalContext.Variables[k] = v
 		}
 	}
 
@@ -129,28 +148,35 @@ func (q *QuerySchema) EvalTransforms(tp types.ResultType, identifier string) err
 // EvalFilter evaluates the filter list, and if one of the items
 // evaluates to false, it returns false and the evaluation should be stopped.
 func (s *DynamicSchema) EvalFilter(queryName string) (bool, error) {
+	for _, q := range s.QuerySchemas {
+		if q.Name == queryName {
+			return evalFilter(q.Filters, q.EvalContext)
+		}
+	}
+
+	return true, nil
+}
+
+// evalFilter evaluates the filter list in body, if there is one.
+func evalFilter(body hcl.Body, ctx *hcl.EvalContext) (bool, error) {
+	if body == nil {
+		return true, nil
+	}
+
 	filterspec := hcldec.AttrSpec{
 		Name: "filter",
 		Type: cty.List(cty.Bool),
 	}
 
-	var filters []bool
-	for _, q := range s.QuerySchemas {
-		if q.Name == queryName {
-			if q.Filters == nil {
-				return true, nil
-			}
-
-			v, diags := hcldec.Decode(q.Filters, &filterspec, q.EvalContext)
-			if diags.HasErrors() {
-				return false, diags.Errs()[0]
-			}
+	v, diags := hcldec.Decode(body, &filterspec, ctx)
+	if diags.HasErrors() {
+		return false, diagError(diags)
+	}
 
-			err := gocty.FromCtyValue(v, &filters)
-			if err != nil {
-				return false, err
-			}
-		}
+	var filters []bool
+	err := gocty.FromCtyValue(v, &filters)
+	if err != nil {
+		return false, err
 	}
 
 	// Check if all outputs evaluate to true, otherwise return false
@@ -164,17 +190,77 @@ func (s *DynamicSchema) EvalFilter(queryName string) (bool, error) {
 }
 
 type ChainFunctionProvider interface {
-	Balance(types.Chain, common.Address, *big.Int) (float64, error)
-	TokenBalance(types.Chain, common.Address, common.Address, *big.Int) (float64, error)
+	Balance(types.Chain, common.Address, *big.Int) (*big.Float, error)
+	TokenBalance(types.Chain, common.Address, common.Address, *big.Int) (*big.Float, error)
 	// Price(types.Chain, common.Address, common.Address, *big.Int) (float64, error)
 }
 
+// SetChains makes the metadata of the chain of every query available to it, as the
+// `chain_id`, `native_symbol` and `native_decimals` variables.
+func (s *DynamicSchema) SetChains(chains map[types.Chain]types.ChainInfo) {
+	for _, q := range s.QuerySchemas {
+		info, ok := chains[q.Chain]
+		if !ok {
+			continue
+		}
+
+		for k, v := range chainVars(info) {
+			q.EvalContext.Variables[k] = v
+		}
+	}
+}
+
+// setChainFunctions makes the chain functions available to the expressions and the
+// user-defined functions of the query.
+func (q *QuerySchema) setChainFunctions(functions map[string]function.Function) {
+	for k, v := range functions {
+		q.functionContext.Functions[k] = v
+	}
+}
+
+// newFunctionContext returns a child of parent with the user-defined functions of bodies.
+// They're evaluated in this context when they're called, so they can use the functions that
+// are added to it later.
+func newFunctionContext(parent *hcl.EvalContext, bodies []hcl.Body) (*hcl.EvalContext, error) {
+	ctx := parent.NewChild()
+	ctx.Functions = make(map[string]function.Function)
+
+	for _, body := range bodies {
+		funcs, _, diags := userfunc.DecodeUserFunctions(body, "function", func() *hcl.EvalContext {
+			return ctx
+		})
+		if diags.HasErrors() {
+			return nil, diagError(diags)
+		}
+
+		for k, v := range funcs {
+			ctx.Functions[k] = v
+		}
+	}
+
+	return ctx, nil
+}
+
+func chainVars(info types.ChainInfo) map[string]cty.Value {
+	return map[string]cty.Value{
+		"chain_id":        cty.NumberUIntVal(info.ChainID),
+		"native_symbol":   cty.StringVal(info.NativeSymbol),
+		"native_decimals": cty.NumberUIntVal(uint64(info.NativeDecimals)),
+	}
+}
+
 // EvalSave updates the evaluation context, evaluates the transform blocks and then
-// evaluates the save block. The results will be returned as a map.
+// evaluates the save block. The results will be returned as a map, or nil if the result
+// is filtered out or was already handled before the state was restored.
 func (s *DynamicSchema) EvalSave(provider ChainFunctionProvider, res types.CallResult) (map[string]cty.Value, error) {
 	outputs := make(map[string]cty.Value)
 	for _, q := range s.QuerySchemas {
 		if q.Name == res.QueryName {
+			// Results up to the checkpoint of a restored state were handled before the restart
+			if q.applied(res) {
+				return nil, nil
+			}
+
 			if q.EvalContext.Variables == nil {
 				q.EvalContext.Variables = make(map[string]cty.Value)
 			}
@@ -183,17 +269,27 @@ func (s *DynamicSchema) EvalSave(provider ChainFunctionProvider, res types.CallR
 				q.EvalContext.Variables[k] = v
 			}
 
-			for k, v := range BuildChainFunctions(provider, res.Chain, big.NewInt(int64(res.BlockNumber))) {
-				q.EvalContext.Functions[k] = v
+			// The chain functions are at the block of the current result
+			q.setChainFunctions(BuildChainFunctions(provider, res.Chain, big.NewInt(int64(res.BlockNumber))))
+
+			// The transforms see the state before this result, the filter and save after.
+			if q.HasState() {
+				for k, v := range q.state.values {
+					q.EvalContext.Variables[k] = v
+				}
+			}
+
+			if err := q.EvalTransforms(res); err != nil {
+				return nil, newEvalError(res, err)
 			}
 
-			if err := q.EvalTransforms(res.Type, res.Identifier); err != nil {
-				return nil, err
+			if err := q.updateState(); err != nil {
+				return nil, newEvalError(res, err)
 			}
 
 			ok, err := s.EvalFilter(res.QueryName)
 			if err != nil {
-				return nil, err
+				return nil, newEvalError(res, err)
 			}
 
 			if !ok {
@@ -202,7 +298,21 @@ func (s *DynamicSchema) EvalSave(provider ChainFunctionProvider, res types.CallR
 
 			diags := gohcl.DecodeBody(q.Saves.Options, q.EvalContext, &outputs)
 			if diags.HasErrors() {
-				return nil, diags.Errs()[0]
+				return nil, newEvalError(res, diagError(diags))
+			}
+
+			q.Saves.unwrap(outputs)
+
+			// The keys of aggregates are the columns of the windows
+			if q.Aggregate == nil {
+				keys, err := q.Keys()
+				if err != nil {
+					return nil, newEvalError(res, err)
+				}
+
+				if err := addKeyColumns(keys, q.EvalContext, outputs); err != nil {
+					return nil, newEvalError(res, err)
+				}
 			}
 		}
 	}
@@ -210,37 +320,53 @@ func (s *DynamicSchema) EvalSave(provider ChainFunctionProvider, res types.CallR
 	return outputs, nil
 }
 
+// Validate validates the block ranges and intervals of every query.
 func (s DynamicSchema) Validate(opts types.ApolloOpts) error {
-	hasMethods := false
-	hasEvents := false
 	for _, q := range s.QuerySchemas {
-		for _, c := range q.ContractSchemas {
-			hasMethods = len(c.Methods) > 0
-			hasEvents = len(c.Events) > 0
+		if err := q.Validate(&s, opts); err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
 		}
 	}
 
-	if hasMethods {
+	return nil
+}
+
+// Validate checks if the query has the intervals it needs, after applying
+// the defaults from the top-level schema. Events can't have an interval in historical mode,
+// so that is only checked on the settings of the query itself.
+func (q QuerySchema) Validate(s *DynamicSchema, opts types.ApolloOpts) error {
+	if _, err := types.ParseTableMode(q.TableMode_); err != nil {
+		return err
+	}
+
+	if err := q.validateKeys(); err != nil {
+		return err
+	}
+
+	resolved := q
+	resolved.ApplyDefaults(s)
+
+	if q.HasContractMethods() {
 		if opts.Realtime {
-			if s.BlockInterval == 0 && s.TimeInterval == 0 {
+			if resolved.BlockInterval == 0 && resolved.TimeInterval == 0 {
 				return ErrNoIntervalRealtime
 			}
 		}
 
-		if (s.StartBlock != 0 && s.EndBlock != 0) || (s.StartTime != 0 && s.EndTime != 0) {
-			if s.BlockInterval == 0 && s.TimeInterval == 0 {
+		if (resolved.StartBlock != 0 && resolved.EndBlock != 0) || (resolved.StartTime != 0 && resolved.EndTime != 0) {
+			if resolved.BlockInterval == 0 && resolved.TimeInterval == 0 {
 				return ErrNoIntervalHistorical
 			}
 		}
 	}
 
-	if hasEvents {
+	if q.HasContractEvents() || q.HasGlobalEvents() {
 		if !opts.Realtime {
-			if s.BlockInterval != 0 {
+			if q.BlockInterval != 0 {
 				return ErrIntervalDefinedForHistoricalEvents
 			}
 
-			if s.TimeInterval != 0 {
+			if q.TimeInterval != 0 {
 				return ErrIntervalDefinedForHistoricalEvents
 			}
 		}
@@ -249,6 +375,29 @@ func (s DynamicSchema) Validate(opts types.ApolloOpts) error {
 	return nil
 }
 
+// ApplyDefaults fills in the start, end and interval of the query with the top-level
+// settings of the schema, if the query doesn't define them itself. A query that defines
+// a start block doesn't inherit the start time, and the other way around.
+func (q *QuerySchema) ApplyDefaults(s *DynamicSchema) {
+	if q.StartBlock == 0 && q.StartTime == 0 {
+		q.StartBlock, q.StartTime = s.StartBlock, s.StartTime
+	}
+
+	if q.EndBlock == 0 && q.EndTime == 0 {
+		q.EndBlock, q.EndTime = s.EndBlock, s.EndTime
+	}
+
+	if q.BlockInterval == 0 && q.TimeInterval == 0 {
+		q.BlockInterval, q.TimeInterval = s.BlockInterval, s.TimeInterval
+	}
+}
+
+// TableMode returns the table mode of the query, append if it's not defined.
+func (q QuerySchema) TableMode() types.TableMode {
+	mode, _ := types.ParseTableMode(q.TableMode_)
+	return mode
+}
+
 func (q QuerySchema) HasGlobalEvents() bool {
 	return len(q.EventSchemas) > 0
 }
@@ -275,7 +424,7 @@ func (q QuerySchema) HasContractMethods() (hasContractMethods bool) {
 
 type ContractSchema struct {
 	Address_ string `hcl:"address"`
-	AbiPath  string `hcl:"abi"`
+	AbiPath  string `hcl:"abi,optional"`
 
 	// ContractSchema can hold both methods
 	// and events
@@ -295,6 +444,30 @@ func (c ContractSchema) Address() common.Address {
 	return common.HexToAddress(c.Address_)
 }
 
+// transforms returns the transforms that apply to a result of this contract.
+func (c ContractSchema) transforms(res types.CallResult) []*Transform {
+	var transforms []*Transform
+	if res.Type == types.Method {
+		for _, m := range c.Methods {
+			if m.Transforms != nil {
+				transforms = append(transforms, m.Transforms)
+			}
+		}
+	} else {
+		for _, e := range c.Events {
+			if e.Name() == res.EventName {
+				transforms = append(transforms, e.transforms()...)
+			}
+		}
+	}
+
+	if c.Transforms != nil {
+		transforms = append(transforms, c.Transforms)
+	}
+
+	return transforms
+}
+
 type MethodSchema struct {
 	// BlockOffset is the block offset at which to call the method.
 	// Only used when this method is a method that's supposed to be called
@@ -306,8 +479,12 @@ type MethodSchema struct {
 	// have to be the same as in the ABI.
 	Inputs_ map[string]string `hcl:"inputs,optional"`
 	// The method outputs we want to save. Any named outputs should be the same
-	// as in the ABI.
-	Outputs []string `hcl:"outputs"`
+	// as in the ABI. They can only be omitted if the query template provides them.
+	Outputs []string `hcl:"outputs,optional"`
+
+	// Transforms is an optional transform block that is evaluated for every
+	// result of this method, before the contract transform.
+	Transforms *Transform `hcl:"transform,block"`
 }
 
 func (m MethodSchema) Name() string {
@@ -323,8 +500,9 @@ type EventSchema struct {
 	AbiPath string `hcl:"abi,optional"`
 
 	// The event outputs we want to save. They
-	// have to be the same as in the ABI.
-	Outputs_ []string `hcl:"outputs"`
+	// have to be the same as in the ABI. They can only be
+	// omitted if the query template provides them.
+	Outputs_ []string `hcl:"outputs,optional"`
 	// Any optional methods we want to call at the event.
 	Methods []*MethodSchema `hcl:"method,block"`
 
@@ -349,6 +527,23 @@ func (e EventSchema) OutputName() string {
 	return e.Name_ + "_events"
 }
 
+// transforms returns the transforms of the methods called at this event,
+// followed by the transform of the event itself.
+func (e EventSchema) transforms() []*Transform {
+	var transforms []*Transform
+	for _, m := range e.Methods {
+		if m.Transforms != nil {
+			transforms = append(transforms, m.Transforms)
+		}
+	}
+
+	if e.Transforms != nil {
+		transforms = append(transforms, e.Transforms)
+	}
+
+	return transforms
+}
+
 type Transform struct {
 	// These should be decoded in a later step with different evaluation contexts,
 	// because they should provide access to things like inputs, outputs,
@@ -366,28 +561,57 @@ type Save struct {
 // InitialContext returns the initial context at the start of evaluation.
 // It has nothing but the most basic functions and variables.
 func InitialContext() hcl.EvalContext {
+	// Copy the functions, because they will be extended with
+	// user-defined and chain functions later.
+	functions := make(map[string]function.Function, len(Functions))
+	for k, v := range Functions {
+		functions[k] = v
+	}
+
 	return hcl.EvalContext(hcl.EvalContext{
-		Functions: Functions,
+		Functions: functions,
 		Variables: map[string]cty.Value{
 			"now": cty.NumberIntVal(time.Now().UnixMilli() / 1000),
 		},
 	})
 }
 
-// NewSchema returns a new DynamicSchema, loaded from confDir/schema.hcl.
-// It will decode the top-level body with an initial evaluation context
-// to provide access to custom functions. For each contract, it will also
-// read and convert the json ABI file to an abi.ABI.
-func NewSchema(confDir string) (*DynamicSchema, error) {
-	schemaPath := path.Join(confDir, "schema.hcl")
-	f, err := ioutil.ReadFile(schemaPath)
+// SchemaOption configures how a schema is loaded.
+type SchemaOption func(*schemaOptions)
+
+type schemaOptions struct {
+	abiDir string
+}
+
+// WithAbiDir resolves relative ABI paths in dir, instead of in the directory of the schema.
+func WithAbiDir(dir string) SchemaOption {
+	return func(o *schemaOptions) {
+		o.abiDir = dir
+	}
+}
+
+// NewSchema returns a new DynamicSchema, loaded from schemaPath. This is either a single
+// file, or a directory in which case every *.hcl file in it is loaded. Files can include
+// other files with the `include` directive. For every file, it will decode the user-defined
+// functions first, and then the top-level body with an initial evaluation context
+// to provide access to custom functions. The variables and queries of all files are merged.
+// For each contract, it will also read and convert the json ABI file to an abi.ABI, relative to
+// the schema or the ABI directory.
+func NewSchema(schemaPath string, opts ...SchemaOption) (*DynamicSchema, error) {
+	files, baseDir, err := loadSchemaFiles(hclparse.NewParser(), schemaPath)
 	if err != nil {
 		return nil, err
 	}
 
-	file, diags := hclsyntax.ParseConfig(f, schemaPath, hcl.InitialPos)
-	if diags.HasErrors() {
-		return nil, diags.Errs()[0]
+	var options schemaOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	// ABIs are relative to the schema, unless another directory is configured
+	abiDir := baseDir
+	if options.abiDir != "" {
+		abiDir = options.abiDir
 	}
 
 	// Set up the inital context (access to upper, lower, etc)
@@ -396,10 +620,49 @@ func NewSchema(confDir string) (*DynamicSchema, error) {
 		EvalContext: &schemaContext,
 	}
 
-	// Decode ONLY the variables, that's the first thing we need
-	diags = gohcl.DecodeBody(file.Body, &schemaContext, s)
-	if diags.HasErrors() {
-		return nil, diags.Errs()[0]
+	// defined keeps track of the file in which settings, variables, functions and queries
+	// are defined, to report name collisions.
+	defined := make(map[string]string)
+	var bodies, functionBodies []hcl.Body
+
+	for _, file := range files {
+		// User-defined functions are evaluated in the top-level context when they are called,
+		// so they have access to the variables. Queries get their own copy, which can call
+		// the chain functions too.
+		userFuncs, body, diags := userfunc.DecodeUserFunctions(file.Body, "function", func() *hcl.EvalContext {
+			return s.EvalContext
+		})
+		if diags.HasErrors() {
+			return nil, diagError(diags)
+		}
+
+		for k, v := range userFuncs {
+			if _, ok := s.EvalContext.Functions[k]; ok {
+				if f, ok := defined["function "+k]; ok {
+					return nil, fmt.Errorf("function %s is defined in both %s and %s", k, f, file.Name)
+				}
+
+				return nil, fmt.Errorf("function %s is already defined", k)
+			}
+
+			defined["function "+k] = file.Name
+			s.EvalContext.Functions[k] = v
+		}
+
+		functionBodies = append(functionBodies, file.Body)
+
+		// Decode ONLY the variables, that's the first thing we need
+		var fileSchema DynamicSchema
+		diags = gohcl.DecodeBody(body, &schemaContext, &fileSchema)
+		if diags.HasErrors() {
+			return nil, diagError(diags)
+		}
+
+		if err := s.merge(&fileSchema, file.Name, defined); err != nil {
+			return nil, err
+		}
+
+		bodies = append(bodies, fileSchema.SchemaConfig)
 	}
 
 	// Add the variables into the evaluation context
@@ -407,77 +670,196 @@ func NewSchema(confDir string) (*DynamicSchema, error) {
 		s.EvalContext.Variables[k] = v
 	}
 
-	// This is the next step we need to decode. It's either a Loop or Queries.
-	var topLevel struct {
-		Loop    *LoopSchema    `hcl:"loop,block"`
-		Queries []*QuerySchema `hcl:"query,block"`
+	for i, body := range bodies {
+		if err := s.decodeQueries(body, files[i].Name, defined); err != nil {
+			return nil, err
+		}
 	}
 
-	// We decode into the topLevel struct with the variables available.
-	diags = gohcl.DecodeBody(s.SchemaConfig, s.EvalContext, &topLevel)
-	if diags.HasErrors() {
-		return nil, diags.Errs()[0]
-	}
+	// For every query, add the evaluation context (we need it later),
+	// then parse and load the needed ABIs. Every query gets its own child
+	// context, so that the results of one query don't leak into another.
+	for _, query := range s.QuerySchemas {
+		query.functionContext, err = newFunctionContext(s.EvalContext, functionBodies)
+		if err != nil {
+			return nil, fmt.Errorf("query %s: %w", query.Name, err)
+		}
 
-	// If there are top-level queries, immediately save them
-	s.QuerySchemas = append(s.QuerySchemas, topLevel.Queries...)
+		query.EvalContext = query.functionContext.NewChild()
+		query.EvalContext.Variables = make(map[string]cty.Value)
+		query.EvalContext.Functions = make(map[string]function.Function)
 
-	// If there are loops, loop over the queries, decode them using
-	// the loop variables in the evaluation context, and save the queries
-	if topLevel.Loop != nil {
-		for _, item := range topLevel.Loop.Items {
-			var loopLevel struct {
-				Queries []*QuerySchema `hcl:"query,block"`
-			}
+		for k, v := range query.loopVariables {
+			query.EvalContext.Variables[k] = v
+		}
 
-			newCtx := InitialContext()
-			newCtx.Variables = map[string]cty.Value{"item": item}
-			diags = gohcl.DecodeBody(topLevel.Loop.QuerySchema, &newCtx, &loopLevel)
-			if diags.HasErrors() {
-				return nil, diags.Errs()[0]
+		if query.Template != "" {
+			query.TemplateSchema, err = LoadTemplate(baseDir, query.Template)
+			if err != nil {
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
 			}
 
-			s.QuerySchemas = append(s.QuerySchemas, loopLevel.Queries...)
+			if err := query.TemplateSchema.Apply(query); err != nil {
+				return nil, fmt.Errorf("query %s: applying template %s: %w", query.Name, query.Template, err)
+			}
 		}
-	}
-
-	// For every query, add the evaluation context (we need it later),
-	// then parse and load the needed ABIs.
-	for _, query := range s.QuerySchemas {
-		query.EvalContext = s.EvalContext
 
 		for _, event := range query.EventSchemas {
-			f, err := os.Open(path.Join(confDir, event.AbiPath))
-			if err != nil {
-				return nil, fmt.Errorf("ParseV2: reading ABI file: %w", err)
+			if event.AbiPath == "" {
+				// The ABI was provided by the template
+				if query.TemplateSchema != nil {
+					continue
+				}
+
+				return nil, fmt.Errorf("query %s: no ABI defined for event %s", query.Name, event.Name())
 			}
 
-			abi, err := abi.JSON(f)
+			event.Abi, err = loadAbi(abiDir, event.AbiPath)
 			if err != nil {
-				return nil, fmt.Errorf("ParseV2: parsing ABI")
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
 			}
-
-			event.Abi = abi
 		}
 
 		for _, contract := range query.ContractSchemas {
-			f, err := os.Open(path.Join(confDir, contract.AbiPath))
-			if err != nil {
-				return nil, fmt.Errorf("ParseV2: reading ABI file: %w", err)
+			if contract.AbiPath == "" {
+				// The ABI was provided by the template
+				if query.TemplateSchema != nil {
+					continue
+				}
+
+				return nil, fmt.Errorf("query %s: no ABI defined for contract %s", query.Name, contract.Address_)
 			}
 
-			abi, err := abi.JSON(f)
+			contract.Abi, err = loadAbi(abiDir, contract.AbiPath)
 			if err != nil {
-				return nil, fmt.Errorf("ParseV2: parsing ABI")
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
 			}
+		}
 
-			contract.Abi = abi
+		if err := query.checkOutputs(); err != nil {
+			return nil, err
 		}
+
+		if query.Aggregate != nil {
+			if _, err := query.Aggregate.columns(); err != nil {
+				return nil, fmt.Errorf("query %s: %w", query.Name, err)
+			}
+		}
+
+		if err := query.initState(); err != nil {
+			return nil, fmt.Errorf("query %s: %w", query.Name, err)
+		}
+	}
+
+	for _, derived := range s.DerivedSchemas {
+		if err := derived.validate(s.QuerySchemas); err != nil {
+			return nil, fmt.Errorf("derived query %s: %w", derived.Name, err)
+		}
+
+		if derived.sourceColumns, err = derived.saveColumns(s.QuerySchemas); err != nil {
+			return nil, fmt.Errorf("derived query %s: %w", derived.Name, err)
+		}
+
+		derived.joinsOnBlock = derived.onBlock()
+		derived.EvalContext = s.EvalContext.NewChild()
 	}
 
 	return s, nil
 }
 
+// decodeQueries decodes the queries and loops in the body of a schema file, with the
+// variables and functions available. Query names have to be unique.
+func (s *DynamicSchema) decodeQueries(body hcl.Body, filename string, defined map[string]string) error {
+	// This is the next step we need to decode: loops and queries.
+	var topLevel struct {
+		Loops   []*LoopSchema    `hcl:"loop,block"`
+		Queries []*QuerySchema   `hcl:"query,block"`
+		Derived []*DerivedSchema `hcl:"derived,block"`
+	}
+
+	// We decode into the topLevel struct with the variables available.
+	diags := gohcl.DecodeBody(body, s.EvalContext, &topLevel)
+	if diags.HasErrors() {
+		return diagError(diags)
+	}
+
+	// If there are loops, loop over the queries, decode them using
+	// the loop variables in the evaluation context, and save the queries
+	queries := topLevel.Queries
+	for _, loop := range topLevel.Loops {
+		loopQueries, err := expandLoop(loop, s.EvalContext, "", nil)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+
+		queries = append(queries, loopQueries...)
+	}
+
+	for _, q := range queries {
+		key := "query " + q.Name
+		if f, ok := defined[key]; ok {
+			return fmt.Errorf("query %s is defined in both %s and %s", q.Name, f, filename)
+		}
+
+		defined[key] = filename
+	}
+
+	// Derived queries share the namespace of queries, since both produce outputs
+	for _, d := range topLevel.Derived {
+		key := "query " + d.Name
+		if f, ok := defined[key]; ok {
+			return fmt.Errorf("query %s is defined in both %s and %s", d.Name, f, filename)
+		}
+
+		defined[key] = filename
+	}
+
+	s.QuerySchemas = append(s.QuerySchemas, queries...)
+	s.DerivedSchemas = append(s.DerivedSchemas, topLevel.Derived...)
+
+	return nil
+}
+
+// checkOutputs makes sure every method and event has outputs, since
+// they are optional in the schema when a template is used.
+func (q QuerySchema) checkOutputs() error {
+	checkMethods := func(methods []*MethodSchema) error {
+		for _, m := range methods {
+			if len(m.Outputs) == 0 {
+				return fmt.Errorf("query %s: no outputs defined for method %s", q.Name, m.Name())
+			}
+		}
+
+		return nil
+	}
+
+	checkEvents := func(events []*EventSchema) error {
+		for _, e := range events {
+			if len(e.Outputs()) == 0 {
+				return fmt.Errorf("query %s: no outputs defined for event %s", q.Name, e.Name())
+			}
+
+			if err := checkMethods(e.Methods); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, c := range q.ContractSchemas {
+		if err := checkMethods(c.Methods); err != nil {
+			return err
+		}
+
+		if err := checkEvents(c.Events); err != nil {
+			return err
+		}
+	}
+
+	return checkEvents(q.EventSchemas)
+}
+
 // GenerateContextVars converts a CallResult into a map that can be added
 // as context variables. This function is called after the first step (calling
 // methods or parsing events) to generate variables to be used in the next steps
@@ -495,6 +877,7 @@ func GenerateContextVars(cr types.CallResult) map[string]cty.Value {
 		m["tx_hash"], _ = gocty.ToCtyValue(cr.TxHash.String(), cty.String)
 		m["event_name"], _ = gocty.ToCtyValue(cr.EventName, cty.String)
 		m["tx_index"], _ = gocty.ToCtyValue(cr.TxIndex, cty.Number)
+		m["log_index"], _ = gocty.ToCtyValue(cr.LogIndex, cty.Number)
 	}
 
 	for k, v := range cr.Inputs {
@@ -507,15 +890,28 @@ func GenerateContextVars(cr types.CallResult) map[string]cty.Value {
 	}
 
 	for k, v := range cr.Outputs {
-		switch v := v.(type) {
-		case common.Address:
-			m[k], _ = gocty.ToCtyValue(v.String(), cty.String)
-		case string:
-			m[k], _ = gocty.ToCtyValue(v, cty.String)
-		default:
-			m[k], _ = gocty.ToCtyValue(v, cty.Number)
-		}
+		m[k], _ = toCtyValue(v)
 	}
 
 	return m
 }
+
+// loadAbi reads and parses the ABI at p. Relative paths are resolved in dir.
+func loadAbi(dir, p string) (abi.ABI, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return abi.ABI{}, fmt.Errorf("reading ABI file: %w", err)
+	}
+	defer f.Close()
+
+	contractAbi, err := abi.JSON(f)
+	if err != nil {
+		return abi.ABI{}, fmt.Errorf("parsing ABI %s: %w", p, err)
+	}
+
+	return contractAbi, nil
+}
@@ -2,8 +2,16 @@ package dsl
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"strings"
 	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/common"
 )
 
 func TestNewSchema(t *testing.T) {
@@ -24,3 +32,244 @@ func TestNewSchema(t *testing.T) {
 	}
 	fmt.Printf("%s\n", string(sjson))
 }
+
+func TestAbiDir(t *testing.T) {
+	dir := writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+
+  event Swap {
+    abi = "unipair.abi.json"
+    outputs = ["sender"]
+  }
+
+  save {
+    sender = sender
+  }
+}
+`)
+
+	// The ABI is not next to the schema
+	if _, err := NewSchema(dir); err == nil {
+		t.Fatal("expected ABI not found error")
+	}
+
+	s, err := NewSchema(dir, WithAbiDir("../test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.QuerySchemas[0].EventSchemas[0].Abi.Events["Swap"]; !ok {
+		t.Fatal("expected Swap in ABI")
+	}
+}
+
+type mockProvider struct{}
+
+func (mockProvider) Balance(chain types.Chain, address common.Address, block *big.Int) (*big.Float, error) {
+	return new(big.Float).SetInt(block), nil
+}
+
+func (mockProvider) TokenBalance(chain types.Chain, address, token common.Address, block *big.Int) (*big.Float, error) {
+	return big.NewFloat(2), nil
+}
+
+func writeSchema(t *testing.T, schema string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "schema.hcl"), []byte(schema), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func TestUserFunctions(t *testing.T) {
+	dir := writeSchema(t, `
+variables = {
+  account = "0xe1Dd30fecAb8a63105F2C035B084BfC6Ca5B1493"
+}
+
+function "double_balance" {
+  params = [addr]
+  result = balance(addr) * 2
+}
+
+function "account_value" {
+  params = [price]
+  result = double_balance(account) * price
+}
+
+query balances {
+  chain = "arbitrum"
+
+  save {
+    value = account_value(3)
+  }
+}
+`)
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{QueryName: "balances", BlockNumber: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := save["value"].AsBigFloat().Text('f', -1); got != "600" {
+		t.Fatalf("expected 600, got %s", got)
+	}
+
+	// The chain functions should be evaluated at the block of the result
+	save, err = s.EvalSave(mockProvider{}, types.CallResult{QueryName: "balances", BlockNumber: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := save["value"].AsBigFloat().Text('f', -1); got != "1200" {
+		t.Fatalf("expected 1200, got %s", got)
+	}
+
+	// The chain functions belong to the query, not to the shared top-level context
+	if _, ok := s.EvalContext.Functions["balance"]; ok {
+		t.Fatal("expected no chain functions in the top-level context")
+	}
+}
+
+func TestSetChains(t *testing.T) {
+	dir := writeSchema(t, `
+query balances {
+  chain = "devnet"
+
+  save {
+    chain_id = chain_id
+    value = balance("0xe1Dd30fecAb8a63105F2C035B084BfC6Ca5B1493") / pow(10, native_decimals)
+    symbol = native_symbol
+  }
+}
+`)
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetChains(map[types.Chain]types.ChainInfo{
+		"devnet": {ChainID: 31337, NativeSymbol: "DEV", NativeDecimals: 2},
+	})
+
+	if err := s.Check([]types.Chain{"devnet"}); err != nil {
+		t.Fatal(err)
+	}
+
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{QueryName: "balances", Chain: "devnet", BlockNumber: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := save["chain_id"].AsBigFloat().Text('f', -1); got != "31337" {
+		t.Fatalf("expected chain ID 31337, got %s", got)
+	}
+
+	if got := save["value"].AsBigFloat().Text('f', -1); got != "1" {
+		t.Fatalf("expected 1, got %s", got)
+	}
+
+	if got := save["symbol"].AsString(); got != "DEV" {
+		t.Fatalf("expected DEV, got %s", got)
+	}
+}
+
+func TestQueryRanges(t *testing.T) {
+	dir := writeSchema(t, `
+start_time = format_date("02-01-2006 15:04", "25-05-2022 12:00")
+end_block = 2000
+time_interval = 3600
+
+query balances {
+  chain = "arbitrum"
+  start_block = 1000
+  block_interval = 10
+
+  save {
+    block = blocknumber
+  }
+}
+
+query other_balances {
+  chain = "ethereum"
+
+  save {
+    block = blocknumber
+  }
+}
+`)
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := s.QuerySchemas[0]
+	q.ApplyDefaults(s)
+	if q.StartBlock != 1000 || q.StartTime != 0 || q.EndBlock != 2000 || q.BlockInterval != 10 || q.TimeInterval != 0 {
+		t.Fatalf("unexpected range for %s: %+v", q.Name, q)
+	}
+
+	q = s.QuerySchemas[1]
+	q.ApplyDefaults(s)
+	if q.StartBlock != 0 || q.StartTime != 1653480000 || q.EndBlock != 2000 || q.TimeInterval != 3600 {
+		t.Fatalf("unexpected range for %s: %+v", q.Name, q)
+	}
+}
+
+func TestValidateQueryIntervals(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"schema.hcl": `
+start_block = 1000
+end_block = 2000
+
+query swaps {
+  chain = "ethereum"
+  block_interval = 10
+  template = "uniswapv2"
+
+  contract {
+    address = "0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc"
+    event Swap {}
+  }
+
+  save {
+    block = blocknumber
+  }
+}
+`,
+	})
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Validate(types.ApolloOpts{}); !errors.Is(err, ErrIntervalDefinedForHistoricalEvents) {
+		t.Fatalf("expected %s, got %v", ErrIntervalDefinedForHistoricalEvents, err)
+	}
+}
+
+func TestTableMode(t *testing.T) {
+	q := QuerySchema{TableMode_: "upsert"}
+	if q.TableMode() != types.TableUpsert {
+		t.Fatalf("expected upsert, got %s", q.TableMode())
+	}
+
+	if (QuerySchema{}).TableMode() != types.TableAppend {
+		t.Fatal("expected append by default")
+	}
+
+	q = QuerySchema{TableMode_: "truncate"}
+	if err := q.Validate(&DynamicSchema{}, types.ApolloOpts{}); err == nil || !strings.Contains(err.Error(), "truncate") {
+		t.Fatalf("expected unknown table mode error, got %v", err)
+	}
+}
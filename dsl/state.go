@@ -0,0 +1,228 @@
+package dsl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/chainbound/apollo/types"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// StateSchema defines a DSL state block. It's a named accumulator that is kept
+// across the results of a query, like:
+//
+//	state cumulative_volume {
+//	  initial = 0
+//	  update = cumulative_volume + size
+//	}
+type StateSchema struct {
+	Name string `hcl:"name,label"`
+	// Initial is the value of the accumulator before the first result.
+	Initial hcl.Expression `hcl:"initial"`
+	// Update is evaluated for every result, after the transforms. It has access
+	// to the previous values of all accumulators of the query.
+	Update hcl.Expression `hcl:"update"`
+}
+
+// queryState is the current state of the accumulators of a query.
+type queryState struct {
+	values map[string]cty.Value
+
+	// checkpoint is the last result that updated the state.
+	checkpoint checkpoint
+	// restored is the checkpoint of a persisted state. Results at or before
+	// it have already been applied before the restart.
+	restored *checkpoint
+}
+
+// checkpoint is the position of a result. The method results of a block all have the
+// same position, so Seq counts the results at the position, starting at 1. The results
+// at a position arrive in the same order every run, because stateful queries are ordered.
+type checkpoint struct {
+	types.Position
+	Seq uint64 `json:"seq"`
+}
+
+// next returns the checkpoint of the result at pos that comes after c.
+func (c checkpoint) next(pos types.Position) checkpoint {
+	if c.Seq > 0 && c.Position == pos {
+		return checkpoint{Position: pos, Seq: c.Seq + 1}
+	}
+
+	return checkpoint{Position: pos, Seq: 1}
+}
+
+// notAfter returns true if c is at or before o. A checkpoint without a Seq, from before
+// it was added, includes every result at its position.
+func (c checkpoint) notAfter(o checkpoint) bool {
+	if c.Position != o.Position {
+		return c.Position.Before(o.Position)
+	}
+
+	return o.Seq == 0 || c.Seq <= o.Seq
+}
+
+// persistedState is the on-disk representation of the state of a query.
+type persistedState struct {
+	Checkpoint checkpoint                         `json:"checkpoint"`
+	Values     map[string]ctyjson.SimpleJSONValue `json:"values"`
+}
+
+// initState evaluates the initial values of the accumulators of the query.
+func (q *QuerySchema) initState() error {
+	q.state = &queryState{values: make(map[string]cty.Value)}
+
+	for _, st := range q.States {
+		if _, ok := q.state.values[st.Name]; ok {
+			return fmt.Errorf("state %s is defined more than once", st.Name)
+		}
+
+		v, diags := st.Initial.Value(q.EvalContext)
+		if diags.HasErrors() {
+			return fmt.Errorf("state %s: %w", st.Name, diagError(diags))
+		}
+
+		q.state.values[st.Name] = v
+	}
+
+	return nil
+}
+
+// HasState returns true if the query has state blocks. The results of such
+// a query have to be evaluated in chain order.
+func (q QuerySchema) HasState() bool {
+	return len(q.States) > 0
+}
+
+// applied advances the checkpoint of the query to the result, and returns true if the result
+// was already applied to the state before a restart. Those results were handled by the outputs
+// too, so they are dropped.
+func (q *QuerySchema) applied(res types.CallResult) bool {
+	if !q.HasState() {
+		return false
+	}
+
+	next := q.state.checkpoint.next(res.Position())
+	if q.state.restored != nil {
+		if next.notAfter(*q.state.restored) {
+			q.state.checkpoint = next
+			return true
+		}
+
+		q.state.restored = nil
+	}
+
+	q.state.checkpoint = next
+
+	return false
+}
+
+// updateState evaluates the update expressions of all accumulators with the previous
+// values, and then stores the new values.
+func (q *QuerySchema) updateState() error {
+	if !q.HasState() {
+		return nil
+	}
+
+	updated := make(map[string]cty.Value, len(q.States))
+	for _, st := range q.States {
+		v, diags := st.Update.Value(q.EvalContext)
+		if diags.HasErrors() {
+			return fmt.Errorf("state %s: %w", st.Name, diagError(diags))
+		}
+
+		updated[st.Name] = v
+	}
+
+	for k, v := range updated {
+		q.state.values[k] = v
+		q.EvalContext.Variables[k] = v
+	}
+
+	return nil
+}
+
+// LoadState restores the state of every stateful query from dir, if it was saved there before.
+func (s *DynamicSchema) LoadState(dir string) error {
+	for _, q := range s.QuerySchemas {
+		if !q.HasState() {
+			continue
+		}
+
+		b, err := os.ReadFile(stateFile(dir, q.Name))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return err
+		}
+
+		var ps persistedState
+		if err := json.Unmarshal(b, &ps); err != nil {
+			return fmt.Errorf("query %s: parsing state: %w", q.Name, err)
+		}
+
+		// Only restore accumulators that still exist, new ones keep their initial value.
+		for k, v := range ps.Values {
+			if _, ok := q.state.values[k]; ok {
+				q.state.values[k] = v.Value
+			}
+		}
+
+		// The checkpoint is reached again by counting the results before it
+		restored := ps.Checkpoint
+		q.state.restored = &restored
+	}
+
+	return nil
+}
+
+// SaveState writes the state of every stateful query to dir, one file per query.
+func (s *DynamicSchema) SaveState(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, q := range s.QuerySchemas {
+		if !q.HasState() {
+			continue
+		}
+
+		ps := persistedState{
+			Checkpoint: q.state.checkpoint,
+			Values:     make(map[string]ctyjson.SimpleJSONValue, len(q.state.values)),
+		}
+
+		for k, v := range q.state.values {
+			ps.Values[k] = ctyjson.SimpleJSONValue{Value: v}
+		}
+
+		b, err := json.MarshalIndent(ps, "", "  ")
+		if err != nil {
+			return fmt.Errorf("query %s: encoding state: %w", q.Name, err)
+		}
+
+		// Write to a temporary file first, so a crash never leaves a half-written state behind.
+		tmp := stateFile(dir, q.Name) + ".tmp"
+		if err := os.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+
+		if err := os.Rename(tmp, stateFile(dir, q.Name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func stateFile(dir, queryName string) string {
+	return filepath.Join(dir, queryName+".json")
+}
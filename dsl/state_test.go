@@ -0,0 +1,142 @@
+package dsl
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+)
+
+const stateSchema = `
+query blocks {
+  chain = "ethereum"
+
+  state total {
+    initial = 0
+    update = total + blocknumber
+  }
+
+  state seen {
+    initial = 0
+    update = seen + 1
+  }
+
+  filter = [
+    seen > 1
+  ]
+
+  save {
+    block = blocknumber
+    total = total
+    seen = seen
+  }
+}
+`
+
+func evalBlock(t *testing.T, s *DynamicSchema, block uint64) (int64, bool) {
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{QueryName: "blocks", Chain: types.ETHEREUM, BlockNumber: block})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if save == nil {
+		return 0, false
+	}
+
+	total, _ := save["total"].AsBigFloat().Int64()
+	return total, true
+}
+
+func TestState(t *testing.T) {
+	s, err := NewSchema(writeSchema(t, stateSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The filter sees the updated state, so the first result is filtered out
+	if _, ok := evalBlock(t, s, 10); ok {
+		t.Fatal("expected the first result to be filtered out")
+	}
+
+	total, ok := evalBlock(t, s, 11)
+	if !ok || total != 21 {
+		t.Fatalf("expected total 21, got %d", total)
+	}
+}
+
+func TestStatePersistence(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := writeSchema(t, stateSchema)
+
+	s, err := NewSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evalBlock(t, s, 10)
+	evalBlock(t, s, 11)
+
+	if err := s.SaveState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restarted.LoadState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results up to the checkpoint were already handled before the restart, so they're dropped
+	for _, block := range []uint64{10, 11} {
+		if _, ok := evalBlock(t, restarted, block); ok {
+			t.Fatalf("expected block %d to be dropped after the restart", block)
+		}
+	}
+
+	total, ok := evalBlock(t, restarted, 12)
+	if !ok || total != 33 {
+		t.Fatalf("expected total 33, got %d", total)
+	}
+}
+
+func TestStateCheckpointSeq(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := writeSchema(t, stateSchema)
+
+	s, err := NewSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Method results of a block share a position, the run stops after the second of three
+	evalBlock(t, s, 10)
+	evalBlock(t, s, 11)
+	evalBlock(t, s, 11)
+
+	if err := s.SaveState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restarted.LoadState(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []uint64{10, 11, 11} {
+		if _, ok := evalBlock(t, restarted, block); ok {
+			t.Fatalf("expected block %d to be dropped after the restart", block)
+		}
+	}
+
+	// The third result of the block wasn't handled yet
+	total, ok := evalBlock(t, restarted, 11)
+	if !ok || total != 43 {
+		t.Fatalf("expected total 43, got %d", total)
+	}
+}
@@ -0,0 +1,203 @@
+package dsl
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/ext/userfunc"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// builtinTemplates contains the template packs that ship with apollo.
+// Every template pack is a directory with a template.hcl file and the ABI it uses.
+//
+//go:embed templates
+var builtinTemplates embed.FS
+
+var ErrTemplateNotFound = errors.New("template not found")
+
+// TemplateSchema defines a template pack. A query that uses a template
+// gets access to its ABI, methods, events, transforms, variables and functions.
+type TemplateSchema struct {
+	Name string
+
+	AbiPath   string               `hcl:"abi"`
+	Variables map[string]cty.Value `hcl:"variables,optional"`
+
+	// Methods and events provide the default inputs, outputs and transforms
+	// for the methods and events with the same name in a query.
+	Methods []*MethodSchema `hcl:"method,block"`
+	Events  []*EventSchema  `hcl:"event,block"`
+
+	// Functions contains the function blocks. They are decoded per query,
+	// so that they are evaluated in the context of that query.
+	Functions hcl.Body `hcl:",remain"`
+
+	Abi abi.ABI
+}
+
+// LoadTemplate loads the template pack with the given name. User-provided template packs
+// in confDir/templates take precedence over the built-in ones, so they can be overridden.
+func LoadTemplate(confDir, name string) (*TemplateSchema, error) {
+	userTemplates := os.DirFS(path.Join(confDir, "templates"))
+	if _, err := fs.Stat(userTemplates, path.Join(name, "template.hcl")); err == nil {
+		return loadTemplate(userTemplates, name)
+	}
+
+	builtin, err := fs.Sub(builtinTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := fs.Stat(builtin, path.Join(name, "template.hcl")); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrTemplateNotFound, name)
+	}
+
+	return loadTemplate(builtin, name)
+}
+
+func loadTemplate(fsys fs.FS, name string) (*TemplateSchema, error) {
+	templatePath := path.Join(name, "template.hcl")
+	f, err := fs.ReadFile(fsys, templatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, diags := hclsyntax.ParseConfig(f, templatePath, hcl.InitialPos)
+	addSource(templatePath, file)
+	if diags.HasErrors() {
+		return nil, diagError(diags)
+	}
+
+	t := &TemplateSchema{Name: name}
+	ctx := InitialContext()
+	diags = gohcl.DecodeBody(file.Body, &ctx, t)
+	if diags.HasErrors() {
+		return nil, diagError(diags)
+	}
+
+	abiFile, err := fsys.Open(path.Join(name, t.AbiPath))
+	if err != nil {
+		return nil, fmt.Errorf("reading template ABI file: %w", err)
+	}
+	defer abiFile.Close()
+
+	t.Abi, err = abi.JSON(abiFile)
+	if err != nil {
+		return nil, fmt.Errorf("parsing template ABI: %w", err)
+	}
+
+	return t, nil
+}
+
+func (t TemplateSchema) method(name string) *MethodSchema {
+	for _, m := range t.Methods {
+		if m.Name() == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+func (t TemplateSchema) event(name string) *EventSchema {
+	for _, e := range t.Events {
+		if e.Name() == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Apply fills in everything the query doesn't define itself with the defaults from
+// the template: the ABI of contracts and events without one, the inputs, outputs and
+// transforms of known methods and events, and the variables and functions in the query context.
+func (t TemplateSchema) Apply(q *QuerySchema) error {
+	for _, c := range q.ContractSchemas {
+		if c.AbiPath == "" {
+			c.Abi = t.Abi
+		}
+
+		for _, m := range c.Methods {
+			t.applyMethod(m)
+		}
+
+		for _, e := range c.Events {
+			t.applyEvent(e)
+		}
+	}
+
+	for _, e := range q.EventSchemas {
+		if e.AbiPath == "" {
+			e.Abi = t.Abi
+		}
+
+		t.applyEvent(e)
+	}
+
+	for k, v := range t.Variables {
+		q.EvalContext.Variables[k] = v
+	}
+
+	// Template functions are evaluated in the query context, so they can use
+	// the template variables.
+	funcs, _, diags := userfunc.DecodeUserFunctions(t.Functions, "function", func() *hcl.EvalContext {
+		return q.EvalContext
+	})
+	if diags.HasErrors() {
+		return diagError(diags)
+	}
+
+	for k, v := range funcs {
+		q.EvalContext.Functions[k] = v
+	}
+
+	return nil
+}
+
+func (t TemplateSchema) applyMethod(m *MethodSchema) {
+	tm := t.method(m.Name())
+	if tm == nil {
+		return
+	}
+
+	if len(m.Outputs) == 0 {
+		m.Outputs = tm.Outputs
+	}
+
+	if m.Inputs_ == nil {
+		m.Inputs_ = tm.Inputs_
+	}
+
+	if m.Transforms == nil {
+		m.Transforms = tm.Transforms
+	}
+}
+
+func (t TemplateSchema) applyEvent(e *EventSchema) {
+	te := t.event(e.Name())
+	if te == nil {
+		return
+	}
+
+	if len(e.Outputs_) == 0 {
+		e.Outputs_ = te.Outputs_
+	}
+
+	if e.Transforms == nil {
+		e.Transforms = te.Transforms
+	}
+
+	for _, m := range e.Methods {
+		t.applyMethod(m)
+	}
+}
@@ -0,0 +1,54 @@
+// Aave V3 pools
+abi = "pool.abi.json"
+
+variables = {
+  // Aave V3 reports account data in the base currency (USD) with 8 decimals
+  base_decimals = 8
+}
+
+method getUserAccountData {
+  outputs = ["totalCollateralBase", "totalDebtBase", "availableBorrowsBase", "currentLiquidationThreshold", "ltv", "healthFactor"]
+}
+
+event Supply {
+  outputs = ["reserve", "user", "onBehalfOf", "amount"]
+}
+
+event Withdraw {
+  outputs = ["reserve", "user", "to", "amount"]
+}
+
+event Borrow {
+  outputs = ["reserve", "user", "onBehalfOf", "amount", "interestRateMode", "borrowRate"]
+
+  transform {
+    // The borrow rate is expressed in ray (27 decimals)
+    borrow_rate = parse_decimals(borrowRate, 27)
+  }
+}
+
+event Repay {
+  outputs = ["reserve", "user", "repayer", "amount"]
+}
+
+event LiquidationCall {
+  outputs = ["collateralAsset", "debtAsset", "user", "debtToCover", "liquidatedCollateralAmount", "liquidator"]
+}
+
+// The health factor of an account, below 1 the account can be liquidated
+function "health_factor" {
+  params = [health_factor]
+  result = parse_decimals(health_factor, 18)
+}
+
+// Converts a base currency amount to USD
+function "base_value" {
+  params = [amount]
+  result = parse_decimals(amount, base_decimals)
+}
+
+// The ratio of collateral to debt of an account
+function "collateral_ratio" {
+  params = [collateral, debt]
+  result = debt == 0 ? 0 : collateral / debt
+}
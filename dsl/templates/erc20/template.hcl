@@ -0,0 +1,41 @@
+// ERC20 tokens
+abi = "erc20.abi.json"
+
+method balanceOf {
+  outputs = ["balance"]
+}
+
+method totalSupply {
+  outputs = ["total_supply"]
+}
+
+method decimals {
+  outputs = ["decimals"]
+}
+
+method symbol {
+  outputs = ["symbol"]
+}
+
+method name {
+  outputs = ["name"]
+}
+
+event Transfer {
+  outputs = ["from", "to", "value"]
+
+  transform {
+    mint = from == "0x0000000000000000000000000000000000000000"
+    burn = to == "0x0000000000000000000000000000000000000000"
+  }
+}
+
+event Approval {
+  outputs = ["owner", "spender", "value"]
+}
+
+// The share of the total supply an amount represents
+function "supply_share" {
+  params = [amount, total_supply]
+  result = total_supply == 0 ? 0 : amount / total_supply
+}
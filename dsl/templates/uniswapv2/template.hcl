@@ -0,0 +1,53 @@
+// Uniswap V2 pairs (and forks like Sushiswap)
+abi = "pair.abi.json"
+
+method getReserves {
+  outputs = ["_reserve0", "_reserve1"]
+}
+
+method token0 {
+  outputs = ["token0"]
+}
+
+method token1 {
+  outputs = ["token1"]
+}
+
+event Swap {
+  outputs = ["sender", "to", "amount0In", "amount1In", "amount0Out", "amount1Out"]
+
+  transform {
+    // A buy means token0 was bought with token1
+    buy = amount0Out != 0
+  }
+}
+
+event Sync {
+  outputs = ["reserve0", "reserve1"]
+}
+
+event Mint {
+  outputs = ["sender", "amount0", "amount1"]
+}
+
+event Burn {
+  outputs = ["sender", "to", "amount0", "amount1"]
+}
+
+// The mid price of token0 in token1
+function "mid_price" {
+  params = [reserve0, reserve1, decimals0, decimals1]
+  result = parse_decimals(reserve1, decimals1) / parse_decimals(reserve0, decimals0)
+}
+
+// The execution price of a swap in token1 per token0
+function "swap_price" {
+  params = [amount0In, amount1In, amount0Out, amount1Out, decimals0, decimals1]
+  result = amount0Out != 0 ? parse_decimals(amount1In, decimals1) / parse_decimals(amount0Out, decimals0) : parse_decimals(amount1Out, decimals1) / parse_decimals(amount0In, decimals0)
+}
+
+// The output amount for an input amount, including the 0.3% fee
+function "amount_out" {
+  params = [amount_in, reserve_in, reserve_out]
+  result = mul_div(amount_in * 997, reserve_out, reserve_in * 1000 + amount_in * 997)
+}
@@ -0,0 +1,57 @@
+// Uniswap V3 pools
+abi = "pool.abi.json"
+
+method slot0 {
+  outputs = ["sqrtPriceX96", "tick"]
+}
+
+method liquidity {
+  outputs = ["liquidity"]
+}
+
+method token0 {
+  outputs = ["token0"]
+}
+
+method token1 {
+  outputs = ["token1"]
+}
+
+event Swap {
+  outputs = ["sender", "recipient", "amount0", "amount1", "sqrtPriceX96", "liquidity", "tick"]
+
+  transform {
+    // Amounts are from the perspective of the pool, a positive amount0 means token0 was sold
+    buy = amount0 < 0
+  }
+}
+
+event Mint {
+  outputs = ["sender", "owner", "amount", "amount0", "amount1"]
+}
+
+event Burn {
+  outputs = ["owner", "amount", "amount0", "amount1"]
+}
+
+event Collect {
+  outputs = ["owner", "recipient", "amount0", "amount1"]
+}
+
+// The price of token0 in token1 from the square root price
+function "sqrt_price_to_price" {
+  params = [sqrt_price_x96, decimals0, decimals1]
+  result = pow(sqrt_price_x96, 2) / pow(2, 192) * pow(10, decimals0 - decimals1)
+}
+
+// The price of token0 in token1 at a tick
+function "tick_to_price" {
+  params = [tick, decimals0, decimals1]
+  result = pow(1.0001, tick) * pow(10, decimals0 - decimals1)
+}
+
+// The execution price of a swap in token1 per token0
+function "swap_price" {
+  params = [amount0, amount1, decimals0, decimals1]
+  result = abs(parse_decimals(amount1, decimals1) / parse_decimals(amount0, decimals0))
+}
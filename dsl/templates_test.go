@@ -0,0 +1,88 @@
+package dsl
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestBuiltinTemplates(t *testing.T) {
+	for _, name := range []string{"erc20", "uniswapv2", "uniswapv3", "aavev3"} {
+		tmpl, err := LoadTemplate(t.TempDir(), name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		for _, m := range tmpl.Methods {
+			if _, ok := tmpl.Abi.Methods[m.Name()]; !ok {
+				t.Fatalf("%s: method %s not in ABI", name, m.Name())
+			}
+		}
+
+		for _, e := range tmpl.Events {
+			if _, ok := tmpl.Abi.Events[e.Name()]; !ok {
+				t.Fatalf("%s: event %s not in ABI", name, e.Name())
+			}
+		}
+	}
+
+	if _, err := LoadTemplate(t.TempDir(), "compound"); err == nil {
+		t.Fatal("expected template not found error")
+	}
+}
+
+func TestTemplateQuery(t *testing.T) {
+	dir := writeSchema(t, `
+query swaps {
+  chain = "ethereum"
+  template = "uniswapv2"
+
+  contract {
+    address = "0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc"
+    event Swap {}
+  }
+
+  save {
+    buy = buy
+    price = swap_price(amount0In, amount1In, amount0Out, amount1Out, 6, 18)
+  }
+}
+`)
+
+	s, err := NewSchema(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := s.QuerySchemas[0].ContractSchemas[0].Events[0]
+	if len(event.Outputs()) == 0 {
+		t.Fatal("expected outputs from template")
+	}
+
+	eth, _ := new(big.Int).SetString("1000000000000000000", 10)
+	save, err := s.EvalSave(mockProvider{}, types.CallResult{
+		Type:       types.Event,
+		QueryName:  "swaps",
+		EventName:  "Swap",
+		Identifier: common.HexToAddress("0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc").String(),
+		Outputs: map[string]any{
+			"amount0In":  big.NewInt(2000000000),
+			"amount1In":  big.NewInt(0),
+			"amount0Out": big.NewInt(0),
+			"amount1Out": eth,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if save["buy"].True() {
+		t.Fatal("expected a sell")
+	}
+
+	if got := save["price"].AsBigFloat().Text('f', -1); got != "0.0005" {
+		t.Fatalf("expected 0.0005, got %s", got)
+	}
+}
@@ -0,0 +1,96 @@
+package dsl
+
+import (
+	"math/big"
+	"reflect"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/gocty"
+)
+
+// toCtyValue converts a decoded ABI value to a cty value. Addresses, hashes and bytes become
+// hex strings, booleans stay booleans, arrays become tuples and tuples (which are decoded into
+// structs) become objects with the names of their ABI components. Everything else is a number.
+func toCtyValue(v any) (cty.Value, error) {
+	switch v := v.(type) {
+	case nil:
+		return cty.NullVal(cty.DynamicPseudoType), nil
+	case common.Address:
+		return cty.StringVal(v.String()), nil
+	case common.Hash:
+		return cty.StringVal(v.Hex()), nil
+	case string:
+		return cty.StringVal(v), nil
+	case bool:
+		return cty.BoolVal(v), nil
+	case []byte:
+		return cty.StringVal(hexutil.Encode(v)), nil
+	case *big.Int:
+		if v == nil {
+			return cty.NullVal(cty.Number), nil
+		}
+
+		return cty.NumberVal(new(big.Float).SetInt(v)), nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Array:
+		// Fixed size bytes, like bytes32
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return cty.StringVal(hexutil.Encode(b)), nil
+		}
+
+		return toCtyTuple(rv)
+	case reflect.Slice:
+		return toCtyTuple(rv)
+	case reflect.Struct:
+		attrs := make(map[string]cty.Value, rv.NumField())
+		for i := 0; i < rv.NumField(); i++ {
+			field := rv.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+
+			// The ABI component names are kept in the json tags
+			name := field.Name
+			if tag, ok := field.Tag.Lookup("json"); ok && tag != "" {
+				name = strings.Split(tag, ",")[0]
+			}
+
+			val, err := toCtyValue(rv.Field(i).Interface())
+			if err != nil {
+				return cty.NilVal, err
+			}
+
+			attrs[name] = val
+		}
+
+		return cty.ObjectVal(attrs), nil
+	}
+
+	return gocty.ToCtyValue(v, cty.Number)
+}
+
+func toCtyTuple(rv reflect.Value) (cty.Value, error) {
+	if rv.Len() == 0 {
+		return cty.EmptyTupleVal, nil
+	}
+
+	vals := make([]cty.Value, rv.Len())
+	for i := range vals {
+		val, err := toCtyValue(rv.Index(i).Interface())
+		if err != nil {
+			return cty.NilVal, err
+		}
+
+		vals[i] = val
+	}
+
+	return cty.TupleVal(vals), nil
+}
@@ -0,0 +1,43 @@
+package dsl
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestToCtyValue(t *testing.T) {
+	// Tuples are decoded into structs with the component names in the json tags
+	type position struct {
+		Owner     common.Address `json:"owner"`
+		Liquidity *big.Int       `json:"liquidity"`
+		Active    bool           `json:"active"`
+		Ticks     []int32        `json:"ticks"`
+		Salt      [4]byte        `json:"salt"`
+	}
+
+	v, err := toCtyValue(position{
+		Owner:     common.HexToAddress("0xe1Dd30fecAb8a63105F2C035B084BfC6Ca5B1493"),
+		Liquidity: big.NewInt(1000),
+		Active:    true,
+		Ticks:     []int32{-10, 10},
+		Salt:      [4]byte{0xde, 0xad, 0xbe, 0xef},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := cty.ObjectVal(map[string]cty.Value{
+		"owner":     cty.StringVal("0xe1Dd30fecAb8a63105F2C035B084BfC6Ca5B1493"),
+		"liquidity": cty.NumberIntVal(1000),
+		"active":    cty.True,
+		"ticks":     cty.TupleVal([]cty.Value{cty.NumberIntVal(-10), cty.NumberIntVal(10)}),
+		"salt":      cty.StringVal("0xdeadbeef"),
+	})
+
+	if !v.RawEquals(expected) {
+		t.Fatalf("expected %#v, got %#v", expected, v)
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"time"
+
 	"github.com/chainbound/apollo/types"
 	"github.com/urfave/cli/v2"
 )
@@ -13,21 +17,139 @@ func BuildFlags(opts *types.ApolloOpts) []cli.Flag {
 			Usage:       "Run apollo in realtime",
 			Destination: &opts.Realtime,
 		},
+		&cli.StringFlag{
+			Name:        "config",
+			Usage:       "Load the config from `PATH` (default: config.yml in the config directory)",
+			EnvVars:     []string{"APOLLO_CONFIG"},
+			Destination: &opts.ConfigPath,
+		},
+		&cli.StringFlag{
+			Name:        "schema",
+			Usage:       "Load the schema from `PATH`, a file or a directory of .hcl files (default: schema.hcl in the config directory)",
+			EnvVars:     []string{"APOLLO_SCHEMA"},
+			Destination: &opts.SchemaPath,
+		},
+		&cli.StringFlag{
+			Name:        "abi-dir",
+			Usage:       "Resolve relative ABI paths in `DIR` (default: the directory of the schema)",
+			EnvVars:     []string{"APOLLO_ABI_DIR"},
+			Destination: &opts.AbiDir,
+		},
+		&cli.StringFlag{
+			Name:        "output-dir",
+			Usage:       "Write output files to `DIR`",
+			EnvVars:     []string{"APOLLO_OUTPUT_DIR"},
+			Value:       ".",
+			Destination: &opts.OutputDir,
+		},
+		&cli.StringFlag{
+			Name:        "state-dir",
+			Usage:       "Persist the state of queries with state blocks in `DIR`, so it survives restarts",
+			EnvVars:     []string{"APOLLO_STATE_DIR"},
+			Destination: &opts.StateDir,
+		},
 		&cli.BoolFlag{
 			Name:        "db",
 			Usage:       "Save results in database",
 			Destination: &opts.Db,
 		},
+		&cli.IntFlag{
+			Name:        "db-batch-size",
+			Usage:       "Insert database rows in batches of `ROWS`",
+			Destination: &opts.DbBatchSize,
+			Value:       1000,
+		},
+		&cli.DurationFlag{
+			Name:        "db-flush-interval",
+			Usage:       "Insert pending database rows every `INTERVAL`, even if the batch is not full",
+			Destination: &opts.DbFlushInterval,
+			Value:       time.Second,
+		},
 		&cli.BoolFlag{
 			Name:        "csv",
 			Usage:       "Save results in csv file",
 			Destination: &opts.Csv,
 		},
+		&cli.BoolFlag{
+			Name:        "json",
+			Usage:       "Save results in a NDJSON file per query",
+			Destination: &opts.Json,
+		},
+		&cli.BoolFlag{
+			Name:        "parquet",
+			Usage:       "Save results in Parquet files",
+			Destination: &opts.Parquet,
+		},
+		&cli.Int64Flag{
+			Name:        "parquet-row-group-size",
+			Usage:       "Number of `ROWS` in a Parquet row group",
+			Destination: &opts.ParquetRowGroupSize,
+			Value:       100000,
+		},
+		&cli.StringFlag{
+			Name:        "parquet-compression",
+			Usage:       "Parquet compression `CODEC`: none, snappy, gzip, lz4 or zstd",
+			Destination: &opts.ParquetCompression,
+			Value:       "snappy",
+		},
+		&cli.Int64Flag{
+			Name:        "parquet-max-rows",
+			Usage:       "Start a new Parquet file after `ROWS` rows (0 to disable)",
+			Destination: &opts.ParquetMaxRows,
+		},
+		&cli.Uint64Flag{
+			Name:        "parquet-max-blocks",
+			Usage:       "Start a new Parquet file every `BLOCKS` blocks (0 to disable)",
+			Destination: &opts.ParquetMaxBlocks,
+		},
+		&cli.StringFlag{
+			Name:        "sqlite",
+			Usage:       "Save results in the SQLite database file at `PATH`, with a table per query",
+			Destination: &opts.SQLitePath,
+		},
+		&cli.BoolFlag{
+			Name:        "webhook",
+			Usage:       "POST results as JSON to the webhook URLs of the config",
+			Destination: &opts.Webhook,
+		},
+		&cli.StringFlag{
+			Name:        "stream",
+			Usage:       "Stream results over WebSocket and SSE from a server at `ADDR`, like :8080",
+			Destination: &opts.StreamAddr,
+		},
+		&cli.IntFlag{
+			Name:        "stream-replay",
+			Usage:       "Number of `RESULTS` per query that new stream clients get first",
+			Value:       100,
+			Destination: &opts.StreamReplay,
+		},
+		&cli.StringFlag{
+			Name:        "stream-slow-clients",
+			Usage:       "What happens to stream clients that don't keep up: drop results or disconnect",
+			Value:       "drop",
+			Destination: &opts.StreamSlowClients,
+		},
 		&cli.BoolFlag{
 			Name:        "stdout",
 			Usage:       "Print to stdout",
 			Destination: &opts.Stdout,
 		},
+		&cli.StringFlag{
+			Name:        "stdout-format",
+			Usage:       "Print to stdout as `FORMAT`, text or json (one JSON object per line, the logs go to stderr)",
+			Destination: &opts.StdoutFormat,
+			Value:       "text",
+		},
+		&cli.BoolFlag{
+			Name:        "exact",
+			Usage:       "Keep the full precision of numbers in the outputs",
+			Destination: &opts.Exact,
+		},
+		&cli.BoolFlag{
+			Name:        "unordered",
+			Usage:       "Don't sort historical results in chain order, for more throughput (queries with state are always sorted)",
+			Destination: &opts.Unordered,
+		},
 		&cli.IntFlag{
 			Name:        "rate-limit",
 			Usage:       "Rate limit `RPS` in max requests per second",
@@ -48,3 +170,28 @@ func BuildFlags(opts *types.ApolloOpts) []cli.Flag {
 		},
 	}
 }
+
+// commandOpts returns the options of a subcommand like `plan`: the defaults, overridden by the
+// flags before the subcommand and then by the flags of the subcommand itself. The subcommand
+// can't share the options of the app, because parsing its flags resets them to their defaults.
+func commandOpts(c *cli.Context) (types.ApolloOpts, error) {
+	var opts types.ApolloOpts
+
+	set := flag.NewFlagSet(c.Command.Name, flag.ContinueOnError)
+	for _, f := range BuildFlags(&opts) {
+		if err := f.Apply(set); err != nil {
+			return opts, err
+		}
+	}
+
+	// The lineage is the subcommand, the app and an empty root context
+	for _, ctx := range []*cli.Context{c.Lineage()[1], c} {
+		for _, name := range ctx.LocalFlagNames() {
+			if err := set.Set(name, fmt.Sprint(ctx.Value(name))); err != nil {
+				return opts, fmt.Errorf("flag %s: %w", name, err)
+			}
+		}
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chainbound/apollo/types"
+	"github.com/urfave/cli/v2"
+)
+
+func TestCommandOpts(t *testing.T) {
+	var (
+		opts types.ApolloOpts
+		got  types.ApolloOpts
+	)
+
+	app := &cli.App{
+		Flags: BuildFlags(&opts),
+		Commands: []*cli.Command{{
+			Name:  "plan",
+			Flags: BuildFlags(&types.ApolloOpts{}),
+			Action: func(c *cli.Context) (err error) {
+				got, err = commandOpts(c)
+				return err
+			},
+		}},
+	}
+
+	args := []string{"apollo", "--config", "global.yml", "--schema", "global.hcl", "--rate-limit", "5", "plan", "--schema", "local.hcl", "--csv"}
+	if err := app.Run(args); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags before the subcommand are kept, the flags of the subcommand override them
+	if got.ConfigPath != "global.yml" || got.SchemaPath != "local.hcl" || got.RateLimit != 5 || !got.Csv {
+		t.Fatalf("unexpected options %+v", got)
+	}
+
+	// Other flags have their defaults
+	if got.OutputDir != "." || got.DbBatchSize != 1000 || got.LogParts != 50 {
+		t.Fatalf("unexpected defaults %+v", got)
+	}
+}
@@ -0,0 +1,120 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// ClickHouse is the dialect of ClickHouse. Tables use the MergeTree engine and have no id column,
+// because ClickHouse has no auto incrementing columns.
+type ClickHouse struct{}
+
+func (ClickHouse) Name() string {
+	return "clickhouse"
+}
+
+// identifierEscaper escapes backslashes and backticks in quoted identifiers.
+var identifierEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+func (ClickHouse) Quote(name string) string {
+	return "`" + identifierEscaper.Replace(name) + "`"
+}
+
+// ColumnType returns the column type of the kind. Numbers are Float64, or String with
+// exact, because the driver has no decimals that fit 256 bit integers. JSON is stored in
+// String columns, because the JSON type is experimental. Every column is nullable.
+func (ClickHouse) ColumnType(k Kind, exact bool) string {
+	switch k {
+	case KindNumber:
+		if exact {
+			return "Nullable(String)"
+		}
+
+		return "Nullable(Float64)"
+	case KindInteger:
+		return "Nullable(Int64)"
+	case KindBool:
+		return "Nullable(UInt8)"
+	case KindTimestamp:
+		return "Nullable(DateTime)"
+	default:
+		return "Nullable(String)"
+	}
+}
+
+// Value converts a value to the Go type the driver expects for the column type.
+func (ClickHouse) Value(v cty.Value, k Kind, exact bool) (any, error) {
+	if v == cty.NilVal || v.IsNull() || !v.IsKnown() {
+		return nil, nil
+	}
+
+	if v.Type() == cty.Number && k == KindNumber && !exact {
+		f, _ := v.AsBigFloat().Float64()
+		return f, nil
+	}
+
+	return kindValue(v, k, exact)
+}
+
+func (ClickHouse) ColumnsSQL(table string) (string, []any) {
+	return "SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?", []any{table}
+}
+
+// CreateTableSQL creates a MergeTree table. If there are keys, it's a ReplacingMergeTree ordered
+// by the keys, which removes rows with the same keys in the background. Keys can't be nullable.
+func (c ClickHouse) CreateTableSQL(table string, cols map[string]ColumnType, keys []string, exact bool) string {
+	isKey := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		isKey[k] = true
+	}
+
+	defs := make([]string, 0, len(cols))
+	for _, name := range SortedColumns(cols) {
+		t := TypeSQL(c, cols[name], exact)
+		if isKey[name] {
+			t = strings.TrimSuffix(strings.TrimPrefix(t, "Nullable("), ")")
+		}
+
+		defs = append(defs, fmt.Sprintf("%s %s", c.Quote(name), t))
+	}
+
+	engine := "MergeTree ORDER BY tuple()"
+	if len(keys) > 0 {
+		engine = fmt.Sprintf("ReplacingMergeTree ORDER BY (%s)", keysSQL(c, keys))
+	}
+
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n) ENGINE = %s", c.Quote(table), strings.Join(defs, ",\n\t"), engine)
+}
+
+// UniqueKeySQL is empty, the keys are the sorting key of the table.
+func (ClickHouse) UniqueKeySQL(table string, keys []string) string {
+	return ""
+}
+
+func (c ClickHouse) DropTableSQL(table string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s", c.Quote(table))
+}
+
+func (c ClickHouse) AddColumnSQL(table, column string, t ColumnType, exact bool) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.Quote(table), c.Quote(column), TypeSQL(c, t, exact))
+}
+
+// InsertSQL returns a single row insert, whatever `rows` is: the driver only inserts in
+// batches, by executing a single row insert per row in a transaction.
+func (c ClickHouse) InsertSQL(table string, columns []string, rows int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) %s", c.Quote(table), strings.Join(quoteAll(c, columns), ", "),
+		valuesSQL(len(columns), 1, func(int) string { return "?" }))
+}
+
+// UpsertSQL is a plain insert. ClickHouse has no upserts, duplicates are removed in the
+// background by the ReplacingMergeTree engine of tables with keys.
+func (c ClickHouse) UpsertSQL(table string, columns, keys []string, rows int) string {
+	return c.InsertSQL(table, columns, rows)
+}
+
+// BulkLoadSQL returns the insert that the driver executes in batches, also with keys.
+func (c ClickHouse) BulkLoadSQL(table string, columns, keys []string) string {
+	return c.InsertSQL(table, columns, 1)
+}
@@ -0,0 +1,163 @@
+package generate
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Kind is what a column stores. Every dialect maps it to a column type of its own.
+type Kind string
+
+const (
+	KindNumber    Kind = "numeric"
+	KindInteger   Kind = "integer"
+	KindText      Kind = "text"
+	KindBool      Kind = "boolean"
+	KindTimestamp Kind = "timestamp"
+	KindJSON      Kind = "json"
+)
+
+// kindAliases are the names of the kinds in type annotations.
+var kindAliases = map[string]Kind{
+	"numeric":     KindNumber,
+	"number":      KindNumber,
+	"decimal":     KindNumber,
+	"integer":     KindInteger,
+	"int":         KindInteger,
+	"bigint":      KindInteger,
+	"text":        KindText,
+	"string":      KindText,
+	"bool":        KindBool,
+	"boolean":     KindBool,
+	"timestamp":   KindTimestamp,
+	"timestamptz": KindTimestamp,
+	"datetime":    KindTimestamp,
+	"json":        KindJSON,
+	"jsonb":       KindJSON,
+}
+
+// ColumnType is the type of a column. It's derived from the values of the first result,
+// unless the ABI or an annotation in the save block determines it.
+type ColumnType struct {
+	Kind Kind
+	// SQL is a column type of the database, which is used as is instead of the type of
+	// the kind. The kind then only determines how values are converted.
+	SQL string
+}
+
+// CtyColumnType returns the column type of values of type t. Values that are null in the
+// first result have no type, so they're stored as text.
+func CtyColumnType(t cty.Type) ColumnType {
+	switch {
+	case t == cty.Number:
+		return ColumnType{Kind: KindNumber}
+	case t == cty.Bool:
+		return ColumnType{Kind: KindBool}
+	case t == cty.String, t == cty.DynamicPseudoType:
+		return ColumnType{Kind: KindText}
+	}
+
+	return ColumnType{Kind: KindJSON}
+}
+
+// AbiColumnType returns the column type of values of the ABI type t. Integers that fit in
+// a signed 64 bit integer are integers, larger ones are numeric.
+func AbiColumnType(t abi.Type) ColumnType {
+	switch t.T {
+	case abi.IntTy:
+		if t.Size <= 64 {
+			return ColumnType{Kind: KindInteger}
+		}
+	case abi.UintTy:
+		if t.Size < 64 {
+			return ColumnType{Kind: KindInteger}
+		}
+	case abi.BoolTy:
+		return ColumnType{Kind: KindBool}
+	case abi.StringTy, abi.AddressTy, abi.BytesTy, abi.FixedBytesTy, abi.HashTy:
+		return ColumnType{Kind: KindText}
+	case abi.SliceTy, abi.ArrayTy, abi.TupleTy:
+		return ColumnType{Kind: KindJSON}
+	}
+
+	return ColumnType{Kind: KindNumber}
+}
+
+// ParseColumnType parses the type of a type annotation, like `timestamptz`. The names of
+// the kinds and their aliases are portable, any other type is used as is.
+func ParseColumnType(s string) ColumnType {
+	if k, ok := kindAliases[strings.ToLower(strings.TrimSpace(s))]; ok {
+		return ColumnType{Kind: k}
+	}
+
+	return ColumnType{SQL: s}
+}
+
+// TypeSQL returns the column type of t in the dialect.
+func TypeSQL(d Dialect, t ColumnType, exact bool) string {
+	if t.SQL != "" {
+		return t.SQL
+	}
+
+	return d.ColumnType(t.Kind, exact)
+}
+
+// kindValue converts a value for a column of kind k, for a dialect that stores numbers as
+// decimals. Numbers are timestamps in seconds, and booleans are 1 or 0 in number columns.
+func kindValue(v cty.Value, k Kind, exact bool) (any, error) {
+	if v == cty.NilVal || v.IsNull() || !v.IsKnown() {
+		return nil, nil
+	}
+
+	switch v.Type() {
+	case cty.Number:
+		f := v.AsBigFloat()
+		switch k {
+		case KindInteger:
+			if i, acc := f.Int64(); acc == big.Exact {
+				return i, nil
+			}
+		case KindBool:
+			return f.Sign() != 0, nil
+		case KindTimestamp:
+			if sec, acc := f.Int64(); acc == big.Exact {
+				return time.Unix(sec, 0).UTC(), nil
+			}
+
+			sec, _ := f.Float64()
+			return time.Unix(0, int64(sec*float64(time.Second))).UTC(), nil
+		case KindJSON:
+			return jsonText(v)
+		}
+
+		return numberText(f, exact), nil
+	case cty.String:
+		if k == KindJSON {
+			return jsonText(v)
+		}
+
+		return v.AsString(), nil
+	case cty.Bool:
+		switch k {
+		case KindNumber, KindInteger:
+			if v.True() {
+				return int64(1), nil
+			}
+
+			return int64(0), nil
+		case KindText:
+			return strconv.FormatBool(v.True()), nil
+		case KindJSON:
+			return jsonText(v)
+		}
+
+		return v.True(), nil
+	}
+
+	return jsonText(v)
+}
@@ -0,0 +1,79 @@
+package generate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestAbiColumnType(t *testing.T) {
+	tests := []struct {
+		abiType string
+		want    Kind
+	}{
+		{"uint8", KindInteger},
+		{"int64", KindInteger},
+		{"uint64", KindNumber},
+		{"uint256", KindNumber},
+		{"bool", KindBool},
+		{"address", KindText},
+		{"string", KindText},
+		{"bytes32", KindText},
+		{"uint256[]", KindJSON},
+	}
+
+	for _, tt := range tests {
+		typ, err := abi.NewType(tt.abiType, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := AbiColumnType(typ); got.Kind != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.abiType, tt.want, got.Kind)
+		}
+	}
+}
+
+func TestParseColumnType(t *testing.T) {
+	if got := ParseColumnType("TimestampTZ"); got != (ColumnType{Kind: KindTimestamp}) {
+		t.Errorf("expected timestamp kind, got %+v", got)
+	}
+
+	// Other types are types of the database
+	if got := ParseColumnType("VARCHAR(32)"); got != (ColumnType{SQL: "VARCHAR(32)"}) {
+		t.Errorf("expected SQL type, got %+v", got)
+	}
+
+	if got := TypeSQL(MySQL{}, ColumnType{Kind: KindTimestamp}, false); got != "DATETIME(6)" {
+		t.Errorf("expected DATETIME(6), got %s", got)
+	}
+}
+
+func TestKindValue(t *testing.T) {
+	tests := []struct {
+		v    cty.Value
+		kind Kind
+		want any
+	}{
+		{cty.NumberIntVal(1650000000), KindTimestamp, time.Unix(1650000000, 0).UTC()},
+		{cty.NumberIntVal(42), KindInteger, int64(42)},
+		{cty.True, KindBool, true},
+		{cty.True, KindInteger, int64(1)},
+		{cty.False, KindText, "false"},
+		{cty.StringVal("0xabc"), KindJSON, `"0xabc"`},
+		{cty.NullVal(cty.Number), KindTimestamp, nil},
+	}
+
+	for _, tt := range tests {
+		got, err := kindValue(tt.v, tt.kind, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tt.want {
+			t.Errorf("%s as %s: expected %v, got %v", tt.v.GoString(), tt.kind, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package generate
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+// Dialect generates the SQL of a database. Every statement is parameterized, so values
+// are never formatted into the SQL.
+type Dialect interface {
+	// Name is the name of the dialect, as it's configured in config.yml.
+	Name() string
+	// Quote quotes an identifier, like a table or column name.
+	Quote(name string) string
+	// ColumnType returns the column type of the kind.
+	ColumnType(k Kind, exact bool) string
+	// Value converts a value to a statement argument for a column of kind k.
+	Value(v cty.Value, k Kind, exact bool) (any, error)
+	// ColumnsSQL returns a query and its arguments that select the name and type of every
+	// column of the table. It returns no rows if the table doesn't exist.
+	ColumnsSQL(table string) (string, []any)
+	// CreateTableSQL returns the statement that creates the table, with a column per value
+	// in cols. Only dialects that need the keys in the table definition use them, the others
+	// make them unique with UniqueKeySQL.
+	CreateTableSQL(table string, cols map[string]ColumnType, keys []string, exact bool) string
+	// UniqueKeySQL returns the statement that adds a unique index on the keys to the table,
+	// or nothing if the dialect doesn't need one.
+	UniqueKeySQL(table string, keys []string) string
+	// DropTableSQL returns the statement that drops the table if it exists.
+	DropTableSQL(table string) string
+	// AddColumnSQL returns the statement that adds a column of type t to the table.
+	AddColumnSQL(table, column string, t ColumnType, exact bool) string
+	// InsertSQL returns a statement that inserts `rows` rows of the columns.
+	InsertSQL(table string, columns []string, rows int) string
+	// UpsertSQL returns a statement that inserts `rows` rows of the columns, and updates the
+	// rows that already exist with the same keys.
+	UpsertSQL(table string, columns, keys []string, rows int) string
+	// BulkLoadSQL returns a statement that loads rows in bulk: it's prepared in a transaction
+	// and executed once per row, and the rows are sent when the statement is closed. If there
+	// are keys, existing rows with the same keys are updated. If it's empty, the dialect can't
+	// bulk load (with these keys) and rows are inserted with multi-row inserts.
+	BulkLoadSQL(table string, columns, keys []string) string
+}
+
+var dialects = map[string]Dialect{
+	"postgres":   Postgres{},
+	"mysql":      MySQL{},
+	"clickhouse": ClickHouse{},
+	"sqlite":     SQLite{},
+}
+
+// NewDialect returns the dialect with the name. An empty name is Postgres, which
+// was the only database before dialects were added.
+func NewDialect(name string) (Dialect, error) {
+	if name == "" {
+		return Postgres{}, nil
+	}
+
+	d, ok := dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown SQL dialect %s, expected postgres, mysql, clickhouse or sqlite", name)
+	}
+
+	return d, nil
+}
+
+// valuesSQL generates the `VALUES (...), (...)` clause for `rows` rows of n columns.
+// placeholder returns the placeholder of the i-th argument, starting at 1.
+func valuesSQL(n, rows int, placeholder func(i int) string) string {
+	tuples := make([]string, rows)
+	for r := range tuples {
+		params := make([]string, n)
+		for c := range params {
+			params[c] = placeholder(r*n + c + 1)
+		}
+
+		tuples[r] = "(" + strings.Join(params, ", ") + ")"
+	}
+
+	return "VALUES " + strings.Join(tuples, ", ")
+}
+
+func quoteAll(d Dialect, names []string) []string {
+	quoted := make([]string, len(names))
+	for i, n := range names {
+		quoted[i] = d.Quote(n)
+	}
+
+	return quoted
+}
+
+// numberText formats a number as decimal text. Integers keep their full precision, other numbers
+// are rounded to float64 precision unless exact is set.
+func numberText(f *big.Float, exact bool) string {
+	if f.IsInt() {
+		i, _ := f.Int(nil)
+		return i.String()
+	}
+
+	if exact {
+		return f.Text('f', -1)
+	}
+
+	f64, _ := f.Float64()
+	return big.NewFloat(f64).Text('f', -1)
+}
+
+// jsonText formats a value that has no column type of its own, like a tuple, as JSON.
+func jsonText(v cty.Value) (string, error) {
+	b, err := ctyjson.SimpleJSONValue{Value: v}.MarshalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// CompatibleType returns true if a column of type dbType, as it's reported by the database,
+// can store values of type t. Types are compared by what they store (numbers, strings,
+// booleans, timestamps or JSON), and types that are unknown are assumed to be compatible.
+func CompatibleType(d Dialect, dbType string, t ColumnType, exact bool) bool {
+	have, want := typeFamily(dbType), typeFamily(TypeSQL(d, t, exact))
+	if have == "" || want == "" || have == want {
+		return true
+	}
+
+	// Booleans are stored as integers by some databases, and JSON as text. Dialects that
+	// create JSON columns as text, like ClickHouse, can use existing JSON columns too.
+	return (want == "bool" && have == "number") || (want == "json" && have == "string") ||
+		(t.Kind == KindJSON && t.SQL == "" && want == "string" && have == "json")
+}
+
+// StoredKind returns the kind of the values of an existing column of type dbType, when
+// it's compatible with t but stores something else, like booleans in a number column.
+func StoredKind(dbType string, t ColumnType) Kind {
+	switch typeFamily(dbType) {
+	case "number":
+		if t.Kind == KindBool {
+			return KindInteger
+		}
+	case "string":
+		if t.Kind == KindJSON {
+			return KindText
+		}
+	}
+
+	return t.Kind
+}
+
+// typeFamily returns what a column type stores: number, string, bool, time or json.
+func typeFamily(dbType string) string {
+	t := strings.ToLower(dbType)
+	if strings.HasPrefix(t, "nullable(") {
+		t = strings.TrimSuffix(strings.TrimPrefix(t, "nullable("), ")")
+	}
+
+	switch {
+	case strings.HasPrefix(t, "timestamp"), strings.HasPrefix(t, "datetime"), t == "date":
+		return "time"
+	case strings.HasPrefix(t, "bool"):
+		return "bool"
+	case strings.HasPrefix(t, "json"), strings.HasPrefix(t, "object('json')"):
+		return "json"
+	case strings.Contains(t, "char"), strings.Contains(t, "text"), strings.Contains(t, "string"):
+		return "string"
+	case strings.Contains(t, "int"), strings.Contains(t, "numeric"), strings.Contains(t, "decimal"),
+		strings.Contains(t, "float"), strings.Contains(t, "double"), strings.Contains(t, "real"), strings.Contains(t, "serial"):
+		return "number"
+	}
+
+	return ""
+}
+
+// SortedColumns returns the names of the columns in alphabetical order.
+func SortedColumns[V any](cols map[string]V) []string {
+	names := make([]string, 0, len(cols))
+	for k := range cols {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// keysSQL returns the quoted, comma separated keys.
+func keysSQL(d Dialect, keys []string) string {
+	return strings.Join(quoteAll(d, keys), ", ")
+}
+
+// keyIndexName returns the name of the unique index on the keys, like the name Postgres gives
+// a unique constraint. It's truncated to the 63 characters every dialect allows.
+func keyIndexName(table string, keys []string) string {
+	name := strings.ToLower(table + "_" + strings.Join(keys, "_") + "_key")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+
+	return name
+}
+
+// columnsDDL returns the column definitions of the table, in alphabetical order.
+func columnsDDL(d Dialect, cols map[string]ColumnType, exact bool) []string {
+	defs := make([]string, 0, len(cols))
+	for _, name := range SortedColumns(cols) {
+		defs = append(defs, fmt.Sprintf("%s %s", d.Quote(name), TypeSQL(d, cols[name], exact)))
+	}
+
+	return defs
+}
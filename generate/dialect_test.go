@@ -0,0 +1,160 @@
+package generate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestDialectInsertSQL(t *testing.T) {
+	columns := []string{"amount", "from"}
+
+	tests := []struct {
+		dialect Dialect
+		want    string
+	}{
+		{Postgres{}, `INSERT INTO "swaps" ("amount", "from") VALUES ($1, $2), ($3, $4)`},
+		{MySQL{}, "INSERT INTO `swaps` (`amount`, `from`) VALUES (?, ?), (?, ?)"},
+		{ClickHouse{}, "INSERT INTO `swaps` (`amount`, `from`) VALUES (?, ?)"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.dialect.InsertSQL("swaps", columns, 2); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.dialect.Name(), tt.want, got)
+		}
+	}
+}
+
+func TestDialectUpsertSQL(t *testing.T) {
+	columns := []string{"amount", "block", "pair"}
+	keys := []string{"block", "pair"}
+
+	got := Postgres{}.UpsertSQL("swaps", columns, keys, 1)
+	want := `INSERT INTO "swaps" ("amount", "block", "pair") VALUES ($1, $2, $3) ON CONFLICT ("block", "pair") DO UPDATE SET "amount" = EXCLUDED."amount"`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	got = MySQL{}.UpsertSQL("swaps", columns, keys, 1)
+	want = "INSERT INTO `swaps` (`amount`, `block`, `pair`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `amount` = VALUES(`amount`)"
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestDialectCreateTableSQL(t *testing.T) {
+	cols := map[string]ColumnType{
+		"amount0In": CtyColumnType(cty.Number),
+		"pair":      CtyColumnType(cty.String),
+		"timestamp": ParseColumnType("timestamptz"),
+		"name":      ParseColumnType("VARCHAR(32)"),
+	}
+
+	pg := Postgres{}.CreateTableSQL("Swaps", cols, nil, false)
+	if !strings.Contains(pg, `"amount0in" NUMERIC`) || !strings.Contains(pg, `"pair" TEXT`) || !strings.Contains(pg, `"timestamp" TIMESTAMPTZ`) ||
+		!strings.Contains(pg, `"name" VARCHAR(32)`) || !strings.Contains(pg, `CREATE TABLE "swaps"`) || strings.Contains(pg, "DROP") {
+		t.Errorf("unexpected postgres ddl %s", pg)
+	}
+
+	delete(cols, "name")
+	ch := ClickHouse{}.CreateTableSQL("swaps", cols, []string{"pair"}, true)
+	if !strings.Contains(ch, "`amount0In` Nullable(String)") || !strings.Contains(ch, "`pair` String") ||
+		!strings.Contains(ch, "ReplacingMergeTree ORDER BY (`pair`)") {
+		t.Errorf("unexpected clickhouse ddl %s", ch)
+	}
+
+	// The unique index has the name Postgres gives a UNIQUE constraint
+	got := Postgres{}.UniqueKeySQL("Swaps", []string{"tx_hash", "log_index"})
+	want := `CREATE UNIQUE INDEX IF NOT EXISTS "swaps_tx_hash_log_index_key" ON "swaps" ("tx_hash", "log_index");`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if ddl := (ClickHouse{}).UniqueKeySQL("swaps", []string{"pair"}); ddl != "" {
+		t.Errorf("expected no clickhouse index, got %s", ddl)
+	}
+}
+
+func TestCompatibleType(t *testing.T) {
+	tests := []struct {
+		dialect Dialect
+		dbType  string
+		t       ColumnType
+		want    bool
+	}{
+		{Postgres{}, "numeric", CtyColumnType(cty.Number), true},
+		{Postgres{}, "character varying", CtyColumnType(cty.Number), false},
+		{Postgres{}, "numeric", CtyColumnType(cty.String), false},
+		{Postgres{}, "numeric", CtyColumnType(cty.Bool), true},
+		{Postgres{}, "numeric", ColumnType{Kind: KindTimestamp}, false},
+		{Postgres{}, "timestamp with time zone", ColumnType{Kind: KindTimestamp}, true},
+		{MySQL{}, "tinyint", CtyColumnType(cty.Bool), true},
+		{ClickHouse{}, "Nullable(Float64)", CtyColumnType(cty.Number), true},
+		{ClickHouse{}, "Float64", CtyColumnType(cty.String), false},
+		// ClickHouse creates JSON columns as strings, but can use existing JSON columns
+		{ClickHouse{}, "Nullable(JSON)", ColumnType{Kind: KindJSON}, true},
+		{ClickHouse{}, "Object('json')", ColumnType{Kind: KindJSON}, true},
+		{ClickHouse{}, "JSON", CtyColumnType(cty.String), false},
+		{SQLite{}, "TEXT", CtyColumnType(cty.Number), false},
+		// Unknown types can't be checked
+		{Postgres{}, "tsvector", CtyColumnType(cty.Number), true},
+	}
+
+	for _, tt := range tests {
+		if got := CompatibleType(tt.dialect, tt.dbType, tt.t, false); got != tt.want {
+			t.Errorf("%s %s with %s: expected %t", tt.dialect.Name(), tt.dbType, tt.t.Kind, tt.want)
+		}
+	}
+}
+
+func TestDialectValue(t *testing.T) {
+	amount, _ := cty.ParseNumberVal("115792089237316195423570985008687907853269984665640564039457584007913129639935")
+
+	v, err := Postgres{}.Value(amount, KindNumber, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != "115792089237316195423570985008687907853269984665640564039457584007913129639935" {
+		t.Errorf("expected full precision integer, got %v", v)
+	}
+
+	v, err = ClickHouse{}.Value(cty.NumberFloatVal(1.5), KindNumber, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != 1.5 {
+		t.Errorf("expected float64, got %v", v)
+	}
+
+	// JSON values are JSON text, also in the String columns of ClickHouse
+	v, err = ClickHouse{}.Value(cty.StringVal("gm"), KindJSON, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v != `"gm"` {
+		t.Errorf("expected JSON text, got %v", v)
+	}
+
+	if _, err := NewDialect("oracle"); err == nil {
+		t.Error("expected unknown dialect error")
+	}
+}
+
+func TestClickHouseQuote(t *testing.T) {
+	tests := map[string]string{
+		"swaps":    "`swaps`",
+		"a`b":      "`a\\`b`",
+		`a\b`:      "`a\\\\b`",
+		"a\\`; --": "`a\\\\\\`; --`",
+	}
+
+	for name, want := range tests {
+		if got := (ClickHouse{}).Quote(name); got != want {
+			t.Errorf("quoting %q: expected %s, got %s", name, want, got)
+		}
+	}
+}
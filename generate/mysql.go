@@ -0,0 +1,96 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// MySQL is the dialect of MySQL and MariaDB.
+type MySQL struct{}
+
+func (MySQL) Name() string {
+	return "mysql"
+}
+
+func (MySQL) Quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// ColumnType returns the column type of the kind. MySQL has no unbounded decimals, so numbers
+// have 47 integer and 18 fractional digits, which is enough for amounts in wei. Text is
+// VARCHAR(255), because TEXT columns can't be keys: annotate longer strings as `TEXT`.
+func (MySQL) ColumnType(k Kind, exact bool) string {
+	switch k {
+	case KindInteger:
+		return "BIGINT"
+	case KindText:
+		return "VARCHAR(255)"
+	case KindBool:
+		return "BOOLEAN"
+	case KindTimestamp:
+		return "DATETIME(6)"
+	case KindJSON:
+		return "JSON"
+	}
+
+	return "DECIMAL(65, 18)"
+}
+
+func (MySQL) Value(v cty.Value, k Kind, exact bool) (any, error) {
+	return kindValue(v, k, exact)
+}
+
+func (MySQL) ColumnsSQL(table string) (string, []any) {
+	return "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?",
+		[]any{table}
+}
+
+func (m MySQL) CreateTableSQL(table string, cols map[string]ColumnType, keys []string, exact bool) string {
+	defs := append([]string{"id BIGINT AUTO_INCREMENT PRIMARY KEY"}, columnsDDL(m, cols, exact)...)
+
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n);", m.Quote(table), strings.Join(defs, ",\n\t"))
+}
+
+// UniqueKeySQL creates the unique index. MySQL has no IF NOT EXISTS for indexes, so
+// it fails with ER_DUP_KEYNAME if the index exists.
+func (m MySQL) UniqueKeySQL(table string, keys []string) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s);", m.Quote(keyIndexName(table, keys)), m.Quote(table), keysSQL(m, keys))
+}
+
+func (m MySQL) DropTableSQL(table string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;", m.Quote(table))
+}
+
+func (m MySQL) AddColumnSQL(table, column string, t ColumnType, exact bool) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", m.Quote(table), m.Quote(column), TypeSQL(m, t, exact))
+}
+
+func (m MySQL) InsertSQL(table string, columns []string, rows int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) %s", m.Quote(table), strings.Join(quoteAll(m, columns), ", "),
+		valuesSQL(len(columns), rows, func(int) string { return "?" }))
+}
+
+// UpsertSQL updates existing rows with ON DUPLICATE KEY UPDATE, which uses the primary key
+// or any unique index of the table, so keys only determine which columns are not updated.
+func (m MySQL) UpsertSQL(table string, columns, keys []string, rows int) string {
+	update := updateColumns(columns, keys)
+	if len(update) == 0 {
+		// Assigning a key to itself makes duplicates a no-op
+		update = keys[:1]
+	}
+
+	set := make([]string, len(update))
+	for i, c := range update {
+		set[i] = fmt.Sprintf("%s = VALUES(%s)", m.Quote(c), m.Quote(c))
+	}
+
+	return fmt.Sprintf("%s ON DUPLICATE KEY UPDATE %s", m.InsertSQL(table, columns, rows), strings.Join(set, ", "))
+}
+
+// BulkLoadSQL is empty, rows are loaded with multi-row inserts. LOAD DATA needs local_infile,
+// which is disabled by default.
+func (MySQL) BulkLoadSQL(table string, columns, keys []string) string {
+	return ""
+}
@@ -0,0 +1,115 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// Postgres is the dialect of PostgreSQL.
+type Postgres struct{}
+
+func (Postgres) Name() string {
+	return "postgres"
+}
+
+// Quote quotes the lowercased name. Unquoted identifiers are folded to lowercase by Postgres,
+// so this keeps the names of existing tables and columns, and allows reserved words like `from`.
+func (Postgres) Quote(name string) string {
+	return `"` + strings.ReplaceAll(strings.ToLower(name), `"`, `""`) + `"`
+}
+
+func (Postgres) ColumnType(k Kind, exact bool) string {
+	switch k {
+	case KindInteger:
+		return "BIGINT"
+	case KindText:
+		return "TEXT"
+	case KindBool:
+		return "BOOLEAN"
+	case KindTimestamp:
+		return "TIMESTAMPTZ"
+	case KindJSON:
+		return "JSONB"
+	}
+
+	return "NUMERIC"
+}
+
+func (Postgres) Value(v cty.Value, k Kind, exact bool) (any, error) {
+	return kindValue(v, k, exact)
+}
+
+// ColumnsSQL selects the columns from the information schema. The name is lowercased
+// like Quote does.
+func (Postgres) ColumnsSQL(table string) (string, []any) {
+	return "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1",
+		[]any{strings.ToLower(table)}
+}
+
+func (p Postgres) CreateTableSQL(table string, cols map[string]ColumnType, keys []string, exact bool) string {
+	defs := append([]string{"id SERIAL PRIMARY KEY"}, columnsDDL(p, cols, exact)...)
+
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n);", p.Quote(table), strings.Join(defs, ",\n\t"))
+}
+
+// UniqueKeySQL creates the unique index if it doesn't exist yet.
+func (p Postgres) UniqueKeySQL(table string, keys []string) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s);", p.Quote(keyIndexName(table, keys)), p.Quote(table), keysSQL(p, keys))
+}
+
+func (p Postgres) DropTableSQL(table string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;", p.Quote(table))
+}
+
+func (p Postgres) AddColumnSQL(table, column string, t ColumnType, exact bool) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", p.Quote(table), p.Quote(column), TypeSQL(p, t, exact))
+}
+
+func (p Postgres) InsertSQL(table string, columns []string, rows int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) %s", p.Quote(table), strings.Join(quoteAll(p, columns), ", "),
+		valuesSQL(len(columns), rows, func(i int) string { return fmt.Sprintf("$%d", i) }))
+}
+
+func (p Postgres) UpsertSQL(table string, columns, keys []string, rows int) string {
+	update := updateColumns(columns, keys)
+	if len(update) == 0 {
+		return fmt.Sprintf("%s ON CONFLICT (%s) DO NOTHING", p.InsertSQL(table, columns, rows), strings.Join(quoteAll(p, keys), ", "))
+	}
+
+	set := make([]string, len(update))
+	for i, c := range update {
+		set[i] = fmt.Sprintf("%s = EXCLUDED.%s", p.Quote(c), p.Quote(c))
+	}
+
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", p.InsertSQL(table, columns, rows),
+		strings.Join(quoteAll(p, keys), ", "), strings.Join(set, ", "))
+}
+
+// BulkLoadSQL returns a COPY statement, which lib/pq executes as a bulk load in a transaction.
+// COPY can't update existing rows, so rows with keys are upserted with multi-row inserts.
+func (p Postgres) BulkLoadSQL(table string, columns, keys []string) string {
+	if len(keys) > 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("COPY %s (%s) FROM STDIN", p.Quote(table), strings.Join(quoteAll(p, columns), ", "))
+}
+
+// updateColumns returns the columns that are not keys, which are updated by an upsert.
+func updateColumns(columns, keys []string) []string {
+	isKey := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		isKey[k] = true
+	}
+
+	var update []string
+	for _, c := range columns {
+		if !isKey[c] {
+			update = append(update, c)
+		}
+	}
+
+	return update
+}
@@ -0,0 +1,116 @@
+package generate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// SQLite is the dialect of SQLite database files.
+type SQLite struct{}
+
+func (SQLite) Name() string {
+	return "sqlite"
+}
+
+func (SQLite) Quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ColumnType returns the SQLite column type of the kind. Numbers are NUMERIC, unless exact
+// is set: integers that don't fit in 64 bits would be converted to REAL, so then they're
+// stored as TEXT. Timestamps are text, which the driver reads as times.
+func (SQLite) ColumnType(k Kind, exact bool) string {
+	switch k {
+	case KindNumber:
+		if exact {
+			return "TEXT"
+		}
+
+		return "NUMERIC"
+	case KindInteger:
+		return "INTEGER"
+	case KindBool:
+		return "BOOLEAN"
+	case KindTimestamp:
+		return "TIMESTAMP"
+	default:
+		return "TEXT"
+	}
+}
+
+// Value converts a value to a SQLite argument. Integers that fit in 64 bits are integers,
+// other numbers are floats, unless exact is set, then all numbers are text. Objects and
+// tuples are JSON.
+func (SQLite) Value(v cty.Value, k Kind, exact bool) (any, error) {
+	if v == cty.NilVal || v.IsNull() || !v.IsKnown() {
+		return nil, nil
+	}
+
+	if v.Type() == cty.Number && k == KindNumber && !exact {
+		f := v.AsBigFloat()
+		if f.IsInt() {
+			if i, _ := f.Int(nil); i.IsInt64() {
+				return i.Int64(), nil
+			}
+		}
+
+		f64, _ := f.Float64()
+		return f64, nil
+	}
+
+	return kindValue(v, k, exact)
+}
+
+func (SQLite) ColumnsSQL(table string) (string, []any) {
+	return "SELECT name, type FROM pragma_table_info(?)", []any{table}
+}
+
+func (s SQLite) CreateTableSQL(table string, cols map[string]ColumnType, keys []string, exact bool) string {
+	defs := append([]string{"id INTEGER PRIMARY KEY AUTOINCREMENT"}, columnsDDL(s, cols, exact)...)
+
+	return fmt.Sprintf("CREATE TABLE %s (\n\t%s\n);", s.Quote(table), strings.Join(defs, ",\n\t"))
+}
+
+// UniqueKeySQL creates the unique index if it doesn't exist yet.
+func (s SQLite) UniqueKeySQL(table string, keys []string) string {
+	return fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s (%s);", s.Quote(keyIndexName(table, keys)), s.Quote(table), keysSQL(s, keys))
+}
+
+func (s SQLite) DropTableSQL(table string) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;", s.Quote(table))
+}
+
+func (s SQLite) AddColumnSQL(table, column string, t ColumnType, exact bool) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", s.Quote(table), s.Quote(column), TypeSQL(s, t, exact))
+}
+
+func (s SQLite) InsertSQL(table string, columns []string, rows int) string {
+	return fmt.Sprintf("INSERT INTO %s (%s) %s", s.Quote(table), strings.Join(quoteAll(s, columns), ", "),
+		valuesSQL(len(columns), rows, func(int) string { return "?" }))
+}
+
+func (s SQLite) UpsertSQL(table string, columns, keys []string, rows int) string {
+	update := updateColumns(columns, keys)
+	if len(update) == 0 {
+		return fmt.Sprintf("%s ON CONFLICT (%s) DO NOTHING", s.InsertSQL(table, columns, rows), keysSQL(s, keys))
+	}
+
+	set := make([]string, len(update))
+	for i, c := range update {
+		set[i] = fmt.Sprintf("%s = excluded.%s", s.Quote(c), s.Quote(c))
+	}
+
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", s.InsertSQL(table, columns, rows), keysSQL(s, keys), strings.Join(set, ", "))
+}
+
+// BulkLoadSQL returns a single row insert (or upsert): executing a prepared statement per row
+// in a transaction is the fastest way to load rows into SQLite.
+func (s SQLite) BulkLoadSQL(table string, columns, keys []string) string {
+	if len(keys) > 0 {
+		return s.UpsertSQL(table, columns, keys, 1)
+	}
+
+	return s.InsertSQL(table, columns, 1)
+}
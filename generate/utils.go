@@ -4,7 +4,6 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/zclconf/go-cty/cty"
 )
 
 type ABIType string
@@ -16,39 +15,6 @@ const (
 	Address ABIType = "address"
 )
 
-var (
-	sqlTypes = map[ABIType]string{
-		Uint256: "NUMERIC",
-		String:  "VARCHAR(55)", // strings are used for things like chain names
-		Address: "VARCHAR(42)", // addresses should be stored as strings without 0x prefix
-	}
-)
-
-var (
-	ctySqlTypes = map[cty.Type]string{
-		cty.Number: "NUMERIC",
-		cty.String: "VARCHAR(66)", // length of a hash
-	}
-)
-
-func ABIToSQLType(abiType ABIType) string {
-	if sqlType, ok := sqlTypes[abiType]; ok {
-		return sqlType
-	}
-
-	// By default, return BIGINT
-	return "NUMERIC"
-}
-
-func CtyToSQLType(t cty.Type) string {
-	if sqlType, ok := ctySqlTypes[t]; ok {
-		return sqlType
-	}
-
-	// By default, return BIGINT
-	return "NUMERIC"
-}
-
 func ABIToGoType(abiType ABIType, val string) any {
 	switch abiType {
 	case Uint256:
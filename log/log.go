@@ -2,16 +2,33 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// logOutput is where all loggers write to.
+var logOutput = struct {
+	sync.RWMutex
+	w io.Writer
+}{w: os.Stdout}
+
+// SetOutput changes the output of all loggers, including the ones that were already created.
+// This is used to keep stdout free for the results.
+func SetOutput(w io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+
+	logOutput.w = w
+}
+
 func NewLogger(module string) zerolog.Logger {
 	zerolog.TimeFieldFormat = time.RFC3339Nano
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: "15:04:05.000"}
+	output := zerolog.ConsoleWriter{Out: redactWriter{}, TimeFormat: "15:04:05.000"}
 	output.FormatMessage = func(i interface{}) string {
 		return fmt.Sprintf("%-45s", fmt.Sprintf("[%s] %s", module, i))
 	}
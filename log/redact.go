@@ -0,0 +1,81 @@
+package log
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// redacted replaces secrets in the log output.
+const redacted = "*****"
+
+// secrets holds every value that should never show up in the logs,
+// like passwords and API keys that were interpolated into the config.
+var secrets = struct {
+	sync.RWMutex
+	values map[string]struct{}
+}{values: make(map[string]struct{})}
+
+// AddSecret registers s as a secret, so it gets redacted in all log output.
+func AddSecret(s string) {
+	// Very short values would redact too much unrelated output
+	if len(s) < 4 {
+		return
+	}
+
+	secrets.Lock()
+	defer secrets.Unlock()
+
+	secrets.values[s] = struct{}{}
+}
+
+// Redact replaces all registered secrets in s.
+func Redact(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+
+	for secret := range secrets.values {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+
+	return s
+}
+
+// RedactURL hides the parts of a URL that usually contain credentials: the user info,
+// the path (e.g. an API key like in /v2/<key>) and the query parameters.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return Redact(raw)
+	}
+
+	redactedURL := u.Scheme + "://"
+	if u.User != nil {
+		redactedURL += redacted + "@"
+	}
+
+	redactedURL += u.Host
+	if u.Path != "" && u.Path != "/" {
+		redactedURL += "/" + redacted
+	}
+
+	if u.RawQuery != "" {
+		redactedURL += "?" + redacted
+	}
+
+	return redactedURL
+}
+
+// redactWriter redacts the secrets in everything written to the log output.
+type redactWriter struct{}
+
+func (w redactWriter) Write(p []byte) (int, error) {
+	logOutput.RLock()
+	defer logOutput.RUnlock()
+
+	if _, err := logOutput.w.Write([]byte(Redact(string(p)))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,9 +17,11 @@ import (
 	"github.com/chainbound/apollo/chainservice"
 	"github.com/chainbound/apollo/db"
 	"github.com/chainbound/apollo/dsl"
+	"github.com/chainbound/apollo/generate"
 	"github.com/chainbound/apollo/log"
 	"github.com/chainbound/apollo/output"
 	"github.com/chainbound/apollo/types"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/rs/zerolog"
 
 	"github.com/urfave/cli/v2"
@@ -30,6 +35,9 @@ var schema []byte
 
 var logger zerolog.Logger
 
+// stateSaveInterval is how often the state of stateful queries is persisted while running.
+const stateSaveInterval = 10 * time.Second
+
 func main() {
 	var opts types.ApolloOpts
 	logger = log.NewLogger("main")
@@ -50,6 +58,32 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:  "validate",
+				Usage: "Check the schema without running it",
+				Flags: BuildFlags(&types.ApolloOpts{}),
+				Action: func(c *cli.Context) error {
+					opts, err := commandOpts(c)
+					if err != nil {
+						return err
+					}
+
+					return Validate(opts)
+				},
+			},
+			{
+				Name:  "plan",
+				Usage: "Print the resolved block ranges, estimated requests and outputs of the schema without running it",
+				Flags: BuildFlags(&types.ApolloOpts{}),
+				Action: func(c *cli.Context) error {
+					opts, err := commandOpts(c)
+					if err != nil {
+						return err
+					}
+
+					return Plan(opts)
+				},
+			},
 		},
 		Action: func(c *cli.Context) error {
 			err := Run(opts)
@@ -60,10 +94,27 @@ func main() {
 	err := app.Run(os.Args)
 
 	if err != nil {
+		// Schema errors are rendered with a snippet of their source
+		var diagErr *dsl.DiagnosticsError
+		if errors.As(err, &diagErr) {
+			fmt.Fprintln(os.Stderr, dsl.FormatError(err, isTerminal(os.Stderr)))
+			os.Exit(1)
+		}
+
 		logger.Fatal().Err(err).Msg("running app")
 	}
 }
 
+// isTerminal returns true if f is a terminal, so we can use colors.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
 func Init() error {
 	p, err := os.UserConfigDir()
 	if err != nil {
@@ -95,28 +146,26 @@ func Init() error {
 }
 
 func Run(opts types.ApolloOpts) error {
+	switch opts.StdoutFormat {
+	case "text":
+	case "json":
+		// Keep stdout for the results, so it can be piped into other tools
+		log.SetOutput(os.Stderr)
+	default:
+		return fmt.Errorf("unknown stdout format %s, expected text or json", opts.StdoutFormat)
+	}
+
+	if opts.DbBatchSize < 1 || opts.DbFlushInterval <= 0 {
+		return fmt.Errorf("invalid db batch size %d or flush interval %s", opts.DbBatchSize, opts.DbFlushInterval)
+	}
+
 	lvl := zerolog.Level(int8(opts.LogLevel))
 	logger.Info().Int("log_level", int(lvl)).Msg("logger")
 	zerolog.SetGlobalLevel(lvl)
 
 	var pdb *db.DB
 
-	confDir, err := ConfigDir()
-	if err != nil {
-		return err
-	}
-
-	confPath, err := ConfigPath()
-	if err != nil {
-		return err
-	}
-
-	cfg, err := NewConfig(confPath)
-	if err != nil {
-		return err
-	}
-
-	schema, err := dsl.NewSchema(confDir)
+	cfg, schema, err := loadSchema(opts)
 	if err != nil {
 		return err
 	}
@@ -129,31 +178,210 @@ func Run(opts types.ApolloOpts) error {
 	cfg.DbSettings.DefaultTimeout = time.Second * 20
 
 	if opts.Db {
-		pdb, err = db.NewDB(cfg.DbSettings).Connect()
-		if err != nil {
+		pdb = db.NewDB(cfg.DbSettings)
+		pdb.BatchSize = opts.DbBatchSize
+		pdb.FlushInterval = opts.DbFlushInterval
+		pdb.FlushOnly = opts.StateDir != ""
+
+		if pdb, err = pdb.Connect(); err != nil {
 			return err
 		}
 	}
 
+	if opts.StateDir != "" {
+		if err := schema.LoadState(opts.StateDir); err != nil {
+			return fmt.Errorf("loading state: %w", err)
+		}
+	}
+
 	defaultTimeout := time.Second * 30
 
-	service := chainservice.NewChainService(defaultTimeout, opts.RateLimit, opts.LogParts, cfg.Rpc)
-	setupCloseHandler(service)
+	service := chainservice.NewChainService(defaultTimeout, opts.RateLimit, opts.LogParts, cfg.Chains())
 
 	out := output.NewOutputHandler()
 
+	if opts.Exact {
+		out = out.WithExact()
+	}
+
 	if opts.Db {
 		out = out.WithDB(pdb)
 	}
 
 	if opts.Csv {
-		out = out.WithCsv(output.NewCsvHandler())
+		out = out.WithCsv(output.NewCsvHandler(opts.OutputDir))
+	}
+
+	if opts.Json {
+		out = out.WithJson(output.NewJsonHandler(opts.OutputDir))
+	}
+
+	if opts.Parquet {
+		parquet, err := output.NewParquetHandler(opts.OutputDir, output.ParquetOptions{
+			RowGroupSize: opts.ParquetRowGroupSize,
+			Compression:  opts.ParquetCompression,
+			MaxRows:      opts.ParquetMaxRows,
+			MaxBlocks:    opts.ParquetMaxBlocks,
+		})
+		if err != nil {
+			return err
+		}
+
+		// Columns that reference ABI values get their integer types
+		for _, q := range schema.QuerySchemas {
+			parquet.SetAbiTypes(q.Name, q.ColumnAbiTypes())
+		}
+
+		for _, d := range schema.DerivedSchemas {
+			parquet.SetAbiTypes(d.Name, d.ColumnAbiTypes())
+		}
+
+		out = out.WithParquet(parquet)
+	}
+
+	if opts.SQLitePath != "" {
+		sqlite := db.NewSQLite(opts.SQLitePath)
+		sqlite.BatchSize = opts.DbBatchSize
+		sqlite.FlushInterval = opts.DbFlushInterval
+		sqlite.FlushOnly = opts.StateDir != ""
+
+		if sqlite, err = sqlite.Connect(); err != nil {
+			return err
+		}
+
+		out = out.WithSQLite(sqlite)
+	}
+
+	if opts.Webhook {
+		settings := cfg.Webhook
+		if settings.QueueDir == "" {
+			settings.QueueDir = filepath.Join(opts.OutputDir, "webhook-queue")
+		}
+
+		for _, q := range schema.QuerySchemas {
+			if settings.URLFor(q.Name) == "" {
+				logger.Warn().Str("query", q.Name).Msg("query has no webhook url, its results are not sent")
+			}
+		}
+
+		webhook, err := output.NewWebhookHandler(settings)
+		if err != nil {
+			return err
+		}
+
+		out = out.WithWebhook(webhook)
+	}
+
+	if opts.StreamAddr != "" {
+		stream, err := output.NewStreamServer(output.StreamOptions{
+			Addr:        opts.StreamAddr,
+			Replay:      opts.StreamReplay,
+			SlowClients: opts.StreamSlowClients,
+		})
+		if err != nil {
+			return err
+		}
+
+		out = out.WithStream(stream)
+	}
+
+	// Existing tables are kept, unless the query replaces them. Queries with keys are upserted.
+	for _, q := range schema.QuerySchemas {
+		keys, err := q.Keys()
+		if err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+
+		out.SetTableOptions(q.Name, db.TableOptions{
+			Mode:  q.TableMode(),
+			Keys:  keys,
+			Types: columnTypes(q.ColumnAbiTypes(), q.TypeAnnotations()),
+		})
+	}
+
+	for _, d := range schema.DerivedSchemas {
+		keys, err := d.Keys()
+		if err != nil {
+			return fmt.Errorf("derived query %s: %w", d.Name, err)
+		}
+
+		out.SetTableOptions(d.Name, db.TableOptions{
+			Mode:  d.TableMode(),
+			Keys:  keys,
+			Types: columnTypes(d.ColumnAbiTypes(), d.TypeAnnotations()),
+		})
 	}
 
-	if opts.Stdout {
+	if opts.StdoutFormat == "json" {
+		out = out.WithStdOutJSON()
+	} else if opts.Stdout {
 		out = out.WithStdOut()
 	}
 
+	// stateMu makes sure the state isn't saved while a result is being handled
+	var stateMu sync.Mutex
+	saveState := func() {
+		if opts.StateDir == "" {
+			return
+		}
+
+		// No result is handled until the state is saved, and the pending rows are committed
+		// first, so the outputs contain exactly the results up to the checkpoint of the state
+		stateMu.Lock()
+		defer stateMu.Unlock()
+
+		if err := out.Flush(); err != nil {
+			logger.Error().Err(err).Msg("flushing output, not saving state")
+			return
+		}
+
+		if err := schema.SaveState(opts.StateDir); err != nil {
+			logger.Error().Err(err).Msg("saving state")
+		}
+	}
+
+	// Files like Parquet are unreadable if they're not closed properly
+	closeOutput := func() {
+		if err := out.Close(); err != nil {
+			logger.Error().Err(err).Msg("closing output")
+		}
+	}
+	defer closeOutput()
+
+	setupCloseHandler(service, func() {
+		saveState()
+		closeOutput()
+	})
+
+	// Queries with an aggregate block output their windows instead of every result
+	aggregators := make(map[string]*dsl.Aggregator)
+	for _, q := range schema.QuerySchemas {
+		if q.Aggregate == nil {
+			continue
+		}
+
+		// Historical results are in chain order, like in the chain service
+		aggregators[q.Name], err = dsl.NewAggregator(q, opts.Realtime, !opts.Unordered || q.HasState())
+		if err != nil {
+			return fmt.Errorf("query %s: %w", q.Name, err)
+		}
+	}
+
+	// Derived queries join the save results of their sources
+	var derived []*dsl.Joiner
+	joiners := make(map[string][]*dsl.Joiner)
+	for _, d := range schema.DerivedSchemas {
+		j, err := dsl.NewJoiner(d, opts.Realtime, !opts.Unordered)
+		if err != nil {
+			return err
+		}
+
+		derived = append(derived, j)
+		for _, source := range j.Sources() {
+			joiners[source] = append(joiners[source], j)
+		}
+	}
+
 	// First check if there are any methods to be called, it might just be events
 	chainResults := make(chan types.CallResult)
 
@@ -170,12 +398,9 @@ func Run(opts types.ApolloOpts) error {
 		return nil
 	}()
 
-	for res := range chainResults {
-		if res.Err != nil {
-			logger.Warn().Str("chain", string(res.Chain)).Msg(res.Err.Error())
-			continue
-		}
-
+	// handleResult evaluates the result and writes it to the outputs. It runs with stateMu held,
+	// so the state is never saved between updating it and handling its result.
+	handleResult := func(res types.CallResult) error {
 		save, err := schema.EvalSave(service, res)
 		if err != nil {
 			return fmt.Errorf("evaluating save block: %w", err)
@@ -183,26 +408,124 @@ func Run(opts types.ApolloOpts) error {
 
 		// Result got filtered out
 		if save == nil {
+			return nil
+		}
+
+		for _, j := range joiners[res.QueryName] {
+			rows, err := j.Add(res.QueryName, res, save)
+			if err != nil {
+				return fmt.Errorf("derived query %s: %w", j.Name(), err)
+			}
+
+			for _, row := range rows {
+				if err := out.HandleResult(j.Name(), res.BlockNumber, row); err != nil {
+					return fmt.Errorf("handling result: %w", err)
+				}
+			}
+		}
+
+		if agg, ok := aggregators[res.QueryName]; ok {
+			windows, err := agg.Add(res, save)
+			if err != nil {
+				return fmt.Errorf("aggregating result: %w", err)
+			}
+
+			for _, w := range windows {
+				if err := out.HandleResult(res.QueryName, w.Block, w.Values); err != nil {
+					return fmt.Errorf("handling result: %w", err)
+				}
+			}
+
+			return nil
+		}
+
+		if err := out.HandleResult(res.QueryName, res.BlockNumber, save); err != nil {
+			return fmt.Errorf("handling result: %w", err)
+		}
+
+		return nil
+	}
+
+	lastStateSave := time.Now()
+	for res := range chainResults {
+		if res.Err != nil {
+			logger.Warn().Str("chain", string(res.Chain)).Msg(res.Err.Error())
 			continue
 		}
 
-		err = out.HandleResult(res.QueryName, save)
+		// The state is saved before evaluating the next result, when the previous
+		// results have been handled by the outputs
+		if time.Since(lastStateSave) > stateSaveInterval {
+			saveState()
+			lastStateSave = time.Now()
+		}
+
+		stateMu.Lock()
+		err := handleResult(res)
+		stateMu.Unlock()
 		if err != nil {
-			return fmt.Errorf("handling result: %w", err)
+			return err
+		}
+	}
+
+	for _, j := range derived {
+		if j.Late > 0 {
+			logger.Warn().Str("query", j.Name()).Int64("late_results", j.Late).Msg("dropped results that arrived after their join window")
 		}
 	}
 
+	// Emit the windows that are still open
+	flushWindows := func() error {
+		for name, agg := range aggregators {
+			if agg.Late > 0 {
+				logger.Warn().Str("query", name).Int64("late_results", agg.Late).Msg("dropped results that arrived after their window was closed")
+			}
+
+			for _, w := range agg.Flush() {
+				if err := out.HandleResult(name, w.Block, w.Values); err != nil {
+					return fmt.Errorf("handling result: %w", err)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	stateMu.Lock()
+	err = flushWindows()
+	stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	saveState()
 	service.DumpMetrics()
 
 	return nil
 }
 
-func setupCloseHandler(svc *chainservice.ChainService) {
-	c := make(chan os.Signal)
+// columnTypes returns the database column types of the columns with an ABI type or a type annotation.
+// Annotations take precedence.
+func columnTypes(abiTypes map[string]abi.Type, annotations map[string]string) map[string]generate.ColumnType {
+	colTypes := make(map[string]generate.ColumnType, len(abiTypes)+len(annotations))
+	for col, t := range abiTypes {
+		colTypes[col] = generate.AbiColumnType(t)
+	}
+
+	for col, t := range annotations {
+		colTypes[col] = generate.ParseColumnType(t)
+	}
+
+	return colTypes
+}
+
+func setupCloseHandler(svc *chainservice.ChainService, onExit func()) {
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		logger.Warn().Msg("ctrl+c pressed, exiting...")
+		onExit()
 		svc.DumpMetrics()
 		os.Exit(0)
 	}()
@@ -0,0 +1,170 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// maxSafeInteger is the largest integer that can be represented exactly by a float64,
+// and thus by most JSON parsers.
+const maxSafeInteger = 1<<53 - 1
+
+type JsonHandler struct {
+	// dir is the directory the NDJSON files are written to
+	dir string
+	// files maps queries to their buffered files
+	files map[string]*bufio.Writer
+	// handles are the open files of the queries, which are closed on Close
+	handles map[string]*os.File
+}
+
+func NewJsonHandler(dir string) *JsonHandler {
+	return &JsonHandler{
+		dir:     dir,
+		files:   make(map[string]*bufio.Writer),
+		handles: make(map[string]*os.File),
+	}
+}
+
+// AddJson creates the <name>.ndjson file. Existing files are truncated, like CSV files.
+func (j *JsonHandler) AddJson(name string) error {
+	if j.dir != "" {
+		if err := os.MkdirAll(j.dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(j.dir, name+".ndjson"))
+	if err != nil {
+		return err
+	}
+
+	j.files[name] = bufio.NewWriter(f)
+	j.handles[name] = f
+
+	return nil
+}
+
+// Write writes the result as a single line of JSON to the file of the query.
+func (j *JsonHandler) Write(name string, res map[string]cty.Value, exact bool) error {
+	w, ok := j.files[name]
+	if !ok {
+		if err := j.AddJson(name); err != nil {
+			return err
+		}
+
+		w = j.files[name]
+	}
+
+	line, err := json.Marshal(convertCtyMapJSON(res, exact))
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// Close flushes and closes the files. Every file is closed, even if one of them fails.
+func (j *JsonHandler) Close() error {
+	var firstErr error
+	for name, f := range j.handles {
+		if err := j.files[name].Flush(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	j.files = make(map[string]*bufio.Writer)
+	j.handles = make(map[string]*os.File)
+
+	return firstErr
+}
+
+// convertCtyMapJSON converts the results to values that keep their types in JSON.
+func convertCtyMapJSON(m map[string]cty.Value, exact bool) map[string]any {
+	new := make(map[string]any, len(m))
+	for k, v := range m {
+		new[k] = convertCtyJSON(v, exact)
+	}
+
+	return new
+}
+
+// convertCtyJSON converts a cty value to a value that can be marshalled to JSON. Integers
+// are numbers if they can be represented exactly, otherwise strings. Other numbers are
+// rounded to float64, unless exact is set, then they are strings with full precision.
+// Objects and maps become JSON objects, and lists, sets and tuples arrays.
+func convertCtyJSON(v cty.Value, exact bool) any {
+	if v.IsNull() || !v.IsKnown() {
+		return nil
+	}
+
+	t := v.Type()
+	switch {
+	case t == cty.Number:
+		return convertNumberJSON(v.AsBigFloat(), exact)
+	case t == cty.String:
+		return v.AsString()
+	case t == cty.Bool:
+		return v.True()
+	case t.IsObjectType() || t.IsMapType():
+		obj := make(map[string]any, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			k, val := it.Element()
+			obj[k.AsString()] = convertCtyJSON(val, exact)
+		}
+
+		return obj
+	case t.IsListType() || t.IsSetType() || t.IsTupleType():
+		arr := make([]any, 0, v.LengthInt())
+		for it := v.ElementIterator(); it.Next(); {
+			_, val := it.Element()
+			arr = append(arr, convertCtyJSON(val, exact))
+		}
+
+		return arr
+	}
+
+	return nil
+}
+
+func convertNumberJSON(f *big.Float, exact bool) any {
+	if f.IsInt() {
+		i, _ := f.Int(nil)
+		if i.IsInt64() && i.Int64() <= maxSafeInteger && i.Int64() >= -maxSafeInteger {
+			return i.Int64()
+		}
+
+		return i.String()
+	}
+
+	if exact {
+		return formatNumber(f, exact)
+	}
+
+	f64, _ := f.Float64()
+	return f64
+}
+
+// formatValue formats a value that is not a number or string for the text outputs,
+// as JSON.
+func formatValue(v cty.Value, exact bool) string {
+	b, err := json.Marshal(convertCtyJSON(v, exact))
+	if err != nil {
+		return v.GoString()
+	}
+
+	return string(b)
+}
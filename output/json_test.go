@@ -0,0 +1,161 @@
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainbound/apollo/db"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func TestJsonHandler(t *testing.T) {
+	dir := t.TempDir()
+	j := NewJsonHandler(dir)
+
+	amount, _ := new(big.Int).SetString("123456789012345678901234567890", 10)
+	res := map[string]cty.Value{
+		"block":  cty.NumberIntVal(15000000),
+		"amount": cty.NumberVal(new(big.Float).SetInt(amount)),
+		"price":  cty.NumberFloatVal(1234.5),
+		"mint":   cty.True,
+		"pair":   cty.StringVal("0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc"),
+		"position": cty.ObjectVal(map[string]cty.Value{
+			"ticks": cty.TupleVal([]cty.Value{cty.NumberIntVal(-10), cty.NumberIntVal(10)}),
+		}),
+		"empty": cty.NullVal(cty.String),
+	}
+
+	if err := j.Write("swaps", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.Write("swaps", res, false); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "swaps.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	line := `{"amount":"123456789012345678901234567890","block":15000000,"empty":null,"mint":true,` +
+		`"pair":"0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc","position":{"ticks":[-10,10]},"price":1234.5}` + "\n"
+	if string(b) != line+line {
+		t.Fatalf("unexpected output:\n%s", b)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConvertNumberJSON(t *testing.T) {
+	f, _, _ := big.ParseFloat("0.1234567890123456789", 10, 256, big.ToNearestEven)
+	if got := convertNumberJSON(f, true); got != "0.1234567890123456789" {
+		t.Fatalf("expected full precision string, got %v", got)
+	}
+
+	if got := convertNumberJSON(f, false); got != 0.12345678901234568 {
+		t.Fatalf("expected float64, got %v", got)
+	}
+}
+
+func TestDeduplicate(t *testing.T) {
+	dir := t.TempDir()
+	out := NewOutputHandler().WithJson(NewJsonHandler(dir))
+	out.SetTableOptions("transfers", db.TableOptions{Keys: []string{"tx_hash", "log_index"}})
+
+	results := []map[string]cty.Value{
+		{"tx_hash": cty.StringVal("0x01"), "log_index": cty.NumberIntVal(0), "value": cty.NumberIntVal(1)},
+		{"tx_hash": cty.StringVal("0x01"), "log_index": cty.NumberIntVal(1), "value": cty.NumberIntVal(2)},
+		// Rerun of the first result
+		{"tx_hash": cty.StringVal("0x01"), "log_index": cty.NumberIntVal(0), "value": cty.NumberIntVal(1)},
+	}
+
+	for _, res := range results {
+		if err := out.HandleResult("transfers", 1, res); err != nil {
+			t.Fatal(err)
+		}
+
+		// Queries without keys are not deduplicated
+		if err := out.HandleResult("swaps", 1, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]int{"transfers": 2, "swaps": 3} {
+		b, err := os.ReadFile(filepath.Join(dir, name+".ndjson"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if lines := strings.Count(string(b), "\n"); lines != expected {
+			t.Fatalf("expected %d %s, got %d", expected, name, lines)
+		}
+	}
+}
+
+func TestCloseFiles(t *testing.T) {
+	dir := t.TempDir()
+	j, c := NewJsonHandler(dir), NewCsvHandler(dir)
+	out := NewOutputHandler().WithJson(j).WithCsv(c)
+
+	res := map[string]cty.Value{"block": cty.NumberIntVal(1)}
+	if err := out.HandleResult("blocks", 1, res); err != nil {
+		t.Fatal(err)
+	}
+
+	handles := []*os.File{j.handles["blocks"], c.handles["blocks"]}
+
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range handles {
+		if _, err := f.Write([]byte("\n")); !errors.Is(err, os.ErrClosed) {
+			t.Fatalf("expected %s to be closed, got %v", f.Name(), err)
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "blocks.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "block\n1\n" {
+		t.Fatalf("unexpected csv %q", b)
+	}
+}
+
+func TestKeyWindow(t *testing.T) {
+	w := newKeyWindow(2)
+
+	for _, key := range []string{"a", "b"} {
+		if !w.add(key) {
+			t.Fatalf("expected %s to be new", key)
+		}
+	}
+
+	if w.add("a") {
+		t.Fatal("expected a to be a duplicate")
+	}
+
+	// c evicts the oldest key
+	if !w.add("c") || !w.add("a") || w.add("c") {
+		t.Fatal("expected a to be forgotten")
+	}
+
+	if len(w.keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(w.keys))
+	}
+}
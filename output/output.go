@@ -3,23 +3,50 @@ package output
 import (
 	"context"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/chainbound/apollo/db"
 	"github.com/chainbound/apollo/generate"
 	"github.com/chainbound/apollo/log"
 	"github.com/rs/zerolog"
 	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
+var ErrClosed = errors.New("output is closed")
+
 type OutputHandler struct {
 	stdout bool
-	csv    *CsvHandler
-	db     *db.DB
+	// stdoutJSON prints the results to stdout as JSON lines, instead of logging them
+	stdoutJSON bool
+	csv        *CsvHandler
+	json       *JsonHandler
+	parquet    *ParquetHandler
+	sqlite     *db.DB
+	db         *db.DB
+	webhook    *WebhookHandler
+	stream     *StreamServer
+	// exact makes numbers keep their full precision in the outputs
+	exact bool
 	// tables keeps track of which tables have been created
 	tables map[string]bool
+	// keys are the key columns of the queries that upsert. The file outputs skip
+	// recent results with keys they've already written, which are kept in seen.
+	keys   map[string][]string
+	seen   map[string]*keyWindow
 	logger zerolog.Logger
+
+	// mu makes sure results aren't written while the outputs are being closed
+	mu     sync.Mutex
+	closed bool
 }
 
 func NewOutputHandler() *OutputHandler {
@@ -30,6 +57,8 @@ func NewOutputHandler() *OutputHandler {
 	handler := &OutputHandler{
 		db:     defaultDB,
 		tables: make(map[string]bool),
+		keys:   make(map[string][]string),
+		seen:   make(map[string]*keyWindow),
 		logger: log.NewLogger("output"),
 	}
 
@@ -48,47 +77,258 @@ func (o *OutputHandler) WithStdOut() *OutputHandler {
 	return o
 }
 
+// WithStdOutJSON prints every result to stdout as a line of JSON, with the name of the query.
+// The logs should be written somewhere else.
+func (o *OutputHandler) WithStdOutJSON() *OutputHandler {
+	o.logger.Trace().Msg("running with json stdout output")
+	o.stdout = true
+	o.stdoutJSON = true
+	return o
+}
+
+func (o *OutputHandler) WithExact() *OutputHandler {
+	o.logger.Trace().Msg("running with exact numbers")
+	o.exact = true
+	return o
+}
+
 func (o *OutputHandler) WithCsv(csv *CsvHandler) *OutputHandler {
 	o.logger.Trace().Msg("running with csv output")
 	o.csv = csv
 	return o
 }
 
-func (o OutputHandler) LogMap(m map[string]cty.Value) {
+func (o *OutputHandler) WithJson(json *JsonHandler) *OutputHandler {
+	o.logger.Trace().Msg("running with json output")
+	o.json = json
+	return o
+}
+
+func (o *OutputHandler) WithParquet(parquet *ParquetHandler) *OutputHandler {
+	o.logger.Trace().Msg("running with parquet output")
+	o.parquet = parquet
+	return o
+}
+
+func (o *OutputHandler) WithSQLite(sqlite *db.DB) *OutputHandler {
+	o.logger.Trace().Str("path", sqlite.Settings.Name).Msg("running with sqlite output")
+	o.sqlite = sqlite
+	return o
+}
+
+func (o *OutputHandler) WithWebhook(webhook *WebhookHandler) *OutputHandler {
+	o.logger.Trace().Str("queue", webhook.settings.QueueDir).Msg("running with webhook output")
+	o.webhook = webhook
+	return o
+}
+
+func (o *OutputHandler) WithStream(stream *StreamServer) *OutputHandler {
+	o.logger.Trace().Str("addr", stream.Addr()).Msg("running with stream output")
+	o.stream = stream
+	return o
+}
+
+// SetTableOptions sets the options of the table of a query in the database outputs. If it has
+// keys, the file outputs deduplicate its results too.
+func (o *OutputHandler) SetTableOptions(name string, opts db.TableOptions) {
+	if len(opts.Keys) > 0 {
+		o.keys[name] = opts.Keys
+	}
+
+	if o.db != nil {
+		o.db.SetTableOptions(name, opts)
+	}
+
+	if o.sqlite != nil {
+		o.sqlite.SetTableOptions(name, opts)
+	}
+}
+
+// Flush commits the pending rows of the database outputs, and queues the pending webhook
+// batches. It's called before progress is saved, so that every result up to the checkpoint
+// is committed.
+func (o *OutputHandler) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+
+	if o.db != nil {
+		if err := o.db.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if o.sqlite != nil {
+		if err := o.sqlite.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if o.webhook != nil {
+		if err := o.webhook.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the outputs that need to be finalized, like the files and the pending
+// database rows. Results that are handled after closing return ErrClosed.
+func (o *OutputHandler) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil
+	}
+
+	o.closed = true
+
+	// Every output is closed, even if one of them fails
+	var firstErr error
+	if o.stream != nil {
+		if err := o.stream.Close(); err != nil {
+			firstErr = err
+		}
+	}
+
+	if o.parquet != nil {
+		if err := o.parquet.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if o.json != nil {
+		if err := o.json.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if o.csv != nil {
+		if err := o.csv.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if o.sqlite != nil {
+		if err := o.sqlite.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if o.db != nil {
+		if err := o.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if o.webhook != nil {
+		if err := o.webhook.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (o *OutputHandler) LogMap(m map[string]cty.Value) {
 	fmt.Println()
-	for k, v := range convertCtyMap(m) {
+	for k, v := range convertCtyMap(m, o.exact) {
 		o.logger.Info().Msg(fmt.Sprintf("%s: %s", k, v))
 	}
 }
 
-func convertCtyMap(m map[string]cty.Value) map[string]string {
+func convertCtyMap(m map[string]cty.Value, exact bool) map[string]string {
 	new := make(map[string]string)
 	for k, v := range m {
+		if v.IsNull() {
+			new[k] = ""
+			continue
+		}
+
 		switch v.Type() {
 		case cty.Number:
-			new[k] = v.AsBigFloat().String()
+			new[k] = formatNumber(v.AsBigFloat(), exact)
 
 		case cty.String:
 			new[k] = v.AsString()
+
+		case cty.Bool:
+			new[k] = strconv.FormatBool(v.True())
+
+		default:
+			new[k] = formatValue(v, exact)
 		}
 	}
 
 	return new
 }
 
+// formatNumber formats a number without exponent. Integers (like raw on-chain values)
+// are always written in full. Other numbers are rounded to float64 precision,
+// unless exact is set.
+func formatNumber(f *big.Float, exact bool) string {
+	if f.IsInt() {
+		i, _ := f.Int(nil)
+		return i.String()
+	}
+
+	if exact {
+		return f.Text('f', -1)
+	}
+
+	f64, _ := f.Float64()
+	return strconv.FormatFloat(f64, 'f', -1, 64)
+}
+
+// PrintJSON prints the result to stdout as a single line of JSON, like
+// {"query":"swaps","result":{"price":1234.5}}.
+func (o *OutputHandler) PrintJSON(name string, res map[string]cty.Value) error {
+	line, err := json.Marshal(struct {
+		Query  string         `json:"query"`
+		Result map[string]any `json:"result"`
+	}{name, convertCtyMapJSON(res, o.exact)})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Println(string(line))
+	return err
+}
+
 // HandleResult takes a map of the final results (from the `save` block), and writes
 // it to the preferred output options. If DB output is selected, it will create
 // the table if it doesn't exist yet. If CSV is selected, it will create the file.
-func (o OutputHandler) HandleResult(name string, res map[string]cty.Value) error {
-	if o.stdout {
+// block is the block number of the result, or 0 if it doesn't have one.
+func (o *OutputHandler) HandleResult(name string, block uint64, res map[string]cty.Value) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrClosed
+	}
+
+	if o.stdoutJSON {
+		if err := o.PrintJSON(name, res); err != nil {
+			return err
+		}
+	} else if o.stdout {
 		o.LogMap(res)
 	}
 
-	strRes := convertCtyMap(res)
+	if o.stream != nil {
+		if err := o.stream.Publish(name, res, o.exact); err != nil {
+			return err
+		}
+	}
 
 	if o.db != nil {
 		if ok := o.tables[name]; !ok {
-			err := o.db.CreateTable(context.Background(), name, res)
+			err := o.db.CreateTable(context.Background(), name, res, o.exact)
 			if err != nil {
 				return err
 			}
@@ -96,7 +336,43 @@ func (o OutputHandler) HandleResult(name string, res map[string]cty.Value) error
 			o.tables[name] = true
 		}
 
-		if err := o.db.InsertResult(name, strRes); err != nil {
+		if err := o.db.InsertResult(name, res, o.exact); err != nil {
+			return err
+		}
+	}
+
+	if o.sqlite != nil {
+		if !o.sqlite.HasTable(name) {
+			if err := o.sqlite.CreateTable(context.Background(), name, res, o.exact); err != nil {
+				return err
+			}
+		}
+
+		if err := o.sqlite.InsertResult(name, res, o.exact); err != nil {
+			return err
+		}
+	}
+
+	// Webhook receivers get every result, they can upsert it with the keys
+	if o.webhook != nil {
+		if err := o.webhook.Write(name, res, o.exact); err != nil {
+			return err
+		}
+	}
+
+	// The databases upsert results, but the files can't update what they've written
+	if o.duplicate(name, res) {
+		return nil
+	}
+
+	if o.json != nil {
+		if err := o.json.Write(name, res, o.exact); err != nil {
+			return err
+		}
+	}
+
+	if o.parquet != nil {
+		if err := o.parquet.Write(name, block, res, o.exact); err != nil {
 			return err
 		}
 	}
@@ -112,33 +388,119 @@ func (o OutputHandler) HandleResult(name string, res map[string]cty.Value) error
 			csv = o.csv.files[name]
 		}
 
-		err := csv.Write(o.csv.generateCsvEntry(name, strRes))
+		err := csv.Write(o.csv.generateCsvEntry(name, convertCtyMap(res, o.exact)))
 		if err != nil {
 			return err
 		}
 
 		csv.Flush()
+		if err := csv.Error(); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// duplicate returns true if a result with the same keys as res was handled before.
+func (o *OutputHandler) duplicate(name string, res map[string]cty.Value) bool {
+	keys, ok := o.keys[name]
+	if !ok {
+		return false
+	}
+
+	// The key is the JSON of the key values, which never contains a zero byte
+	var key strings.Builder
+	for _, k := range keys {
+		v, ok := res[k]
+		if !ok || v.IsNull() || !v.IsKnown() {
+			v = cty.NullVal(cty.DynamicPseudoType)
+		}
+
+		b, err := ctyjson.Marshal(v, v.Type())
+		if err != nil {
+			b = []byte(v.GoString())
+		}
+
+		key.Write(b)
+		key.WriteByte(0)
+	}
+
+	seen, ok := o.seen[name]
+	if !ok {
+		seen = newKeyWindow(maxSeenKeys)
+		o.seen[name] = seen
+	}
+
+	return !seen.add(key.String())
+}
+
+// maxSeenKeys is the number of keys per query that the file outputs remember. Duplicates
+// are results that are handled again shortly after, like reruns of a block, so only the
+// most recent keys are kept and memory stays bounded in realtime mode.
+const maxSeenKeys = 100000
+
+// keyWindow is a set of the most recent keys. When it's full, the oldest key is forgotten.
+type keyWindow struct {
+	keys  map[string]bool
+	order []string
+	next  int
+}
+
+func newKeyWindow(size int) *keyWindow {
+	return &keyWindow{
+		keys:  make(map[string]bool, size),
+		order: make([]string, 0, size),
+	}
+}
+
+// add adds the key, and returns false if it was in the window already.
+func (w *keyWindow) add(key string) bool {
+	if w.keys[key] {
+		return false
+	}
+
+	if len(w.order) < cap(w.order) {
+		w.order = append(w.order, key)
+	} else {
+		delete(w.keys, w.order[w.next])
+		w.order[w.next] = key
+		w.next = (w.next + 1) % len(w.order)
+	}
+
+	w.keys[key] = true
+
+	return true
+}
+
 type CsvHandler struct {
+	// dir is the directory the csv files are written to
+	dir string
 	// headers maps queries to header names, for matching
 	headers map[string][]string
 	// files maps queries to csv writers
 	files map[string]*csv.Writer
+	// handles are the open files of the queries, which are closed on Close
+	handles map[string]*os.File
 }
 
-func NewCsvHandler() *CsvHandler {
+func NewCsvHandler(dir string) *CsvHandler {
 	return &CsvHandler{
+		dir:     dir,
 		headers: make(map[string][]string),
 		files:   make(map[string]*csv.Writer),
+		handles: make(map[string]*os.File),
 	}
 }
 
 func (c *CsvHandler) AddCsv(name string, cols map[string]cty.Value) error {
-	f, err := os.Create(name + ".csv")
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(c.dir, name+".csv"))
 	if err != nil {
 		return err
 	}
@@ -146,15 +508,44 @@ func (c *CsvHandler) AddCsv(name string, cols map[string]cty.Value) error {
 	w := csv.NewWriter(f)
 
 	header := generate.GenerateCsvHeader(cols)
-	w.Write(header)
+	if err := w.Write(header); err != nil {
+		f.Close()
+		return err
+	}
+
 	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
 
 	c.files[name] = w
+	c.handles[name] = f
 	c.headers[name] = header
 
 	return nil
 }
 
+// Close flushes and closes the files. Every file is closed, even if one of them fails.
+func (c *CsvHandler) Close() error {
+	var firstErr error
+	for name, f := range c.handles {
+		c.files[name].Flush()
+		if err := c.files[name].Error(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	c.files = make(map[string]*csv.Writer)
+	c.handles = make(map[string]*os.File)
+
+	return firstErr
+}
+
 func (c CsvHandler) generateCsvEntry(name string, res map[string]string) []string {
 	header := c.headers[name]
 	entries := make([]string, len(header))
@@ -0,0 +1,349 @@
+package output
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// parquetKind is the physical type a column is written as.
+type parquetKind int
+
+const (
+	parquetInt64 parquetKind = iota
+	parquetDouble
+	parquetBool
+	parquetString
+	// parquetDecimal is a number written as a string, to keep its full precision
+	parquetDecimal
+	// parquetJSON is an object or tuple, written as a JSON string
+	parquetJSON
+)
+
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"lz4":    parquet.CompressionCodec_LZ4,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+}
+
+// ParquetOptions configures the Parquet files.
+type ParquetOptions struct {
+	// RowGroupSize is the number of rows in a row group
+	RowGroupSize int64
+	// Compression is the compression codec: none, snappy, gzip, lz4 or zstd
+	Compression string
+	// MaxRows starts a new file after this many rows. 0 disables it.
+	MaxRows int64
+	// MaxBlocks starts a new file for results that are this many blocks after the
+	// first result of the file. 0 disables it.
+	MaxBlocks uint64
+}
+
+type ParquetHandler struct {
+	// dir is the directory the parquet files are written to
+	dir   string
+	opts  ParquetOptions
+	codec parquet.CompressionCodec
+	// abiTypes maps queries to the ABI types of their columns, if they're known
+	abiTypes map[string]map[string]abi.Type
+	// files maps queries to their current file
+	files map[string]*parquetFile
+}
+
+type parquetColumn struct {
+	name string
+	kind parquetKind
+}
+
+type parquetFile struct {
+	f       *os.File
+	w       *writer.CSVWriter
+	columns []parquetColumn
+	// part is the index of the file, when files are rolled
+	part int
+	// rows and groupRows are the number of rows in the file and the current row group
+	rows       int64
+	groupRows  int64
+	firstBlock uint64
+}
+
+func NewParquetHandler(dir string, opts ParquetOptions) (*ParquetHandler, error) {
+	codec, ok := parquetCodecs[strings.ToLower(opts.Compression)]
+	if !ok {
+		return nil, fmt.Errorf("unknown parquet compression %s", opts.Compression)
+	}
+
+	if opts.RowGroupSize <= 0 {
+		return nil, fmt.Errorf("invalid parquet row group size %d", opts.RowGroupSize)
+	}
+
+	return &ParquetHandler{
+		dir:      dir,
+		opts:     opts,
+		codec:    codec,
+		abiTypes: make(map[string]map[string]abi.Type),
+		files:    make(map[string]*parquetFile),
+	}, nil
+}
+
+// SetAbiTypes sets the ABI types of the columns of a query, which are used to write
+// integers as integers instead of doubles.
+func (p *ParquetHandler) SetAbiTypes(name string, types map[string]abi.Type) {
+	p.abiTypes[name] = types
+}
+
+// Write writes the result to the file of the query. The schema of the file is derived from
+// the first result. block is the block of the result, which is used to roll the files
+// by block range (0 if it's unknown).
+func (p *ParquetHandler) Write(name string, block uint64, res map[string]cty.Value, exact bool) error {
+	pf, ok := p.files[name]
+	if !ok {
+		columns := make([]parquetColumn, 0, len(res))
+		for col, v := range res {
+			columns = append(columns, parquetColumn{name: col, kind: p.kind(name, col, v, exact)})
+		}
+
+		sort.Slice(columns, func(i, j int) bool {
+			return columns[i].name < columns[j].name
+		})
+
+		var err error
+		if pf, err = p.open(name, 0, columns, block); err != nil {
+			return err
+		}
+
+		p.files[name] = pf
+	} else if p.shouldRoll(pf, block) {
+		if err := pf.close(); err != nil {
+			return err
+		}
+
+		next, err := p.open(name, pf.part+1, pf.columns, block)
+		if err != nil {
+			return err
+		}
+
+		pf = next
+		p.files[name] = pf
+	}
+
+	row := make([]interface{}, len(pf.columns))
+	for i, col := range pf.columns {
+		v, err := parquetValue(col.kind, res[col.name], exact)
+		if err != nil {
+			return fmt.Errorf("column %s: %w", col.name, err)
+		}
+
+		row[i] = v
+	}
+
+	if err := pf.w.Write(row); err != nil {
+		return err
+	}
+
+	pf.rows++
+	pf.groupRows++
+	if pf.groupRows >= p.opts.RowGroupSize {
+		pf.groupRows = 0
+		return pf.w.Flush(true)
+	}
+
+	return nil
+}
+
+// Close writes the footers and closes all files. The files are unreadable without it,
+// so it should always be called on shutdown.
+func (p *ParquetHandler) Close() error {
+	var firstErr error
+	for name, pf := range p.files {
+		if err := pf.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing parquet file of %s: %w", name, err)
+		}
+
+		delete(p.files, name)
+	}
+
+	return firstErr
+}
+
+func (p *ParquetHandler) shouldRoll(pf *parquetFile, block uint64) bool {
+	if p.opts.MaxRows > 0 && pf.rows >= p.opts.MaxRows {
+		return true
+	}
+
+	return p.opts.MaxBlocks > 0 && block > 0 && block >= pf.firstBlock+p.opts.MaxBlocks
+}
+
+func (p *ParquetHandler) open(name string, part int, columns []parquetColumn, block uint64) (*parquetFile, error) {
+	if p.dir != "" {
+		if err := os.MkdirAll(p.dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	fileName := name + ".parquet"
+	if p.opts.MaxRows > 0 || p.opts.MaxBlocks > 0 {
+		fileName = fmt.Sprintf("%s-%05d.parquet", name, part)
+	}
+
+	f, err := os.Create(filepath.Join(p.dir, fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	md := make([]string, len(columns))
+	for i, col := range columns {
+		md[i] = parquetMetadata(col)
+	}
+
+	w, err := writer.NewCSVWriterFromWriter(md, f, 1)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Row groups are flushed by row count instead of by size
+	w.RowGroupSize = 1 << 40
+	w.CompressionType = p.codec
+
+	return &parquetFile{
+		f:          f,
+		w:          w,
+		columns:    columns,
+		part:       part,
+		firstBlock: block,
+	}, nil
+}
+
+func (pf *parquetFile) close() error {
+	if err := pf.w.WriteStop(); err != nil {
+		pf.f.Close()
+		return err
+	}
+
+	return pf.f.Close()
+}
+
+// kind determines the type of a column from the ABI type it references, or from its first value.
+func (p *ParquetHandler) kind(query, col string, v cty.Value, exact bool) parquetKind {
+	if t, ok := p.abiTypes[query][col]; ok {
+		switch t.T {
+		case abi.IntTy:
+			if t.Size <= 64 {
+				return parquetInt64
+			}
+
+			return parquetDecimal
+		case abi.UintTy:
+			if t.Size < 64 {
+				return parquetInt64
+			}
+
+			return parquetDecimal
+		case abi.BoolTy:
+			return parquetBool
+		}
+	}
+
+	switch v.Type() {
+	case cty.Number:
+		if exact || (!v.IsNull() && v.IsKnown() && isBigInt(v.AsBigFloat())) {
+			return parquetDecimal
+		}
+
+		return parquetDouble
+	case cty.String:
+		return parquetString
+	case cty.Bool:
+		return parquetBool
+	default:
+		return parquetJSON
+	}
+}
+
+// isBigInt returns whether f is an integer that a double can't represent exactly.
+func isBigInt(f *big.Float) bool {
+	if !f.IsInt() {
+		return false
+	}
+
+	_, acc := f.Float64()
+	return acc != big.Exact
+}
+
+func parquetMetadata(col parquetColumn) string {
+	var t string
+	switch col.kind {
+	case parquetInt64:
+		t = "type=INT64"
+	case parquetDouble:
+		t = "type=DOUBLE"
+	case parquetBool:
+		t = "type=BOOLEAN"
+	default:
+		t = "type=BYTE_ARRAY, convertedtype=UTF8"
+	}
+
+	return fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", col.name, t)
+}
+
+// parquetValue converts a value to the Go type of the column.
+func parquetValue(kind parquetKind, v cty.Value, exact bool) (interface{}, error) {
+	if v == cty.NilVal || v.IsNull() || !v.IsKnown() {
+		return nil, nil
+	}
+
+	switch kind {
+	case parquetInt64:
+		if v.Type() != cty.Number {
+			return nil, fmt.Errorf("expected number, got %s", v.Type().FriendlyName())
+		}
+
+		f := v.AsBigFloat()
+		if !f.IsInt() {
+			return nil, fmt.Errorf("expected integer, got %s", f.Text('f', -1))
+		}
+
+		i, _ := f.Int(nil)
+		if !i.IsInt64() {
+			return nil, fmt.Errorf("%s overflows int64", i)
+		}
+
+		return i.Int64(), nil
+	case parquetDouble:
+		if v.Type() != cty.Number {
+			return nil, fmt.Errorf("expected number, got %s", v.Type().FriendlyName())
+		}
+
+		f, _ := v.AsBigFloat().Float64()
+		return f, nil
+	case parquetBool:
+		if v.Type() != cty.Bool {
+			return nil, fmt.Errorf("expected bool, got %s", v.Type().FriendlyName())
+		}
+
+		return v.True(), nil
+	case parquetDecimal:
+		if v.Type() != cty.Number {
+			return nil, fmt.Errorf("expected number, got %s", v.Type().FriendlyName())
+		}
+
+		return formatNumber(v.AsBigFloat(), true), nil
+	case parquetString:
+		if v.Type() == cty.String {
+			return v.AsString(), nil
+		}
+	}
+
+	return formatValue(v, exact), nil
+}
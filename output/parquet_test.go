@@ -0,0 +1,130 @@
+package output
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/zclconf/go-cty/cty"
+)
+
+func readParquet(t *testing.T, path string) (*reader.ParquetReader, []interface{}) {
+	t.Helper()
+
+	f, err := local.NewLocalFileReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := pr.ReadByNumber(int(pr.GetNumRows()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pr, rows
+}
+
+func TestParquetHandler(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewParquetHandler(dir, ParquetOptions{RowGroupSize: 2, Compression: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uint256, _ := abi.NewType("uint256", "", nil)
+	int64Type, _ := abi.NewType("int64", "", nil)
+	p.SetAbiTypes("swaps", map[string]abi.Type{"block": int64Type, "amount": uint256})
+
+	for i := int64(0); i < 3; i++ {
+		err := p.Write("swaps", uint64(100+i), map[string]cty.Value{
+			"block":  cty.NumberIntVal(100 + i),
+			"amount": cty.NumberIntVal(1000 * i),
+			"price":  cty.NumberFloatVal(1.5),
+			"supply": cty.MustParseNumberVal("1000000000000000000000000000001"),
+			"mint":   cty.BoolVal(i == 0),
+			"pair":   cty.StringVal("0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc"),
+			"tokens": cty.TupleVal([]cty.Value{cty.StringVal("WETH"), cty.StringVal("USDC")}),
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr, rows := readParquet(t, filepath.Join(dir, "swaps.parquet"))
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+
+	if len(pr.Footer.RowGroups) != 2 {
+		t.Fatalf("expected 2 row groups, got %d", len(pr.Footer.RowGroups))
+	}
+
+	if codec := pr.Footer.RowGroups[0].Columns[0].MetaData.Codec; codec != parquet.CompressionCodec_ZSTD {
+		t.Fatalf("expected zstd compression, got %s", codec)
+	}
+
+	expectedTypes := map[string]parquet.Type{
+		"Amount": parquet.Type_BYTE_ARRAY,
+		"Block":  parquet.Type_INT64,
+		"Mint":   parquet.Type_BOOLEAN,
+		"Pair":   parquet.Type_BYTE_ARRAY,
+		"Price":  parquet.Type_DOUBLE,
+		"Supply": parquet.Type_BYTE_ARRAY,
+		"Tokens": parquet.Type_BYTE_ARRAY,
+	}
+
+	for _, el := range pr.SchemaHandler.SchemaElements[1:] {
+		if expectedTypes[el.Name] != el.GetType() {
+			t.Fatalf("expected column %s to be %s, got %s", el.Name, expectedTypes[el.Name], el.GetType())
+		}
+	}
+
+	row, err := json.Marshal(rows[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Amount":"2000","Block":102,"Mint":false,"Pair":"0xB4e16d0168e52d35CaCD2c6185b44281Ec28C9Dc","Price":1.5,"Supply":"1000000000000000000000000000001","Tokens":"[\"WETH\",\"USDC\"]"}`
+	if string(row) != expected {
+		t.Fatalf("expected %s, got %s", expected, row)
+	}
+}
+
+func TestParquetRolling(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewParquetHandler(dir, ParquetOptions{RowGroupSize: 100, Compression: "snappy", MaxBlocks: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, block := range []uint64{100, 105, 110, 125} {
+		if err := p.Write("swaps", block, map[string]cty.Value{"block": cty.NumberUIntVal(block)}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, expected := range map[string]int{"swaps-00000.parquet": 2, "swaps-00001.parquet": 1, "swaps-00002.parquet": 1} {
+		_, rows := readParquet(t, filepath.Join(dir, file))
+		if len(rows) != expected {
+			t.Fatalf("expected %d rows in %s, got %d", expected, file, len(rows))
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package output
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainbound/apollo/log"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const (
+	// DefaultStreamReplay is the number of results per query that new clients get first.
+	DefaultStreamReplay = 100
+	// DefaultStreamClientBuffer is the number of messages that are buffered per client.
+	DefaultStreamClientBuffer = 256
+
+	// SlowClientsDrop drops the messages for clients whose buffer is full.
+	SlowClientsDrop = "drop"
+	// SlowClientsDisconnect disconnects clients whose buffer is full.
+	SlowClientsDisconnect = "disconnect"
+
+	streamWriteTimeout = 10 * time.Second
+	streamPingInterval = 30 * time.Second
+)
+
+// StreamOptions configure the stream server.
+type StreamOptions struct {
+	// Addr is the address the server listens on, like `:8080`.
+	Addr string
+	// Replay is the number of results per query that are kept for new clients.
+	Replay int
+	// ClientBuffer is the number of messages that are buffered per client.
+	ClientBuffer int
+	// SlowClients is what happens to clients whose buffer is full: SlowClientsDrop or SlowClientsDisconnect.
+	SlowClients string
+}
+
+// streamMessage is the JSON of a result in a stream. IDs increase across queries.
+type streamMessage struct {
+	ID     uint64         `json:"id"`
+	Query  string         `json:"query"`
+	Result map[string]any `json:"result"`
+}
+
+// message is an encoded streamMessage.
+type message struct {
+	id    uint64
+	query string
+	data  []byte
+}
+
+// streamClient is a WebSocket or SSE connection.
+type streamClient struct {
+	// queries are the queries the client receives, or nil for all queries
+	queries map[string]bool
+	send    chan message
+	// done is closed when the server disconnects the client
+	done      chan struct{}
+	closeOnce sync.Once
+	dropped   int64
+}
+
+func (c *streamClient) wants(query string) bool {
+	return c.queries == nil || c.queries[query]
+}
+
+func (c *streamClient) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+// StreamServer streams the results of queries over WebSocket and SSE, to clients that
+// subscribe to some or all of the queries. New clients first get the last results of
+// their queries. Clients that don't keep up either miss results or are disconnected.
+type StreamServer struct {
+	opts     StreamOptions
+	listener net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+
+	// run identifies this run in the SSE event IDs, because the sequence restarts in every run
+	run string
+
+	// mu guards the replay buffers and the clients
+	mu      sync.Mutex
+	seq     uint64
+	replay  map[string][]message
+	clients map[*streamClient]bool
+	closed  bool
+	logger  zerolog.Logger
+}
+
+// NewStreamServer starts listening on the address of the options. The streams are at:
+//   - /ws and /sse for every query;
+//   - /ws/<query> and /sse/<query> for a single query.
+//
+// Both can be filtered with `query` parameters, like `/ws?query=swaps,transfers`.
+func NewStreamServer(opts StreamOptions) (*StreamServer, error) {
+	switch opts.SlowClients {
+	case "":
+		opts.SlowClients = SlowClientsDrop
+	case SlowClientsDrop, SlowClientsDisconnect:
+	default:
+		return nil, fmt.Errorf("unknown slow clients policy %s, expected %s or %s", opts.SlowClients, SlowClientsDrop, SlowClientsDisconnect)
+	}
+
+	if opts.Replay < 0 {
+		return nil, errors.New("stream replay can't be negative")
+	}
+
+	if opts.ClientBuffer <= 0 {
+		opts.ClientBuffer = DefaultStreamClientBuffer
+	}
+
+	l, err := net.Listen("tcp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("starting stream server: %w", err)
+	}
+
+	s := &StreamServer{
+		opts:     opts,
+		listener: l,
+		run:      strconv.FormatInt(time.Now().UnixMilli(), 10),
+		upgrader: websocket.Upgrader{
+			// The streams are read-only, so they can be consumed from any origin
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+		replay:  make(map[string][]message),
+		clients: make(map[*streamClient]bool),
+		logger:  log.NewLogger("stream"),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", s.serveWS)
+	mux.HandleFunc("/ws/", s.serveWS)
+	mux.HandleFunc("/sse", s.serveSSE)
+	mux.HandleFunc("/sse/", s.serveSSE)
+	s.server = &http.Server{Handler: mux}
+
+	go func() {
+		if err := s.server.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error().Err(err).Msg("serving streams")
+		}
+	}()
+
+	s.logger.Info().Str("addr", l.Addr().String()).Msg("streaming results")
+
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *StreamServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Publish sends the result to the clients of the query, and keeps it for new clients.
+func (s *StreamServer) Publish(name string, res map[string]cty.Value, exact bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.seq++
+	data, err := json.Marshal(streamMessage{ID: s.seq, Query: name, Result: convertCtyMapJSON(res, exact)})
+	if err != nil {
+		return err
+	}
+
+	msg := message{id: s.seq, query: name, data: data}
+
+	if s.opts.Replay > 0 {
+		buf := append(s.replay[name], msg)
+		if len(buf) > s.opts.Replay {
+			buf = buf[len(buf)-s.opts.Replay:]
+		}
+		s.replay[name] = buf
+	}
+
+	for c := range s.clients {
+		if !c.wants(name) {
+			continue
+		}
+
+		select {
+		case c.send <- msg:
+		default:
+			s.slow(c)
+		}
+	}
+
+	return nil
+}
+
+// slow handles a client whose buffer is full. s.mu must be held.
+func (s *StreamServer) slow(c *streamClient) {
+	if s.opts.SlowClients == SlowClientsDisconnect {
+		s.logger.Warn().Msg("disconnecting slow stream client")
+		delete(s.clients, c)
+		c.close()
+		return
+	}
+
+	if atomic.AddInt64(&c.dropped, 1) == 1 {
+		s.logger.Warn().Msg("stream client is too slow, dropping results")
+	}
+}
+
+// subscribe registers a client for the queries, or every query if queries is nil. It returns
+// the last replay results of those queries with an ID after the given one, in order.
+func (s *StreamServer) subscribe(queries map[string]bool, replay int, after uint64) (*streamClient, []message, error) {
+	c := &streamClient{
+		queries: queries,
+		send:    make(chan message, s.opts.ClientBuffer),
+		done:    make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+
+	var msgs []message
+	for query, buf := range s.replay {
+		if !c.wants(query) {
+			continue
+		}
+
+		for _, m := range buf {
+			if m.id > after {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].id < msgs[j].id
+	})
+
+	if len(msgs) > replay {
+		msgs = msgs[len(msgs)-replay:]
+	}
+
+	s.clients[c] = true
+
+	return c, msgs, nil
+}
+
+func (s *StreamServer) unsubscribe(c *streamClient) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.clients, c)
+
+	if dropped := atomic.LoadInt64(&c.dropped); dropped > 0 {
+		s.logger.Warn().Int64("results", dropped).Msg("stream client disconnected, results were dropped")
+	}
+}
+
+// parseStreamRequest returns the queries and the number of results to replay of a request.
+// The queries are the last element of the path, and the `query` parameters.
+func (s *StreamServer) parseStreamRequest(r *http.Request, prefix string) (map[string]bool, int, error) {
+	var names []string
+	if name := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"); name != "" {
+		names = append(names, name)
+	}
+
+	for _, param := range r.URL.Query()["query"] {
+		for _, name := range strings.Split(param, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var queries map[string]bool
+	if len(names) > 0 {
+		queries = make(map[string]bool, len(names))
+		for _, name := range names {
+			queries[name] = true
+		}
+	}
+
+	replay := s.opts.Replay
+	if param := r.URL.Query().Get("replay"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid replay %s", param)
+		}
+
+		if n < replay {
+			replay = n
+		}
+	}
+
+	return queries, replay, nil
+}
+
+// serveWS streams the results as WebSocket text messages.
+func (s *StreamServer) serveWS(w http.ResponseWriter, r *http.Request) {
+	queries, replay, err := s.parseStreamRequest(r, "/ws")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader responded with the error
+		return
+	}
+	defer conn.Close()
+
+	c, msgs, err := s.subscribe(queries, replay, 0)
+	if err != nil {
+		return
+	}
+	defer s.unsubscribe(c)
+
+	// The client doesn't send anything, but reading handles pings and notices when it's gone
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(messageType int, data []byte) bool {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteMessage(messageType, data) == nil
+	}
+
+	for _, m := range msgs {
+		if !write(websocket.TextMessage, m.data) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case m := <-c.send:
+			if !write(websocket.TextMessage, m.data) {
+				return
+			}
+		case <-ping.C:
+			if !write(websocket.PingMessage, nil) {
+				return
+			}
+		case <-c.done:
+			write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		case <-gone:
+			return
+		}
+	}
+}
+
+// serveSSE streams the results as server-sent events, with the run and the ID of the result
+// as the event ID, like `1650000000000-42`, and the query as the event type. Reconnecting clients
+// that send a Last-Event-ID header get the results after it from the replay buffer. IDs of
+// another run are ignored, so those clients get the replay like new clients.
+func (s *StreamServer) serveSSE(w http.ResponseWriter, r *http.Request) {
+	queries, replay, err := s.parseStreamRequest(r, "/sse")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var after uint64
+	if run, id, ok := strings.Cut(r.Header.Get("Last-Event-ID"), "-"); ok && run == s.run {
+		if after, err = strconv.ParseUint(id, 10, 64); err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	c, msgs, err := s.subscribe(queries, replay, after)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	write := func(m message) bool {
+		if _, err := fmt.Fprintf(w, "id: %s-%d\nevent: %s\ndata: %s\n\n", s.run, m.id, m.query, m.data); err != nil {
+			return false
+		}
+
+		flusher.Flush()
+		return true
+	}
+
+	for _, m := range msgs {
+		if !write(m) {
+			return
+		}
+	}
+
+	ping := time.NewTicker(streamPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case m := <-c.send:
+			if !write(m) {
+				return
+			}
+		case <-ping.C:
+			// A comment keeps proxies from closing the idle connection
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Close disconnects the clients and stops the server.
+func (s *StreamServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	for c := range s.clients {
+		c.close()
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,231 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestStream(t *testing.T, opts StreamOptions) *StreamServer {
+	t.Helper()
+
+	opts.Addr = "127.0.0.1:0"
+	s, err := NewStreamServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func publish(t *testing.T, s *StreamServer, name string, i int64) {
+	t.Helper()
+
+	if err := s.Publish(name, webhookResult(i), false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitClients waits until the server has n clients, so results published after it are streamed.
+func waitClients(t *testing.T, s *StreamServer, n int) {
+	t.Helper()
+
+	for i := 0; i < 200; i++ {
+		s.mu.Lock()
+		clients := len(s.clients)
+		s.mu.Unlock()
+
+		if clients == n {
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d stream clients", n)
+}
+
+func TestStreamWebSocket(t *testing.T) {
+	s := newTestStream(t, StreamOptions{Replay: 2})
+
+	// Only the last 2 swaps are replayed
+	for i := int64(1); i <= 3; i++ {
+		publish(t, s, "swaps", i)
+	}
+	publish(t, s, "transfers", 4)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+s.Addr()+"/ws/swaps", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	waitClients(t, s, 1)
+	publish(t, s, "transfers", 5)
+	publish(t, s, "swaps", 6)
+
+	for _, id := range []uint64{2, 3, 6} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		var msg streamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.ID != id || msg.Query != "swaps" || msg.Result["block"] != float64(id) {
+			t.Fatalf("expected swap %d, got %+v", id, msg)
+		}
+	}
+
+	// Closing the server disconnects the client
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a close message, got %v", err)
+	}
+}
+
+// readEvent reads the fields of the next server-sent event.
+func readEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	t.Helper()
+
+	event := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if line = strings.TrimSuffix(line, "\n"); line == "" {
+			return event
+		}
+
+		field, value, _ := strings.Cut(line, ": ")
+		event[field] = value
+	}
+}
+
+// getSSE starts an SSE request with the Last-Event-ID header, if it's not empty.
+func getSSE(t *testing.T, s *StreamServer, path, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodGet, "http://"+s.Addr()+path, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	return bufio.NewReader(resp.Body)
+}
+
+func TestStreamSSE(t *testing.T) {
+	s := newTestStream(t, StreamOptions{Replay: 10})
+
+	publish(t, s, "swaps", 1)
+	publish(t, s, "transfers", 2)
+	publish(t, s, "swaps", 3)
+	publish(t, s, "mints", 4)
+
+	// A reconnecting client only gets the results after its last event
+	r := getSSE(t, s, "/sse?query=swaps,mints", s.run+"-1")
+
+	waitClients(t, s, 1)
+	publish(t, s, "swaps", 5)
+
+	for _, want := range []struct {
+		id    uint64
+		query string
+	}{{3, "swaps"}, {4, "mints"}, {5, "swaps"}} {
+		event := readEvent(t, r)
+
+		var msg streamMessage
+		if err := json.Unmarshal([]byte(event["data"]), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if event["id"] != s.run+"-"+strconv.FormatUint(want.id, 10) || event["event"] != want.query || msg.ID != want.id {
+			t.Fatalf("expected %s event %d, got %v", want.query, want.id, event)
+		}
+	}
+}
+
+func TestStreamSSEOtherRun(t *testing.T) {
+	s := newTestStream(t, StreamOptions{Replay: 10})
+
+	publish(t, s, "swaps", 1)
+	publish(t, s, "swaps", 2)
+
+	// The IDs of a previous run are ignored, even if they're after the current one
+	r := getSSE(t, s, "/sse", "1-5")
+	for _, id := range []uint64{1, 2} {
+		var msg streamMessage
+		if err := json.Unmarshal([]byte(readEvent(t, r)["data"]), &msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.ID != id {
+			t.Fatalf("expected result %d, got %d", id, msg.ID)
+		}
+	}
+}
+
+func TestStreamSlowClients(t *testing.T) {
+	// Slow clients miss results
+	s := newTestStream(t, StreamOptions{ClientBuffer: 1})
+
+	c, _, err := s.subscribe(nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, s, "swaps", 1)
+	publish(t, s, "swaps", 2)
+
+	if c.dropped != 1 || (<-c.send).id != 1 {
+		t.Fatalf("expected the second result to be dropped, dropped %d", c.dropped)
+	}
+
+	// Or are disconnected
+	s = newTestStream(t, StreamOptions{ClientBuffer: 1, SlowClients: SlowClientsDisconnect})
+
+	c, _, err = s.subscribe(nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publish(t, s, "swaps", 1)
+	publish(t, s, "swaps", 2)
+
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("expected the slow client to be disconnected")
+	}
+
+	if len(s.clients) != 0 {
+		t.Fatal("expected no clients")
+	}
+
+	if _, err := NewStreamServer(StreamOptions{Addr: "127.0.0.1:0", SlowClients: "block"}); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
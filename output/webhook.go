@@ -0,0 +1,530 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainbound/apollo/log"
+	"github.com/rs/zerolog"
+	"github.com/zclconf/go-cty/cty"
+)
+
+const (
+	// DefaultWebhookBatchSize is the number of results per request.
+	DefaultWebhookBatchSize = 1
+	// DefaultWebhookFlushInterval is how often results are sent when a batch fills up slowly.
+	DefaultWebhookFlushInterval = time.Second
+	// DefaultWebhookMaxRetries is the number of times a failed request is retried.
+	DefaultWebhookMaxRetries = 5
+	// DefaultWebhookTimeout is the timeout of a request.
+	DefaultWebhookTimeout = 10 * time.Second
+	// DefaultWebhookMaxQueueSize is the maximum size of the queue on disk, in bytes.
+	DefaultWebhookMaxQueueSize = 64 << 20
+
+	// SignatureHeader contains the hex encoded HMAC-SHA256 of the body, as `sha256=<hex>`,
+	// if a secret is configured.
+	SignatureHeader = "X-Apollo-Signature"
+	// QueryHeader contains the name of the query of the results.
+	QueryHeader = "X-Apollo-Query"
+)
+
+// WebhookSettings are the settings of the webhook output, from the `webhook` section of config.yml.
+type WebhookSettings struct {
+	// URL receives the results of the queries that have no URL in URLs.
+	URL string `yaml:"url"`
+	// URLs are the URLs of queries by name.
+	URLs map[string]string `yaml:"urls"`
+	// Secret signs the requests, in the SignatureHeader.
+	Secret string `yaml:"secret"`
+	// BatchSize is the maximum number of results per request.
+	BatchSize int `yaml:"batch_size"`
+	// FlushInterval is how often a batch is sent before it's full.
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// MaxRetries is the number of times a failed request is retried, with exponential backoff.
+	MaxRetries int `yaml:"max_retries"`
+	// Timeout is the timeout of a single request.
+	Timeout time.Duration `yaml:"timeout"`
+	// QueueDir is the directory of the queue of batches that are not sent yet.
+	QueueDir string `yaml:"queue_dir"`
+	// MaxQueueSize is the maximum size of the queue in bytes. Batches that don't fit are dropped.
+	MaxQueueSize int64 `yaml:"max_queue_size"`
+}
+
+// URLFor returns the URL of the query, or nothing if its results are not sent.
+func (s WebhookSettings) URLFor(name string) string {
+	if url, ok := s.URLs[name]; ok {
+		return url
+	}
+
+	return s.URL
+}
+
+// webhookBody is the JSON body of a request.
+type webhookBody struct {
+	Query   string `json:"query"`
+	Results []any  `json:"results"`
+}
+
+// queuedBatch is a request body in the queue, stored in file.
+type queuedBatch struct {
+	file  string
+	query string
+	size  int64
+}
+
+// WebhookHandler POSTs the results of queries to their URLs as JSON, in batches. Batches are
+// written to a queue on disk, which a single goroutine sends in order, so a slow receiver
+// doesn't block the queries. Batches that are still queued on Close are sent on the next run.
+type WebhookHandler struct {
+	settings WebhookSettings
+	client   *http.Client
+
+	// minBackoff and maxBackoff bound the exponential backoff between retries
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// drainTimeout is how long Close waits for the queue to be sent
+	drainTimeout time.Duration
+
+	// mu guards the pending results and the queue
+	mu sync.Mutex
+	// pending are the results that are not queued yet, per query
+	pending   map[string][]any
+	queue     []queuedBatch
+	queueSize int64
+	seq       uint64
+	// dropped is the number of results that didn't fit in the queue
+	dropped int64
+
+	wake    chan struct{}
+	closing chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	logger  zerolog.Logger
+}
+
+// NewWebhookHandler creates the queue directory and starts sending the batches that are
+// still queued in it.
+func NewWebhookHandler(s WebhookSettings) (*WebhookHandler, error) {
+	if s.URL == "" && len(s.URLs) == 0 {
+		return nil, errors.New("webhook has no url")
+	}
+
+	if s.QueueDir == "" {
+		return nil, errors.New("webhook has no queue_dir")
+	}
+
+	if s.BatchSize <= 0 {
+		s.BatchSize = DefaultWebhookBatchSize
+	}
+
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = DefaultWebhookFlushInterval
+	}
+
+	if s.MaxRetries < 0 {
+		return nil, errors.New("webhook max_retries can't be negative")
+	} else if s.MaxRetries == 0 {
+		s.MaxRetries = DefaultWebhookMaxRetries
+	}
+
+	if s.Timeout <= 0 {
+		s.Timeout = DefaultWebhookTimeout
+	}
+
+	if s.MaxQueueSize <= 0 {
+		s.MaxQueueSize = DefaultWebhookMaxQueueSize
+	}
+
+	log.AddSecret(s.Secret)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &WebhookHandler{
+		settings:     s,
+		client:       &http.Client{Timeout: s.Timeout},
+		minBackoff:   500 * time.Millisecond,
+		maxBackoff:   30 * time.Second,
+		drainTimeout: 30 * time.Second,
+		pending:      make(map[string][]any),
+		wake:         make(chan struct{}, 1),
+		closing:      make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		logger:       log.NewLogger("webhook"),
+	}
+
+	if err := w.loadQueue(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if len(w.queue) > 0 {
+		w.logger.Info().Int("batches", len(w.queue)).Msg("sending queued batches of the previous run")
+	}
+
+	w.wg.Add(2)
+	go w.flushLoop()
+	go w.sendLoop()
+
+	return w, nil
+}
+
+// loadQueue reads the batches that were queued by a previous run, in order.
+func (w *WebhookHandler) loadQueue() error {
+	if err := os.MkdirAll(w.settings.QueueDir, 0755); err != nil {
+		return fmt.Errorf("creating webhook queue: %w", err)
+	}
+
+	entries, err := os.ReadDir(w.settings.QueueDir)
+	if err != nil {
+		return fmt.Errorf("reading webhook queue: %w", err)
+	}
+
+	for _, e := range entries {
+		seq, query, ok := parseBatchName(e.Name())
+		if e.IsDir() || !ok {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("reading webhook queue: %w", err)
+		}
+
+		w.queue = append(w.queue, queuedBatch{file: filepath.Join(w.settings.QueueDir, e.Name()), query: query, size: info.Size()})
+		w.queueSize += info.Size()
+		if seq >= w.seq {
+			w.seq = seq + 1
+		}
+	}
+
+	// The names start with the zero padded sequence number
+	sort.Slice(w.queue, func(i, j int) bool {
+		return w.queue[i].file < w.queue[j].file
+	})
+
+	return nil
+}
+
+// batchName returns the name of the file of a batch: its sequence number and query.
+func batchName(seq uint64, query string) string {
+	return fmt.Sprintf("%020d-%s.json", seq, query)
+}
+
+func parseBatchName(name string) (uint64, string, bool) {
+	if !strings.HasSuffix(name, ".json") || len(name) < 22 || name[20] != '-' {
+		return 0, "", false
+	}
+
+	seq, err := strconv.ParseUint(name[:20], 10, 64)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return seq, strings.TrimSuffix(name[21:], ".json"), true
+}
+
+// Write adds the result to the batch of the query, and queues the batch if it's full.
+// Results of queries without a URL are ignored.
+func (w *WebhookHandler) Write(name string, res map[string]cty.Value, exact bool) error {
+	if w.settings.URLFor(name) == "" {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending[name] = append(w.pending[name], convertCtyMapJSON(res, exact))
+	if len(w.pending[name]) >= w.settings.BatchSize {
+		return w.enqueue(name)
+	}
+
+	return nil
+}
+
+// Flush queues the batches that are not full yet. Queued batches are on disk, so they're
+// sent after a restart too.
+func (w *WebhookHandler) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.flush()
+}
+
+// flush queues every pending batch. w.mu must be held.
+func (w *WebhookHandler) flush() error {
+	for name := range w.pending {
+		if err := w.enqueue(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enqueue writes the pending results of the query to a file in the queue. If the queue is
+// full, they're dropped. w.mu must be held.
+func (w *WebhookHandler) enqueue(name string) error {
+	results := w.pending[name]
+	delete(w.pending, name)
+
+	if len(results) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookBody{Query: name, Results: results})
+	if err != nil {
+		return err
+	}
+
+	if w.queueSize+int64(len(body)) > w.settings.MaxQueueSize {
+		w.dropped += int64(len(results))
+		w.logger.Warn().Str("query", name).Int("results", len(results)).Msg("webhook queue is full, dropping results")
+		return nil
+	}
+
+	file := filepath.Join(w.settings.QueueDir, batchName(w.seq, name))
+	if err := writeFileAtomic(file, body); err != nil {
+		return fmt.Errorf("queueing webhook batch: %w", err)
+	}
+
+	w.seq++
+	w.queue = append(w.queue, queuedBatch{file: file, query: name, size: int64(len(body))})
+	w.queueSize += int64(len(body))
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary file, so the queue never
+// contains partial batches.
+func writeFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, file)
+}
+
+// Dropped returns the number of results that were dropped because the queue was full.
+func (w *WebhookHandler) Dropped() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.dropped
+}
+
+func (w *WebhookHandler) flushLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.settings.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				w.logger.Error().Err(err).Msg("flushing webhook batches")
+			}
+		case <-w.closing:
+			return
+		}
+	}
+}
+
+// sendLoop sends the queued batches in order. It returns when the queue is empty after Close,
+// or when sending is aborted.
+func (w *WebhookHandler) sendLoop() {
+	defer w.wg.Done()
+
+	for {
+		w.mu.Lock()
+		var (
+			b  queuedBatch
+			ok = len(w.queue) > 0
+		)
+		if ok {
+			b = w.queue[0]
+		}
+		w.mu.Unlock()
+
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.closing:
+				return
+			case <-w.ctx.Done():
+				return
+			}
+		}
+
+		err := w.send(w.ctx, b)
+		if err != nil && w.ctx.Err() != nil {
+			// Aborted, the batch stays queued for the next run
+			return
+		}
+
+		if err != nil {
+			w.logger.Error().Err(err).Str("query", b.query).Msg("webhook batch failed, moving it to the failed directory")
+			err = moveToFailed(b.file)
+		} else {
+			err = os.Remove(b.file)
+		}
+
+		if err != nil {
+			w.logger.Error().Err(err).Str("file", b.file).Msg("removing webhook batch from the queue")
+		}
+
+		w.mu.Lock()
+		w.queue = w.queue[1:]
+		w.queueSize -= b.size
+		w.mu.Unlock()
+	}
+}
+
+// moveToFailed moves a batch that can't be sent to the `failed` directory of the queue.
+func moveToFailed(file string) error {
+	dir := filepath.Join(filepath.Dir(file), "failed")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return os.Rename(file, filepath.Join(dir, filepath.Base(file)))
+}
+
+// send POSTs the batch, and retries with exponential backoff if it fails. Client errors
+// other than timeouts and rate limits are not retried.
+func (w *WebhookHandler) send(ctx context.Context, b queuedBatch) error {
+	url := w.settings.URLFor(b.query)
+	if url == "" {
+		return fmt.Errorf("query %s has no webhook url", b.query)
+	}
+
+	body, err := os.ReadFile(b.file)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.minBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, url, b.query, body)
+		if err == nil {
+			w.logger.Trace().Str("query", b.query).Int("attempts", attempt+1).Msg("sent webhook batch")
+			return nil
+		}
+
+		if !retry || attempt >= w.settings.MaxRetries {
+			return err
+		}
+
+		w.logger.Warn().Err(err).Str("query", b.query).Dur("backoff", backoff).Msg("webhook request failed, retrying")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		if backoff *= 2; backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// post sends a request, and returns whether it should be retried if it failed.
+func (w *WebhookHandler) post(ctx context.Context, url, query string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "apollo")
+	req.Header.Set(QueryHeader, query)
+	if w.settings.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(w.settings.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body, so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+
+	return retry, fmt.Errorf("webhook %s responded with %s", url, resp.Status)
+}
+
+// Sign returns the signature of the body with the secret, as it's sent in the SignatureHeader.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close queues the pending results, and waits until the queue is sent. If that takes longer
+// than the drain timeout, the rest of the queue is sent on the next run.
+func (w *WebhookHandler) Close() error {
+	w.mu.Lock()
+	err := w.flush()
+	w.mu.Unlock()
+
+	close(w.closing)
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(w.drainTimeout):
+		w.cancel()
+		<-done
+	}
+	w.cancel()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.queue) > 0 {
+		w.logger.Warn().Int("batches", len(w.queue)).Str("dir", w.settings.QueueDir).Msg("webhook batches are still queued, they're sent on the next run")
+	}
+
+	if w.dropped > 0 {
+		w.logger.Warn().Int64("results", w.dropped).Msg("dropped results because the webhook queue was full")
+	}
+
+	return err
+}
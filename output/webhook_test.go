@@ -0,0 +1,213 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zclconf/go-cty/cty"
+)
+
+// webhookServer records the bodies it receives. It responds with the status codes in order,
+// and with 200 once they're used up.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests int
+	bodies   []webhookBody
+}
+
+func newWebhookServer(t *testing.T, secret string, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if secret != "" && r.Header.Get(SignatureHeader) != Sign(secret, body) {
+			t.Errorf("invalid signature %q", r.Header.Get(SignatureHeader))
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.requests++
+		if len(s.statuses) > 0 {
+			status := s.statuses[0]
+			s.statuses = s.statuses[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		var b webhookBody
+		if err := json.Unmarshal(body, &b); err != nil {
+			t.Error(err)
+		}
+		s.bodies = append(s.bodies, b)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func newTestWebhook(t *testing.T, s WebhookSettings) *WebhookHandler {
+	t.Helper()
+
+	w, err := NewWebhookHandler(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.minBackoff = time.Millisecond
+	w.maxBackoff = 5 * time.Millisecond
+
+	return w
+}
+
+func webhookResult(i int64) map[string]cty.Value {
+	return map[string]cty.Value{"block": cty.NumberIntVal(i)}
+}
+
+func TestWebhookBatches(t *testing.T) {
+	server := newWebhookServer(t, "s3cret")
+
+	w := newTestWebhook(t, WebhookSettings{
+		URLs:      map[string]string{"swaps": server.URL},
+		Secret:    "s3cret",
+		BatchSize: 2,
+		QueueDir:  t.TempDir(),
+	})
+
+	for i := int64(0); i < 3; i++ {
+		if err := w.Write("swaps", webhookResult(i), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queries without a URL are not sent
+	if err := w.Write("transfers", webhookResult(0), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close sends the last batch, which is not full
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.bodies) != 2 || len(server.bodies[0].Results) != 2 || len(server.bodies[1].Results) != 1 {
+		t.Fatalf("unexpected batches %+v", server.bodies)
+	}
+
+	if server.bodies[0].Query != "swaps" || server.bodies[1].Results[0].(map[string]any)["block"] != float64(2) {
+		t.Fatalf("unexpected batches %+v", server.bodies)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	// Server errors and rate limits are retried
+	server := newWebhookServer(t, "", http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	dir := t.TempDir()
+
+	w := newTestWebhook(t, WebhookSettings{URL: server.URL, QueueDir: dir})
+	if err := w.Write("swaps", webhookResult(1), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.requests != 3 || len(server.bodies) != 1 {
+		t.Fatalf("expected 1 batch in 3 requests, got %d in %d", len(server.bodies), server.requests)
+	}
+
+	// Other client errors are not, the batch is moved to the failed directory
+	server = newWebhookServer(t, "", http.StatusBadRequest)
+
+	w = newTestWebhook(t, WebhookSettings{URL: server.URL, QueueDir: dir})
+	if err := w.Write("swaps", webhookResult(1), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if server.requests != 1 {
+		t.Fatalf("expected 1 request, got %d", server.requests)
+	}
+
+	failed, err := os.ReadDir(filepath.Join(dir, "failed"))
+	if err != nil || len(failed) != 1 {
+		t.Fatalf("expected 1 failed batch, got %v (%v)", failed, err)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	unavailable := make([]int, 1000)
+	for i := range unavailable {
+		unavailable[i] = http.StatusServiceUnavailable
+	}
+
+	down := newWebhookServer(t, "", unavailable...)
+	dir := t.TempDir()
+
+	w := newTestWebhook(t, WebhookSettings{URL: down.URL, QueueDir: dir, MaxRetries: 100})
+	w.drainTimeout = 10 * time.Millisecond
+
+	if err := w.Write("swaps", webhookResult(1), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close gives up on the receiver, the batch stays queued
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	queued, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(queued) != 1 {
+		t.Fatalf("expected 1 queued batch, got %v", queued)
+	}
+
+	// The next run sends it first
+	up := newWebhookServer(t, "")
+
+	w = newTestWebhook(t, WebhookSettings{URL: up.URL, QueueDir: dir})
+	if err := w.Write("swaps", webhookResult(2), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(up.bodies) != 2 || up.bodies[0].Results[0].(map[string]any)["block"] != float64(1) {
+		t.Fatalf("unexpected batches %+v", up.bodies)
+	}
+
+	// Batches that don't fit in the queue are dropped
+	w = newTestWebhook(t, WebhookSettings{URL: up.URL, QueueDir: dir, MaxQueueSize: 10})
+	if err := w.Write("swaps", webhookResult(3), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Dropped() != 1 || len(up.bodies) != 2 {
+		t.Fatalf("expected 1 dropped result, got %d", w.Dropped())
+	}
+}
@@ -0,0 +1,51 @@
+package types
+
+// ChainInfo describes an EVM chain. Custom chains can be defined in the `chains` section of the config.
+type ChainInfo struct {
+	// Rpc is the API url of the chain. Websockets are required for realtime mode.
+	Rpc string `yaml:"rpc"`
+	// ChainID is verified against eth_chainId when connecting.
+	ChainID uint64 `yaml:"chain_id"`
+	// NativeSymbol is the symbol of the native token, like ETH.
+	NativeSymbol string `yaml:"native_symbol"`
+	// NativeDecimals are the decimals of the native token.
+	NativeDecimals uint8 `yaml:"native_decimals"`
+	// BlockTime is the average time between blocks in seconds. If it's 0,
+	// it's estimated from the first and the latest block.
+	BlockTime float64 `yaml:"block_time"`
+}
+
+// DefaultChains contains the metadata of the chains that are supported out of the box.
+var DefaultChains = map[Chain]ChainInfo{
+	ETHEREUM: {ChainID: 1, NativeSymbol: "ETH", NativeDecimals: 18},
+	AVAX:     {ChainID: 43114, NativeSymbol: "AVAX", NativeDecimals: 18},
+	ARBITRUM: {ChainID: 42161, NativeSymbol: "ETH", NativeDecimals: 18},
+	OPTIMISM: {ChainID: 10, NativeSymbol: "ETH", NativeDecimals: 18},
+	POLYGON:  {ChainID: 137, NativeSymbol: "MATIC", NativeDecimals: 18},
+	FANTOM:   {ChainID: 250, NativeSymbol: "FTM", NativeDecimals: 18},
+}
+
+// Merge returns the info with every field that is set in o overridden.
+func (i ChainInfo) Merge(o ChainInfo) ChainInfo {
+	if o.Rpc != "" {
+		i.Rpc = o.Rpc
+	}
+
+	if o.ChainID != 0 {
+		i.ChainID = o.ChainID
+	}
+
+	if o.NativeSymbol != "" {
+		i.NativeSymbol = o.NativeSymbol
+	}
+
+	if o.NativeDecimals != 0 {
+		i.NativeDecimals = o.NativeDecimals
+	}
+
+	if o.BlockTime != 0 {
+		i.BlockTime = o.BlockTime
+	}
+
+	return i
+}
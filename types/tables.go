@@ -0,0 +1,29 @@
+package types
+
+import "fmt"
+
+// TableMode determines what the database outputs do with the existing table of a query.
+type TableMode string
+
+const (
+	// TableAppend inserts into the existing table, and adds the columns it's missing.
+	// It's the default, so rerunning a query never deletes data.
+	TableAppend TableMode = "append"
+	// TableReplace drops the existing table and creates it again.
+	TableReplace TableMode = "replace"
+	// TableUpsert inserts into the existing table like TableAppend, but updates the
+	// rows that have the same keys instead of adding duplicates.
+	TableUpsert TableMode = "upsert"
+)
+
+// ParseTableMode parses the table mode of a query. An empty mode is TableAppend.
+func ParseTableMode(mode string) (TableMode, error) {
+	switch TableMode(mode) {
+	case "", TableAppend:
+		return TableAppend, nil
+	case TableReplace, TableUpsert:
+		return TableMode(mode), nil
+	}
+
+	return "", fmt.Errorf("unknown table_mode %s, expected append, replace or upsert", mode)
+}
@@ -1,6 +1,10 @@
 package types
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
 
 type Chain string
 
@@ -19,6 +23,8 @@ type ApolloOpts struct {
 	Db         bool
 	Csv        bool
 	Stdout     bool
+	Json       bool
+	Exact      bool
 	Interval   int64
 	StartBlock int64
 	EndBlock   int64
@@ -26,6 +32,42 @@ type ApolloOpts struct {
 	Chain      string
 	LogLevel   int
 	LogParts   int
+	// StdoutFormat is the format of the stdout output, text or json
+	StdoutFormat string
+	// Parquet enables the Parquet output, configured by the other Parquet options
+	Parquet             bool
+	ParquetRowGroupSize int64
+	ParquetCompression  string
+	ParquetMaxRows      int64
+	ParquetMaxBlocks    uint64
+	// DbBatchSize and DbFlushInterval determine when the pending rows of the db and sqlite
+	// outputs are committed: when a batch is full, or every interval.
+	DbBatchSize     int
+	DbFlushInterval time.Duration
+	// SQLitePath is the database file of the SQLite output. If it's empty, the output is disabled.
+	SQLitePath string
+	// Webhook enables the webhook output, configured in the `webhook` section of the config
+	Webhook bool
+	// StreamAddr is the address of the WebSocket and SSE server. If it's empty, the server is not started.
+	StreamAddr string
+	// StreamReplay is the number of results per query that new stream clients get first
+	StreamReplay int
+	// StreamSlowClients is what happens to stream clients that don't keep up: drop or disconnect
+	StreamSlowClients string
+	// ConfigPath is the path to the config file
+	ConfigPath string
+	// SchemaPath is the path to a schema file or a directory of schema files
+	SchemaPath string
+	// AbiDir is the directory relative ABI paths are resolved in. If it's empty,
+	// they're relative to the schema.
+	AbiDir string
+	// OutputDir is the directory output files (like CSV) are written to
+	OutputDir string
+	// StateDir is where the state of stateful queries is persisted. If it's empty,
+	// state is not persisted.
+	StateDir string
+	// Unordered disables sorting historical results in chain order, for more throughput.
+	Unordered bool
 }
 
 type ResultType int
@@ -53,6 +95,36 @@ type CallResult struct {
 	TxSender  common.Address
 	TxIndex   uint
 	TxHash    common.Hash
+	LogIndex  uint
 	Inputs    map[string]any
 	Outputs   map[string]any
 }
+
+// Position is the position of a result on the chain. It's used
+// to process results in a deterministic order.
+type Position struct {
+	BlockNumber uint64 `json:"block_number"`
+	TxIndex     uint   `json:"tx_index"`
+	LogIndex    uint   `json:"log_index"`
+}
+
+// Before returns true if p comes before o on the chain.
+func (p Position) Before(o Position) bool {
+	if p.BlockNumber != o.BlockNumber {
+		return p.BlockNumber < o.BlockNumber
+	}
+
+	if p.TxIndex != o.TxIndex {
+		return p.TxIndex < o.TxIndex
+	}
+
+	return p.LogIndex < o.LogIndex
+}
+
+func (cr CallResult) Position() Position {
+	return Position{
+		BlockNumber: cr.BlockNumber,
+		TxIndex:     cr.TxIndex,
+		LogIndex:    cr.LogIndex,
+	}
+}